@@ -0,0 +1,334 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buraksezer/consistent"
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoMembers          = errors.New("no storage node available")
+	ErrInvalidVersion     = errors.New("invalid version")
+	ErrVersionUnavailable = errors.New("node holding the version left the ring")
+)
+
+// Consistency model: a node serves its objects with read-your-writes consistency, as the
+// engine applies writes in order. A write goes to the owner of its object, and so does a
+// read, so a read sees the write unless membership changed in between or the read fell back
+// to another node. Writes return a Version naming the node and its sequence number after
+// the write, GetVersion reads from that node only and fails unless the node reached the
+// sequence number. A node which left the ring took its objects along, as writes aren't
+// replicated, so reading the version of such a write fails with ErrVersionUnavailable.
+const (
+	VersionHeader    = "x-mos-version"
+	MinVersionHeader = "x-mos-min-version"
+)
+
+// RequestIDHeader carries the ID of a request to the storage node, which logs it
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose requests to storage nodes carry id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of ctx, it is empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Version names a write, it was applied on Endpoint by the time it reached Seq
+type Version struct {
+	Endpoint string
+	Seq      uint64
+}
+
+// String returns the token of the version, seq@endpoint
+func (v Version) String() string {
+	return fmt.Sprintf("%d@%s", v.Seq, v.Endpoint)
+}
+
+// ParseVersion parses the token of a version
+func ParseVersion(token string) (Version, error) {
+	seq, endpoint, ok := strings.Cut(token, "@")
+	if !ok || endpoint == "" {
+		return Version{}, ErrInvalidVersion
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return Version{}, ErrInvalidVersion
+	}
+	return Version{Endpoint: endpoint, Seq: n}, nil
+}
+
+// Member is a storage node address on the ring
+type Member string
+
+func (m Member) String() string {
+	return string(m)
+}
+
+// Hasher hashes keys on the ring with xxhash
+type Hasher struct{}
+
+func (h Hasher) Sum64(data []byte) uint64 {
+	return xxhash.Sum64(data)
+}
+
+// KeyFunc extracts the part of an object key which locates it on the ring,
+// objects with the same extracted key land on the same node
+type KeyFunc func(username, objectname string) []byte
+
+func ObjectKey(username, objectname string) []byte {
+	return []byte(fmt.Sprintf("%s_%s", username, objectname))
+}
+
+// UserKey co-locates all objects of a user
+func UserKey(username, objectname string) []byte {
+	return []byte(username)
+}
+
+// PrefixKey co-locates objects of a user whose names share the prefix before delimiter
+func PrefixKey(delimiter string) KeyFunc {
+	return func(username, objectname string) []byte {
+		prefix, _, _ := strings.Cut(objectname, delimiter)
+		return []byte(fmt.Sprintf("%s_%s", username, prefix))
+	}
+}
+
+// Response is the response of the storage node which served a request
+type Response struct {
+	Endpoint   string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Version returns the version of the write which got the response, false if the node
+// returned none
+func (r *Response) Version() (Version, bool) {
+	seq, err := strconv.ParseUint(r.Header.Get(VersionHeader), 10, 64)
+	if err != nil {
+		return Version{}, false
+	}
+	return Version{Endpoint: r.Endpoint, Seq: seq}, true
+}
+
+// Client routes object requests to the storage nodes on a consistent hash ring
+type Client struct {
+	mutex      sync.Mutex
+	ring       *consistent.Consistent
+	httpClient *http.Client
+	keyFunc    KeyFunc
+	replicas   int
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(c *Client) {
+		c.keyFunc = keyFunc
+	}
+}
+
+// WithReplicas sets how many of the closest nodes Get tries in turn when a node fails,
+// only a node holding the object answers in place of the owner
+func WithReplicas(replicas int) Option {
+	return func(c *Client) {
+		c.replicas = replicas
+	}
+}
+
+// New creates a client routing over ring, membership changes are applied
+// with Add, Remove and SetMembers
+func New(ring *consistent.Consistent, options ...Option) *Client {
+	c := &Client{
+		ring:       ring,
+		httpClient: http.DefaultClient,
+		keyFunc:    ObjectKey,
+		replicas:   1,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+func (c *Client) Add(endpoint string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ring.Add(Member(endpoint))
+}
+
+func (c *Client) Remove(endpoint string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ring.Remove(endpoint)
+}
+
+// SetMembers adds and removes ring members so that they match members
+func (c *Client) SetMembers(members []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expected := make(map[string]struct{}, len(members))
+	for _, endpoint := range members {
+		expected[endpoint] = struct{}{}
+	}
+	for _, m := range c.ring.GetMembers() {
+		if _, ok := expected[m.String()]; !ok {
+			c.ring.Remove(m.String())
+		}
+		delete(expected, m.String())
+	}
+	for endpoint := range expected {
+		c.ring.Add(Member(endpoint))
+	}
+}
+
+func (c *Client) Members() []string {
+	members := c.ring.GetMembers()
+	endpoints := make([]string, 0, len(members))
+	for _, m := range members {
+		endpoints = append(endpoints, m.String())
+	}
+	return endpoints
+}
+
+// Locate returns the node owning the object
+func (c *Client) Locate(username, objectname string) (string, error) {
+	m := c.ring.LocateKey(c.keyFunc(username, objectname))
+	if m == nil {
+		return "", ErrNoMembers
+	}
+	return m.String(), nil
+}
+
+func (c *Client) Put(ctx context.Context, username, objectname string, value []byte) (*Response, error) {
+	endpoint, err := c.Locate(username, objectname)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "PUT", endpoint, username, objectname, value, nil)
+}
+
+// Get reads the object from its owner, falling back to the next closest nodes
+// holding it when the owner is unreachable or fails
+func (c *Client) Get(ctx context.Context, username, objectname string) (*Response, error) {
+	return c.read(ctx, "GET", username, objectname)
+}
+
+// Head works like Get, the response has the headers of the object only
+func (c *Client) Head(ctx context.Context, username, objectname string) (*Response, error) {
+	return c.read(ctx, "HEAD", username, objectname)
+}
+
+func (c *Client) read(ctx context.Context, method, username, objectname string) (*Response, error) {
+	count := c.replicas
+	if n := len(c.ring.GetMembers()); count > n {
+		count = n
+	}
+	if count == 0 {
+		return nil, ErrNoMembers
+	}
+	members, err := c.ring.GetClosestN(c.keyFunc(username, objectname), count)
+	if err != nil {
+		return nil, errors.Wrap(err, "get closest nodes")
+	}
+	// writes go to the owner only, so a node tried after it not having the object is a
+	// miss, not the answer, and the failure of the owner is returned
+	var owner *Response
+	var ownerErr error
+	for i, m := range members {
+		resp, err := c.do(ctx, method, m.String(), username, objectname, nil, nil)
+		if i == 0 {
+			owner, ownerErr = resp, err
+		}
+		if err == nil && resp.StatusCode < http.StatusInternalServerError && (i == 0 || resp.StatusCode != http.StatusNotFound) {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return owner, ownerErr
+}
+
+func (c *Client) Delete(ctx context.Context, username, objectname string) (*Response, error) {
+	endpoint, err := c.Locate(username, objectname)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "DELETE", endpoint, username, objectname, nil, nil)
+}
+
+// GetVersion reads the object from the node which applied the write of version, the
+// node responds with 503 if it hasn't reached the version. There is no fallback to other
+// nodes, as they may not have the write.
+func (c *Client) GetVersion(ctx context.Context, username, objectname string, version Version) (*Response, error) {
+	if !c.isMember(version.Endpoint) {
+		return nil, ErrVersionUnavailable
+	}
+	header := http.Header{}
+	header.Set(MinVersionHeader, strconv.FormatUint(version.Seq, 10))
+	return c.do(ctx, "GET", version.Endpoint, username, objectname, nil, header)
+}
+
+func (c *Client) isMember(endpoint string) bool {
+	for _, m := range c.ring.GetMembers() {
+		if m.String() == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) do(ctx context.Context, method, endpoint, username, objectname string, value []byte, header http.Header) (*Response, error) {
+	var body io.Reader
+	if value != nil {
+		body = bytes.NewReader(value)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s/%s", endpoint, objectname), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "construct request")
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-mos-username", username)
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "send request")
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response")
+	}
+	return &Response{
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       data,
+	}, nil
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buraksezer/consistent"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNode is an in memory storage node
+type fakeNode struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	seq     uint64
+	server  *httptest.Server
+}
+
+func newFakeNode() *fakeNode {
+	n := &fakeNode{objects: make(map[string][]byte)}
+	n.server = httptest.NewServer(http.HandlerFunc(n.serveHTTP))
+	return n
+}
+
+func (n *fakeNode) endpoint() string {
+	return strings.TrimPrefix(n.server.URL, "http://")
+}
+
+func (n *fakeNode) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	key := r.Header.Get("x-mos-username") + "_" + strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case "PUT":
+		value, _ := io.ReadAll(r.Body)
+		n.objects[key] = value
+		n.seq++
+		w.Header().Set(VersionHeader, strconv.FormatUint(n.seq, 10))
+	case "GET", "HEAD":
+		if min, err := strconv.ParseUint(r.Header.Get(MinVersionHeader), 10, 64); err == nil && min > n.seq {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		value, ok := n.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		if r.Method == "GET" {
+			w.Write(value)
+		}
+	case "DELETE":
+		delete(n.objects, key)
+		n.seq++
+		w.Header().Set(VersionHeader, strconv.FormatUint(n.seq, 10))
+	}
+}
+
+func newTestClient(nodes []*fakeNode, options ...Option) *Client {
+	var members []consistent.Member
+	for _, n := range nodes {
+		members = append(members, Member(n.endpoint()))
+	}
+	ring := consistent.New(members, consistent.Config{
+		Hasher:            Hasher{},
+		PartitionCount:    271,
+		ReplicationFactor: 20,
+		Load:              1.25,
+	})
+	return New(ring, options...)
+}
+
+func TestClient(t *testing.T) {
+	nodes := []*fakeNode{newFakeNode(), newFakeNode(), newFakeNode()}
+	for _, n := range nodes {
+		defer n.server.Close()
+	}
+	c := newTestClient(nodes)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		objectname := fmt.Sprintf("test_%d", i)
+		value := []byte(fmt.Sprintf("%01024d", i))
+		resp, err := c.Put(ctx, "admin", objectname, value)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		// stored only on the owner
+		endpoint, err := c.Locate("admin", objectname)
+		require.Nil(t, err)
+		for _, n := range nodes {
+			_, ok := n.objects["admin_"+objectname]
+			require.Equal(t, n.endpoint() == endpoint, ok)
+		}
+		resp, err = c.Get(ctx, "admin", objectname)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, value, resp.Body)
+		resp, err = c.Head(ctx, "admin", objectname)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "1024", resp.Header.Get("Content-Length"))
+		require.Empty(t, resp.Body)
+		resp, err = c.Delete(ctx, "admin", objectname)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp, err = c.Get(ctx, "admin", objectname)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestClientGetFailover(t *testing.T) {
+	nodes := []*fakeNode{newFakeNode(), newFakeNode()}
+	for _, n := range nodes {
+		defer n.server.Close()
+	}
+	c := newTestClient(nodes, WithReplicas(2))
+	ctx := context.Background()
+	value := []byte("value")
+	endpoint, err := c.Locate("admin", "test")
+	require.Nil(t, err)
+	// the replica holds a copy, the owner goes down
+	for _, n := range nodes {
+		n.objects["admin_test"] = value
+	}
+	for _, n := range nodes {
+		if n.endpoint() == endpoint {
+			n.server.Close()
+		}
+	}
+	resp, err := c.Get(ctx, "admin", "test")
+	require.Nil(t, err)
+	require.Equal(t, value, resp.Body)
+
+	// a replica without the object doesn't hide the failure of the owner as not found
+	for _, n := range nodes {
+		delete(n.objects, "admin_test")
+	}
+	_, err = c.Get(ctx, "admin", "test")
+	require.NotNil(t, err)
+
+	// without replicas the failure is returned
+	c.replicas = 1
+	_, err = c.Get(ctx, "admin", "test")
+	require.NotNil(t, err)
+}
+
+func TestSetMembers(t *testing.T) {
+	c := newTestClient(nil)
+	_, err := c.Locate("admin", "test")
+	require.Equal(t, ErrNoMembers, err)
+	_, err = c.Get(context.Background(), "admin", "test")
+	require.Equal(t, ErrNoMembers, err)
+
+	members := []string{"10.0.0.0:8080", "10.0.0.1:8080", "10.0.1.0:8080"}
+	c.SetMembers(members)
+	require.ElementsMatch(t, members, c.Members())
+	c.SetMembers(members[1:])
+	require.ElementsMatch(t, members[1:], c.Members())
+	for i := 0; i < 100; i++ {
+		endpoint, err := c.Locate("admin", fmt.Sprintf("%d", i))
+		require.Nil(t, err)
+		require.Contains(t, members[1:], endpoint)
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	nodes := []*fakeNode{newFakeNode(), newFakeNode()}
+	for _, n := range nodes {
+		defer n.server.Close()
+	}
+	c := newTestClient(nodes[:1])
+	ctx := context.Background()
+	resp, err := c.Put(ctx, "admin", "test", []byte("value"))
+	require.Nil(t, err)
+	version, ok := resp.Version()
+	require.True(t, ok)
+	require.Equal(t, nodes[0].endpoint(), version.Endpoint)
+	parsed, err := ParseVersion(version.String())
+	require.Nil(t, err)
+	require.Equal(t, version, parsed)
+
+	// the versioned read goes to the node of the write whichever node owns the object now
+	c.SetMembers([]string{nodes[0].endpoint(), nodes[1].endpoint()})
+	resp, err = c.GetVersion(ctx, "admin", "test", version)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []byte("value"), resp.Body)
+
+	// the node must have reached the version
+	resp, err = c.GetVersion(ctx, "admin", "test", Version{Endpoint: version.Endpoint, Seq: version.Seq + 1})
+	require.Nil(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	c.Remove(nodes[0].endpoint())
+	_, err = c.GetVersion(ctx, "admin", "test", version)
+	require.Equal(t, ErrVersionUnavailable, err)
+
+	for _, token := range []string{"", "1", "x@node", "1@"} {
+		_, err := ParseVersion(token)
+		require.Equal(t, ErrInvalidVersion, err)
+	}
+}
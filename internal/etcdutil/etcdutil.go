@@ -0,0 +1,50 @@
+// Package etcdutil holds what the proxy and the storage nodes share for talking to etcd.
+package etcdutil
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RequestTimeout bounds a single etcd request
+const RequestTimeout = 5 * time.Second
+
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// jitter is seeded on its own, so processes started together don't share the sequence
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Retry calls f with exponential backoff until it succeeds or timeout is exceeded, a
+// timeout of 0 retries until f succeeds. The backoff is jittered, so processes cut off
+// from etcd together don't retry in lockstep once it is back.
+func Retry(name string, timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	backoff := minRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if timeout > 0 && time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%s failed after %d attempts: %w", name, attempt, err)
+		}
+		jitter.Lock()
+		wait := backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)+1))
+		jitter.Unlock()
+		log.Printf("%s attempt %d error: %s, retrying in %s", name, attempt, err, wait)
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
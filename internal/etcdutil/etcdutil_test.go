@@ -0,0 +1,30 @@
+package etcdutil
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := Retry("test", time.Second, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = Retry("test", 300*time.Millisecond, func() error {
+		attempts++
+		return errors.New("unavailable")
+	})
+	require.NotNil(t, err)
+	require.True(t, attempts > 1)
+}
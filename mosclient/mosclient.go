@@ -0,0 +1,180 @@
+// Package mosclient is a client for applications storing objects in mos, it talks to
+// one endpoint, a proxy or a single storage node
+package mosclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+const metaHeaderPrefix = "x-mos-meta-"
+
+// Error is an error response other than 404, Code is one of the stable codes of the
+// server, it is empty if the response had no error body
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("mos: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("mos: status %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	// ObjectType is the x-mos-object-type the object was put with
+	ObjectType string
+	// Meta holds the x-mos-meta-* headers the object was put with, by their names
+	// without the prefix
+	Meta map[string]string
+}
+
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// New creates a client of endpoint, given as host:port or as a URL
+func New(endpoint string, options ...Option) *Client {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	c := &Client{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Put stores the content of r as the object name of user, name is bucket/objectname
+// for an object in a bucket
+func (c *Client) Put(ctx context.Context, user, name string, r io.Reader) error {
+	resp, err := c.do(ctx, http.MethodPut, user, name, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Get returns the content of an object, the caller closes it
+func (c *Client) Get(ctx context.Context, user, name string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, user, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) Delete(ctx context.Context, user, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, user, name, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Stat describes an object without reading its content
+func (c *Client) Stat(ctx context.Context, user, name string) (*ObjectInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, user, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{
+		Size:       resp.ContentLength,
+		ETag:       resp.Header.Get("ETag"),
+		ObjectType: resp.Header.Get("x-mos-object-type"),
+	}
+	if modified := resp.Header.Get("Last-Modified"); modified != "" {
+		if info.LastModified, err = http.ParseTime(modified); err != nil {
+			return nil, errors.Wrap(err, "parse last modified")
+		}
+	}
+	for name, values := range resp.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, metaHeaderPrefix) {
+			if info.Meta == nil {
+				info.Meta = make(map[string]string)
+			}
+			info.Meta[strings.TrimPrefix(name, metaHeaderPrefix)] = strings.Join(values, ",")
+		}
+	}
+	return info, nil
+}
+
+func (c *Client) do(ctx context.Context, method, user, name string, body io.Reader) (*http.Response, error) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+"/"+strings.Join(segments, "/"), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "construct request")
+	}
+	req.Header.Set("x-mos-username", user)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "send request")
+	}
+	return resp, nil
+}
+
+// checkResponse turns an error response into ErrNotFound or an *Error, the body of
+// an error response is consumed
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	e := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+	}
+	return e
+}
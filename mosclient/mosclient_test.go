@@ -0,0 +1,79 @@
+package mosclient
+
+import (
+	"context"
+	"io"
+	"mos/storage/engine"
+	"mos/storage/server"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	s, err := server.NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+	ts := httptest.NewServer(s.SetRouter())
+	defer ts.Close()
+
+	c := New(strings.TrimPrefix(ts.URL, "http://"))
+	ctx := context.Background()
+	// objects outside and in buckets, the chunked one is read the same way
+	for _, name := range []string{"object", "bucket/object", "chunked object"} {
+		err := c.Put(ctx, "user", name, strings.NewReader("value of "+name))
+		require.Nil(t, err)
+		r, err := c.Get(ctx, "user", name)
+		require.Nil(t, err)
+		value, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Nil(t, r.Close())
+		require.Equal(t, "value of "+name, string(value))
+
+		info, err := c.Stat(ctx, "user", name)
+		require.Nil(t, err)
+		require.Equal(t, int64(len("value of "+name)), info.Size)
+		require.NotEmpty(t, info.ETag)
+		require.WithinDuration(t, time.Now(), info.LastModified, time.Minute)
+
+		err = c.Delete(ctx, "user", name)
+		require.Nil(t, err)
+		_, err = c.Get(ctx, "user", name)
+		require.Equal(t, ErrNotFound, err)
+		_, err = c.Stat(ctx, "user", name)
+		require.Equal(t, ErrNotFound, err)
+	}
+
+	// other error responses carry the code of the server
+	err = c.Put(ctx, "", "object", strings.NewReader("value"))
+	e, ok := err.(*Error)
+	require.True(t, ok)
+	require.Equal(t, http.StatusBadRequest, e.StatusCode)
+	require.Equal(t, server.CodeEmptyUserName, e.Code)
+}
+
+func TestStatMeta(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "user", r.Header.Get("x-mos-username"))
+		require.Equal(t, "/a%20b/c", r.URL.EscapedPath())
+		w.Header().Set("x-mos-meta-owner", "alice")
+		w.Header().Set("x-mos-object-type", "temporary")
+		w.Header().Set("Content-Length", "5")
+	}))
+	defer ts.Close()
+
+	info, err := New(ts.URL).Stat(context.Background(), "user", "a b/c")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"owner": "alice"}, info.Meta)
+	require.Equal(t, "temporary", info.ObjectType)
+	require.Equal(t, int64(5), info.Size)
+}
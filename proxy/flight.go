@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"mos/client"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces concurrent requests with the same key into one request to the
+// storage node, whose response all of them get, like golang.org/x/sync/singleflight.
+// The response is shared, so it must not be modified.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	// id is the request ID the storage node gets, the one of the request starting the call
+	id   string
+	done chan struct{}
+	resp *client.Response
+	err  error
+	// callers counts the requests waiting for the flight, the first one included
+	callers int
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do calls f unless a call with key is in flight, then it joins that call, and returns
+// the result once the call is done, shared reports whether the result went to other
+// callers too. The call belongs to no caller: f must not use the context of the request
+// starting it but a detached one, and a caller whose ctx is done stops waiting with the
+// error of ctx while the others still get the result.
+func (g *flightGroup) do(ctx context.Context, key string, f func() (*client.Response, error)) (resp *client.Response, err error, shared bool) {
+	g.mutex.Lock()
+	fl, ok := g.flights[key]
+	if ok {
+		fl.callers++
+		// the storage node logs the call under the request ID of the first caller only
+		log.Printf("request_id=%s joins the request to the storage node of request_id=%s", client.RequestID(ctx), fl.id)
+	} else {
+		fl = &flight{id: client.RequestID(ctx), done: make(chan struct{}), callers: 1}
+		g.flights[key] = fl
+		go func() {
+			fl.resp, fl.err = f()
+			g.mutex.Lock()
+			delete(g.flights, key)
+			g.mutex.Unlock()
+			close(fl.done)
+		}()
+	}
+	g.mutex.Unlock()
+	select {
+	case <-fl.done:
+		g.mutex.Lock()
+		shared = fl.callers > 1
+		g.mutex.Unlock()
+		return fl.resp, fl.err, shared
+	case <-ctx.Done():
+		g.mutex.Lock()
+		fl.callers--
+		g.mutex.Unlock()
+		return nil, ctx.Err(), false
+	}
+}
+
+// callers returns the number of requests waiting for the flight of key
+func (g *flightGroup) callers(key string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if fl, ok := g.flights[key]; ok {
+		return fl.callers
+	}
+	return 0
+}
+
+// detachedContext has the values of its parent but is never done, so a call shared by
+// several requests outlives the one which started it, like context.WithoutCancel. The
+// client timeout, -request-timeout, still bounds the call.
+type detachedContext struct {
+	parent context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
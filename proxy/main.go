@@ -1,36 +1,55 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mos/client"
+	"mos/internal/etcdutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/buraksezer/consistent"
-	"github.com/cespare/xxhash"
 	"github.com/gin-gonic/gin"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-type member string
+var (
+	hashKey          = flag.String("hash-key", "object", "part of the object key placed on the ring: object, user or prefix")
+	hashKeyDelimiter = flag.String("hash-key-delimiter", ".", "delimiter ending the object name prefix for -hash-key=prefix")
 
-func (m member) String() string {
-	return string(m)
-}
+	partitionCount    = flag.Int("partition-count", envInt("MOS_PARTITION_COUNT", 65535), "number of partitions on the ring, env MOS_PARTITION_COUNT")
+	replicationFactor = flag.Int("replication-factor", envInt("MOS_REPLICATION_FACTOR", 20), "virtual nodes per member, env MOS_REPLICATION_FACTOR")
+	load              = flag.Float64("load", envFloat("MOS_LOAD", 1.25), "maximum load of a member relative to the average, env MOS_LOAD")
 
-type hasher struct{}
+	etcdTimeout = flag.Duration("etcd-timeout", time.Minute, "how long to wait for etcd at startup before giving up")
 
-func (h hasher) Sum64(data []byte) uint64 {
-	return xxhash.Sum64(data)
-}
+	readReplicas = flag.Int("read-replicas", 1, "closest nodes a read tries in turn when a node fails")
+
+	accessLog = flag.Bool("access-log", false, "log every request with its request ID")
+
+	maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", 256, "idle connections kept open to each storage node")
+	maxConnsPerHost     = flag.Int("max-conns-per-host", 0, "connections to each storage node, 0 means unlimited")
+	dialTimeout         = flag.Duration("dial-timeout", 5*time.Second, "timeout of connecting to a storage node")
+	idleConnTimeout     = flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle connection to a storage node is kept")
+	requestTimeout      = flag.Duration("request-timeout", time.Minute, "timeout of a request to a storage node including its body, 0 means none")
+
+	coalesceReads  = flag.Bool("coalesce-reads", false, "serve concurrent GETs of an object with one request to the storage node, a GET may get the value from before a PUT acknowledged while the request was in flight")
+	coalesceWrites = flag.Bool("coalesce-writes", false, "serve concurrent PUTs of an object with the same content with one request to the storage node")
+)
 
 var endpointPrefix = "/storage_node/"
 
@@ -38,6 +57,12 @@ var endpoints []consistent.Member
 
 var owners = make(map[int]string)
 
+// readFlights and writeFlights coalesce concurrent GETs and identical PUTs of an object
+var (
+	readFlights  = newFlightGroup()
+	writeFlights = newFlightGroup()
+)
+
 // 全局服务锁
 var serviceLocker = sync.RWMutex{}
 
@@ -53,26 +78,123 @@ var etcdCfg = clientv3.Config{
 }
 
 var consistentConfig = consistent.Config{
-	Hasher:            hasher{},
+	Hasher:            client.Hasher{},
 	PartitionCount:    65535,
 	ReplicationFactor: 20,
 	Load:              1.25,
 }
 
+func NewKeyFunc(name string, delimiter string) (client.KeyFunc, error) {
+	switch name {
+	case "object":
+		return client.ObjectKey, nil
+	case "user":
+		return client.UserKey, nil
+	case "prefix":
+		if delimiter == "" {
+			return nil, fmt.Errorf("empty prefix delimiter")
+		}
+		return client.PrefixKey(delimiter), nil
+	}
+	return nil, fmt.Errorf("unknown hash key %q", name)
+}
+
+func envInt(name string, value int) int {
+	if v, ok := os.LookupEnv(name); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("invalid %s %q, using %d", name, v, value)
+			return value
+		}
+		return n
+	}
+	return value
+}
+
+func envFloat(name string, value float64) float64 {
+	if v, ok := os.LookupEnv(name); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Printf("invalid %s %q, using %g", name, v, value)
+			return value
+		}
+		return f
+	}
+	return value
+}
+
+// newHTTPClient returns the client for requests to storage nodes, the default transport
+// keeps only 2 idle connections per host, so most requests under load would connect anew
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   *dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	transport.MaxConnsPerHost = *maxConnsPerHost
+	transport.IdleConnTimeout = *idleConnTimeout
+	return &http.Client{
+		Transport: transport,
+		Timeout:   *requestTimeout,
+	}
+}
+
+// validateConsistentConfig checks the ring can place every partition on members
+func validateConsistentConfig(config consistent.Config, members int) error {
+	if config.PartitionCount <= 0 {
+		return fmt.Errorf("partition count must be positive, got %d", config.PartitionCount)
+	}
+	if config.ReplicationFactor <= 0 {
+		return fmt.Errorf("replication factor must be positive, got %d", config.ReplicationFactor)
+	}
+	if config.Load < 1 {
+		return fmt.Errorf("load must be at least 1, got %g", config.Load)
+	}
+	if members == 0 {
+		return nil
+	}
+	if config.PartitionCount < members {
+		return fmt.Errorf("partition count %d is less than member count %d", config.PartitionCount, members)
+	}
+	// same as consistent.AverageLoad
+	avgLoad := math.Ceil(float64(config.PartitionCount/members) * config.Load)
+	if int(avgLoad)*members < config.PartitionCount {
+		return fmt.Errorf("load %g leaves no room for %d partitions on %d members", config.Load, config.PartitionCount, members)
+	}
+	return nil
+}
+
 func main() {
-	client, err := clientv3.New(etcdCfg)
+	flag.Parse()
+	consistentConfig.PartitionCount = *partitionCount
+	consistentConfig.ReplicationFactor = *replicationFactor
+	consistentConfig.Load = *load
+	keyFunc, err := NewKeyFunc(*hashKey, *hashKeyDelimiter)
 	if err != nil {
 		panic(err)
 	}
-	c, err := StartUp(client)
+	var etcdClient *clientv3.Client
+	var c *consistent.Consistent
+	err = etcdutil.Retry("connect etcd", *etcdTimeout, func() error {
+		if etcdClient == nil {
+			etcdClient, err = clientv3.New(etcdCfg)
+			if err != nil {
+				return err
+			}
+		}
+		c, err = StartUp(etcdClient)
+		return err
+	})
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	httpClient := &http.Client{}
+	cli := client.New(c, client.WithKeyFunc(keyFunc), client.WithReplicas(*readReplicas), client.WithHTTPClient(newHTTPClient()))
 	go func() {
-		DetectClusterChange(client, c, httpClient)
+		DetectClusterChange(etcdClient, cli)
 	}()
-	router := SetRouter(c, httpClient)
+	router := SetRouter(cli)
 	srv := http.Server{
 		Addr:    ":6666",
 		Handler: router,
@@ -93,50 +215,146 @@ func main() {
 	fmt.Println(sig)
 }
 
-func StartUp(client *clientv3.Client) (*consistent.Consistent, error) {
-	ctx := context.Background()
-	resp, err := client.Get(ctx, endpointPrefix, clientv3.WithPrefix())
+// watchRetryInterval is the wait before re-establishing a closed watch
+const watchRetryInterval = time.Second
+
+// listMembers returns the registered storage nodes and the etcd revision they were read at
+func listMembers(etcdClient *clientv3.Client) ([]string, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdutil.RequestTimeout)
+	defer cancel()
+	resp, err := etcdClient.Get(ctx, endpointPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	members := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		members = append(members, strings.TrimPrefix(string(kv.Key), endpointPrefix))
+	}
+	return members, resp.Header.Revision, nil
+}
+
+func StartUp(etcdClient *clientv3.Client) (*consistent.Consistent, error) {
+	members, _, err := listMembers(etcdClient)
 	if err != nil {
 		return nil, err
 	}
 	serviceLocker.Lock()
 	defer serviceLocker.Unlock()
-	for _, kv := range resp.Kvs {
-		key := string(kv.Key)
-		endpoint := strings.TrimPrefix(key, endpointPrefix)
-		endpoints = append(endpoints, member(endpoint))
+	// consistent.New only accepts an empty member list if it is nil
+	endpoints = nil
+	for _, endpoint := range members {
+		endpoints = append(endpoints, client.Member(endpoint))
 	}
+	if err := validateConsistentConfig(consistentConfig, len(endpoints)); err != nil {
+		return nil, err
+	}
+	log.Printf("consistent hashing with %d members, partition count %d, replication factor %d, load %g",
+		len(endpoints), consistentConfig.PartitionCount, consistentConfig.ReplicationFactor, consistentConfig.Load)
 	c := consistent.New(endpoints, consistentConfig)
-	for partID := 0; partID < consistentConfig.PartitionCount; partID++ {
+	for partID := 0; partID < consistentConfig.PartitionCount && len(endpoints) > 0; partID++ {
 		owners[partID] = c.GetPartitionOwner(partID).String()
 	}
 	return c, nil
 }
 
-func DetectClusterChange(client *clientv3.Client, c *consistent.Consistent, httpClient *http.Client) {
-	ctx := context.Background()
-	ch := client.Watch(ctx, endpointPrefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
-	for item := range ch {
-		for _, event := range item.Events {
-			key := string(event.Kv.Key)
-			endpoint := strings.TrimPrefix(key, endpointPrefix)
-			serviceLocker.Lock()
-			switch event.Type {
-			case clientv3.EventTypePut:
-				c.Add(member(endpoint))
-			case clientv3.EventTypeDelete:
-				c.Remove(endpoint)
+// Resync makes the ring match the full member set in etcd and returns the
+// revision it was read at
+func Resync(etcdClient *clientv3.Client, cli *client.Client) (int64, error) {
+	members, revision, err := listMembers(etcdClient)
+	if err != nil {
+		return 0, err
+	}
+	cli.SetMembers(members)
+	return revision, nil
+}
+
+// DetectClusterChange applies membership changes to the ring. The watch is
+// re-established when etcd drops it, and the full member set is re-synced
+// first so no change made in between is lost.
+func DetectClusterChange(etcdClient *clientv3.Client, cli *client.Client) {
+	for {
+		revision, err := Resync(etcdClient, cli)
+		if err != nil {
+			log.Printf("resync members error: %s", err)
+			time.Sleep(watchRetryInterval)
+			continue
+		}
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+		ch := etcdClient.Watch(ctx, endpointPrefix, clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithRev(revision+1))
+		for item := range ch {
+			if err := item.Err(); err != nil {
+				log.Printf("watch members error: %s", err)
+				break
+			}
+			for _, event := range item.Events {
+				key := string(event.Kv.Key)
+				endpoint := strings.TrimPrefix(key, endpointPrefix)
+				switch event.Type {
+				case clientv3.EventTypePut:
+					cli.Add(endpoint)
+				case clientv3.EventTypeDelete:
+					cli.Remove(endpoint)
+				}
 			}
-			serviceLocker.Unlock()
 		}
+		cancel()
+		log.Println("watch members closed, reconnecting")
+		time.Sleep(watchRetryInterval)
+	}
+}
+
+// requestID takes the request ID from X-Request-ID or generates one, it is returned in the
+// response and forwarded to the storage node, which logs it as well
+func requestID(ctx *gin.Context) {
+	id := ctx.GetHeader(client.RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx.Header(client.RequestIDHeader, id)
+	ctx.Request = ctx.Request.WithContext(client.WithRequestID(ctx.Request.Context(), id))
+	start := time.Now()
+	ctx.Next()
+	if *accessLog {
+		log.Printf("request_id=%s method=%s path=%s status=%d duration=%s",
+			id, ctx.Request.Method, ctx.Request.URL.Path, ctx.Writer.Status(), time.Since(start))
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sendError responds to a request the storage node couldn't be asked for
+func sendError(ctx *gin.Context, err error) {
+	log.Printf("request_id=%s send request error: %s", client.RequestID(ctx.Request.Context()), err)
+	ctx.String(http.StatusInternalServerError, "send request error: %s", err.Error())
+}
+
+// headHeaders are the headers describing an object which HEAD passes on from the node
+var headHeaders = []string{"Content-Length", "Content-Type", "ETag", "Last-Modified", "x-mos-object-type"}
+
+// setVersion passes the version of a write on to the client, which sends it back as
+// x-mos-version on reads that must see the write, see client.GetVersion
+func setVersion(ctx *gin.Context, resp *client.Response) {
+	if version, ok := resp.Version(); ok {
+		ctx.Header(client.VersionHeader, version.String())
 	}
 }
 
-func SetRouter(c *consistent.Consistent, httpClient *http.Client) http.Handler {
+// flightKey is the key of the flight of a request for an object, extra tells apart
+// requests for the same object which can't share a response
+func flightKey(username, objectname string, extra ...string) string {
+	return strings.Join(append([]string{username, objectname}, extra...), "\x00")
+}
+
+func SetRouter(cli *client.Client) http.Handler {
 	router := gin.New()
+	router.Use(requestID)
 	putObjectHandler := func(ctx *gin.Context) {
-		serviceLocker.Lock()
-		defer serviceLocker.Unlock()
 		objectname := ctx.Param("objectname")
 		if objectname == "" {
 			ctx.String(http.StatusBadRequest, "empty object name")
@@ -152,29 +370,23 @@ func SetRouter(c *consistent.Consistent, httpClient *http.Client) http.Handler {
 			ctx.String(http.StatusInternalServerError, "read object content error: %s", err.Error())
 			return
 		}
-		key := []byte(fmt.Sprintf("%s_%s", username, objectname))
-		endpoint := c.LocateKey(key).String()
-		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s", endpoint, objectname), bytes.NewReader(value))
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, "construct req error: %s", err.Error())
-			return
+		var resp *client.Response
+		if *coalesceWrites {
+			sum := sha256.Sum256(value)
+			resp, err, _ = writeFlights.do(ctx.Request.Context(), flightKey(username, objectname, string(sum[:])), func() (*client.Response, error) {
+				return cli.Put(detach(ctx.Request.Context()), username, objectname, value)
+			})
+		} else {
+			resp, err = cli.Put(ctx.Request.Context(), username, objectname, value)
 		}
-		req.Header.Set("x-mos-username", username)
-		resp, err := httpClient.Do(req)
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, "send request error: %s", err.Error())
+			sendError(ctx, err)
 			return
 		}
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, "read response error", err.Error())
-			return
-		}
-		ctx.String(resp.StatusCode, string(data))
+		setVersion(ctx, resp)
+		ctx.String(resp.StatusCode, string(resp.Body))
 	}
 	getObjectHandler := func(ctx *gin.Context) {
-		serviceLocker.RLock()
-		defer serviceLocker.RUnlock()
 		objectname := ctx.Param("objectname")
 		if objectname == "" {
 			ctx.String(http.StatusBadRequest, "empty object name")
@@ -185,29 +397,34 @@ func SetRouter(c *consistent.Consistent, httpClient *http.Client) http.Handler {
 			ctx.String(http.StatusBadRequest, "empty user name")
 			return
 		}
-		key := []byte(fmt.Sprintf("%s_%s", username, objectname))
-		endpoint := c.LocateKey(key).String()
-		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/%s", endpoint, objectname), nil)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, "construct req error: %s", err.Error())
-			return
-		}
-		req.Header.Set("x-mos-username", username)
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, "send request error: %s", err.Error())
-			return
+		var resp *client.Response
+		var err error
+		if token := ctx.GetHeader(client.VersionHeader); token != "" {
+			// the read must see the write the token was returned for
+			version, perr := client.ParseVersion(token)
+			if perr != nil {
+				ctx.String(http.StatusBadRequest, "invalid version")
+				return
+			}
+			resp, err = cli.GetVersion(ctx.Request.Context(), username, objectname, version)
+			if err == client.ErrVersionUnavailable {
+				ctx.String(http.StatusServiceUnavailable, "version unavailable: %s", err.Error())
+				return
+			}
+		} else if *coalesceReads {
+			resp, err, _ = readFlights.do(ctx.Request.Context(), flightKey(username, objectname), func() (*client.Response, error) {
+				return cli.Get(detach(ctx.Request.Context()), username, objectname)
+			})
+		} else {
+			resp, err = cli.Get(ctx.Request.Context(), username, objectname)
 		}
-		data, err := io.ReadAll(resp.Body)
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, "read response error", err.Error())
+			sendError(ctx, err)
 			return
 		}
-		ctx.Data(resp.StatusCode, "application/octet-stream", data)
+		ctx.Data(resp.StatusCode, "application/octet-stream", resp.Body)
 	}
-	deleteObjectHandler := func(ctx *gin.Context) {
-		serviceLocker.Lock()
-		defer serviceLocker.Unlock()
+	headObjectHandler := func(ctx *gin.Context) {
 		objectname := ctx.Param("objectname")
 		if objectname == "" {
 			ctx.String(http.StatusBadRequest, "empty object name")
@@ -218,28 +435,40 @@ func SetRouter(c *consistent.Consistent, httpClient *http.Client) http.Handler {
 			ctx.String(http.StatusBadRequest, "empty user name")
 			return
 		}
-		key := []byte(fmt.Sprintf("%s_%s", username, objectname))
-		endpoint := c.LocateKey(key).String()
-		req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s", endpoint, objectname), nil)
+		resp, err := cli.Head(ctx.Request.Context(), username, objectname)
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, "construct req error: %s", err.Error())
+			sendError(ctx, err)
 			return
 		}
-		req.Header.Set("x-mos-username", username)
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, "send request error: %s", err.Error())
+		for _, name := range headHeaders {
+			if value := resp.Header.Get(name); value != "" {
+				ctx.Header(name, value)
+			}
+		}
+		ctx.Status(resp.StatusCode)
+	}
+	deleteObjectHandler := func(ctx *gin.Context) {
+		objectname := ctx.Param("objectname")
+		if objectname == "" {
+			ctx.String(http.StatusBadRequest, "empty object name")
+			return
+		}
+		username := ctx.GetHeader("x-mos-username")
+		if username == "" {
+			ctx.String(http.StatusBadRequest, "empty user name")
 			return
 		}
-		data, err := io.ReadAll(resp.Body)
+		resp, err := cli.Delete(ctx.Request.Context(), username, objectname)
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, "read response error", err.Error())
+			sendError(ctx, err)
 			return
 		}
-		ctx.String(resp.StatusCode, string(data))
+		setVersion(ctx, resp)
+		ctx.String(resp.StatusCode, string(resp.Body))
 	}
 	router.PUT("/:objectname", putObjectHandler)
 	router.GET("/:objectname", getObjectHandler)
+	router.HEAD("/:objectname", headObjectHandler)
 	router.DELETE("/:objectname", deleteObjectHandler)
 	return router
 }
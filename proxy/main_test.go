@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"mos/client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/consistent"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRing() *consistent.Consistent {
+	members := make([]consistent.Member, 0, 8)
+	for i := 0; i < 8; i++ {
+		members = append(members, client.Member(fmt.Sprintf("10.0.0.%d:8080", i)))
+	}
+	return consistent.New(members, consistent.Config{
+		Hasher:            client.Hasher{},
+		PartitionCount:    271,
+		ReplicationFactor: 20,
+		Load:              1.25,
+	})
+}
+
+func TestKeyFuncColocation(t *testing.T) {
+	c := newTestRing()
+
+	keyFunc, err := NewKeyFunc("user", "")
+	require.Nil(t, err)
+	for _, username := range []string{"a", "b", "c"} {
+		expected := c.LocateKey(keyFunc(username, "0")).String()
+		for i := 0; i < 100; i++ {
+			objectname := fmt.Sprintf("%d", i)
+			require.Equal(t, expected, c.LocateKey(keyFunc(username, objectname)).String())
+		}
+	}
+
+	keyFunc, err = NewKeyFunc("prefix", ".")
+	require.Nil(t, err)
+	for _, prefix := range []string{"photos", "videos", "docs"} {
+		expected := c.LocateKey(keyFunc("a", prefix)).String()
+		for i := 0; i < 100; i++ {
+			objectname := fmt.Sprintf("%s.%d", prefix, i)
+			require.Equal(t, expected, c.LocateKey(keyFunc("a", objectname)).String())
+		}
+	}
+
+	// objects are spread over nodes by default
+	keyFunc, err = NewKeyFunc("object", "")
+	require.Nil(t, err)
+	nodes := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		nodes[c.LocateKey(keyFunc("a", fmt.Sprintf("%d", i))).String()] = struct{}{}
+	}
+	require.True(t, len(nodes) > 1)
+
+	_, err = NewKeyFunc("unknown", "")
+	require.NotNil(t, err)
+}
+
+func TestValidateConsistentConfig(t *testing.T) {
+	config := consistent.Config{
+		Hasher:            client.Hasher{},
+		PartitionCount:    271,
+		ReplicationFactor: 20,
+		Load:              1.25,
+	}
+	require.Nil(t, validateConsistentConfig(config, 0))
+	require.Nil(t, validateConsistentConfig(config, 8))
+	members := make([]consistent.Member, 0, 8)
+	for i := 0; i < 8; i++ {
+		members = append(members, client.Member(fmt.Sprintf("10.0.0.%d:8080", i)))
+	}
+	require.NotPanics(t, func() { consistent.New(members, config) })
+
+	require.NotNil(t, validateConsistentConfig(config, 300))
+	config.PartitionCount = 10
+	config.Load = 1
+	require.NotNil(t, validateConsistentConfig(config, 8))
+	config.PartitionCount = 0
+	require.NotNil(t, validateConsistentConfig(config, 0))
+	config.PartitionCount = 271
+	config.Load = 0.5
+	require.NotNil(t, validateConsistentConfig(config, 0))
+}
+
+func TestRequestID(t *testing.T) {
+	var forwarded []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get(client.RequestIDHeader))
+	}))
+	defer node.Close()
+	ring := consistent.New([]consistent.Member{client.Member(strings.TrimPrefix(node.URL, "http://"))}, consistent.Config{
+		Hasher:            client.Hasher{},
+		PartitionCount:    271,
+		ReplicationFactor: 20,
+		Load:              1.25,
+	})
+	router := SetRouter(client.New(ring))
+	do := func(id string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost:6666/test", nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		if id != "" {
+			req.Header.Set(client.RequestIDHeader, id)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := do("abc")
+	require.Equal(t, "abc", recorder.Header().Get(client.RequestIDHeader))
+	recorder = do("")
+	generated := recorder.Header().Get(client.RequestIDHeader)
+	require.NotEmpty(t, generated)
+	require.Equal(t, []string{"abc", generated}, forwarded)
+}
+
+func TestHeadObject(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Content-Length", "5")
+		if r.Method == "GET" {
+			w.Write([]byte("value"))
+		}
+	}))
+	defer node.Close()
+	ring := consistent.New([]consistent.Member{client.Member(strings.TrimPrefix(node.URL, "http://"))}, consistent.Config{
+		Hasher:            client.Hasher{},
+		PartitionCount:    271,
+		ReplicationFactor: 20,
+		Load:              1.25,
+	})
+	router := SetRouter(client.New(ring))
+	do := func(objectname string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("HEAD", "http://localhost:6666/"+objectname, nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := do("test")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, `"abc"`, recorder.Header().Get("ETag"))
+	require.Equal(t, "5", recorder.Header().Get("Content-Length"))
+	require.Empty(t, recorder.Body.String())
+	require.Equal(t, http.StatusNotFound, do("missing").Code)
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	hung := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer node.Close()
+	defer close(hung)
+
+	timeout := *requestTimeout
+	defer func() { *requestTimeout = timeout }()
+	*requestTimeout = 100 * time.Millisecond
+	httpClient := newHTTPClient()
+	require.Equal(t, *maxIdleConnsPerHost, httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost)
+
+	// a hung node fails the request instead of holding it forever
+	_, err := httpClient.Get(node.URL)
+	require.NotNil(t, err)
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	var gets, puts int32
+	release := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			atomic.AddInt32(&puts, 1)
+		} else {
+			atomic.AddInt32(&gets, 1)
+		}
+		<-release
+		w.Write([]byte("value"))
+	}))
+	defer node.Close()
+	ring := consistent.New([]consistent.Member{client.Member(strings.TrimPrefix(node.URL, "http://"))}, consistent.Config{
+		Hasher:            client.Hasher{},
+		PartitionCount:    271,
+		ReplicationFactor: 20,
+		Load:              1.25,
+	})
+	reads, writes := *coalesceReads, *coalesceWrites
+	defer func() { *coalesceReads, *coalesceWrites = reads, writes }()
+	*coalesceReads, *coalesceWrites = true, true
+	router := SetRouter(client.New(ring))
+	do := func(method string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:6666/test", strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	n := 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			recorder := do("GET", "")
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.Equal(t, "value", recorder.Body.String())
+		}()
+		// identical puts are coalesced, puts of other content aren't
+		go func() {
+			defer wg.Done()
+			require.Equal(t, http.StatusOK, do("PUT", "a").Code)
+		}()
+		go func() {
+			defer wg.Done()
+			require.Equal(t, http.StatusOK, do("PUT", "b").Code)
+		}()
+	}
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	require.Eventually(t, func() bool {
+		return readFlights.callers(flightKey("admin", "test")) == n &&
+			writeFlights.callers(flightKey("admin", "test", string(a[:]))) == n &&
+			writeFlights.callers(flightKey("admin", "test", string(b[:]))) == n
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&gets))
+	require.Equal(t, int32(2), atomic.LoadInt32(&puts))
+
+	// later requests go to the node again
+	require.Equal(t, http.StatusOK, do("GET", "").Code)
+	require.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	// a canceled first request doesn't fail the ones joining it
+	release = make(chan struct{})
+	reqCtx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, err := http.NewRequestWithContext(reqCtx, "GET", "http://localhost:6666/test", nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		canceled <- recorder
+	}()
+	require.Eventually(t, func() bool {
+		return readFlights.callers(flightKey("admin", "test")) == 1
+	}, 5*time.Second, time.Millisecond)
+	joined := make(chan *httptest.ResponseRecorder)
+	go func() {
+		joined <- do("GET", "")
+	}()
+	require.Eventually(t, func() bool {
+		return readFlights.callers(flightKey("admin", "test")) == 2
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	require.Equal(t, http.StatusInternalServerError, (<-canceled).Code)
+	close(release)
+	recorder := <-joined
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "value", recorder.Body.String())
+	require.Equal(t, int32(3), atomic.LoadInt32(&gets))
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// PutContentAddressed stores value under its hash, the hex SHA-256 of value, and returns
+// the hash. A value stored already isn't written again, so identical values are stored
+// once. Content addressed values are immutable, they can't be deleted safely while others
+// may refer to them, and keys of 64 hex digits are reserved for them.
+func (m *MKV) PutContentAddressed(value []byte) (string, error) {
+	return m.PutContentAddressedCtx(context.Background(), value)
+}
+
+// PutContentAddressedCtx works like PutContentAddressed and gives up when ctx is done
+func (m *MKV) PutContentAddressedCtx(ctx context.Context, value []byte) (string, error) {
+	sum := sha256.Sum256(value)
+	hash := hex.EncodeToString(sum[:])
+	if err := m.checkRecord([]byte(hash), value, 0); err != nil {
+		return "", err
+	}
+	if _, err := m.putIfAbsent(ctx, []byte(hash), value, 0); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// IsContentHash reports whether hash may be the hash of a content addressed value
+func IsContentHash(hash string) bool {
+	if len(hash) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
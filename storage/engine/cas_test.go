@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutContentAddressed(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	hash, err := s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	require.Equal(t, "cd42404d52ad55ccfa9aca4adc828aa5800ad9d385a0671fbcbf724118320619", hash)
+	require.True(t, IsContentHash(hash))
+	value, err := s.Get([]byte(hash))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// identical values are stored once
+	size := s.cur.Size()
+	again, err := s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	require.Equal(t, hash, again)
+	require.Equal(t, size, s.cur.Size())
+
+	other, err := s.PutContentAddressed([]byte("other value"))
+	require.Nil(t, err)
+	require.NotEqual(t, hash, other)
+
+	require.False(t, IsContentHash("key"))
+	require.False(t, IsContentHash("CD42404D52AD55CCFA9ACA4ADC828AA5800AD9D385A0671FBCBF724118320619"))
+}
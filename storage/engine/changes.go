@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var ErrChangesLost = errors.New("changes since the sequence number are no longer retained")
+
+// KeyChange is the latest write to a key, Seq is the sequence number of that write
+type KeyChange struct {
+	Key     string
+	Seq     uint64
+	Deleted bool
+}
+
+// tombstone is where and when a key was deleted
+type tombstone struct {
+	id  int
+	seq uint64
+}
+
+// ChangedSince returns the keys written or deleted after the write with sequence
+// number seq, ordered by the sequence number of their latest write. A key changed
+// several times is returned once, with its latest write.
+//
+// Writes are found in the index. The index doesn't hold deleted keys, so deletes are
+// kept in memory from the open of the store until a merge drops their tombstones.
+// If seq is older than the open of the store or a dropped delete, ErrChangesLost is
+// returned and the caller has to sync all keys again. Callers should take their first
+// cursor from Seq before a full sync and keep it current, as merges raise the floor.
+func (m *MKV) ChangedSince(seq uint64) ([]KeyChange, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if seq < m.changesFloor {
+		return nil, ErrChangesLost
+	}
+	var changes []KeyChange
+	for key, entry := range m.index {
+		if entry.Seq > seq {
+			changes = append(changes, KeyChange{Key: key, Seq: entry.Seq})
+		}
+	}
+	for key, t := range m.deletes {
+		if t.seq > seq {
+			changes = append(changes, KeyChange{Key: key, Seq: t.seq, Deleted: true})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Seq < changes[j].Seq
+	})
+	return changes, nil
+}
+
+// Seq returns the sequence number of the latest write
+func (m *MKV) Seq() uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.seq
+}
+
+// pruneDeletes forgets the deletes whose tombstones are in data files up to last,
+// which a merge just dropped
+func (m *MKV) pruneDeletes(last int) {
+	for key, t := range m.deletes {
+		if t.id > last {
+			continue
+		}
+		if t.seq > m.changesFloor {
+			m.changesFloor = t.seq
+		}
+		delete(m.deletes, key)
+	}
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedSince(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		err := s.Put([]byte(key), []byte("value"))
+		require.Nil(t, err)
+	}
+	cursor := s.Seq()
+	require.Equal(t, uint64(3), cursor)
+	err = s.Put([]byte("a"), []byte("changed"))
+	require.Nil(t, err)
+	err = s.Delete([]byte("b"))
+	require.Nil(t, err)
+	err = s.Put([]byte("d"), []byte("value"))
+	require.Nil(t, err)
+	// a key deleted and written again is a write
+	err = s.Delete([]byte("c"))
+	require.Nil(t, err)
+	err = s.Put([]byte("c"), []byte("again"))
+	require.Nil(t, err)
+
+	changes, err := s.ChangedSince(cursor)
+	require.Nil(t, err)
+	require.Equal(t, []KeyChange{
+		{Key: "a", Seq: 4},
+		{Key: "b", Seq: 5, Deleted: true},
+		{Key: "d", Seq: 6},
+		{Key: "c", Seq: 8},
+	}, changes)
+	changes, err = s.ChangedSince(s.Seq())
+	require.Nil(t, err)
+	require.Empty(t, changes)
+
+	// the merge drops the tombstone of b, so older cursors can't be served anymore
+	err = s.Merge()
+	require.Nil(t, err)
+	_, err = s.ChangedSince(cursor)
+	require.Equal(t, ErrChangesLost, err)
+	changes, err = s.ChangedSince(5)
+	require.Nil(t, err)
+	require.Len(t, changes, 2)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// deletes before the open are unknown
+	s, err = Open(config)
+	require.Nil(t, err)
+	_, err = s.ChangedSince(5)
+	require.Equal(t, ErrChangesLost, err)
+	err = s.Delete([]byte("a"))
+	require.Nil(t, err)
+	changes, err = s.ChangedSince(8)
+	require.Nil(t, err)
+	require.Equal(t, []KeyChange{{Key: "a", Seq: 9, Deleted: true}}, changes)
+	err = s.Truncate()
+	require.Nil(t, err)
+	_, err = s.ChangedSince(8)
+	require.Equal(t, ErrChangesLost, err)
+	err = s.Close()
+	require.Nil(t, err)
+	os.RemoveAll(config.RootDirectory)
+}
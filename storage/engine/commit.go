@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// committer tracks which writes are durable. With group commit, see Config.CommitInterval,
+// writes return once appended and runCommitter syncs them in batches.
+type committer struct {
+	mutex sync.Mutex
+	// committed is the sequence number of the latest write known to be durable
+	committed uint64
+	// err is the error of the latest commit, it is cleared by the next successful one
+	err error
+	// done is closed and replaced after every commit
+	done chan struct{}
+	// requests asks runCommitter for an early commit
+	requests chan struct{}
+	ticker   *time.Ticker
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newCommitter(committed uint64) *committer {
+	return &committer{
+		committed: committed,
+		done:      make(chan struct{}),
+	}
+}
+
+// startCommitter starts group commit if CommitInterval is set
+func (m *MKV) startCommitter() {
+	if m.config.CommitInterval <= 0 || m.config.SyncWrite {
+		return
+	}
+	c := m.commits
+	c.requests = make(chan struct{}, 1)
+	c.ticker = time.NewTicker(m.config.CommitInterval)
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go m.runCommitter()
+}
+
+func (m *MKV) runCommitter() {
+	c := m.commits
+	defer close(c.stopped)
+	for {
+		select {
+		case <-c.ticker.C:
+		case <-c.requests:
+		case <-c.stop:
+			return
+		}
+		// a failed commit is reported to waiters, the next one retries
+		if err := m.commit(); err != nil {
+			m.config.logger().Warnf("commit error: %s", err)
+		}
+	}
+}
+
+// stopCommitter stops runCommitter, writes left are synced by close
+func (m *MKV) stopCommitter() {
+	c := m.commits
+	if c.stop == nil {
+		return
+	}
+	c.ticker.Stop()
+	close(c.stop)
+	<-c.stopped
+}
+
+// written counts a write of size bytes applied with the lock held and asks for an
+// early commit once CommitWrites writes are pending
+func (m *MKV) written(size int64) {
+	m.bytesWritten += size
+	m.uncommitted++
+	c := m.commits
+	if c == nil || c.requests == nil || m.config.CommitWrites <= 0 || m.uncommitted < m.config.CommitWrites {
+		return
+	}
+	select {
+	case c.requests <- struct{}{}:
+	default:
+	}
+}
+
+// commit makes every write applied so far durable. The write buffer is flushed with the
+// lock held, the file is synced without it, so writers only wait for the flush. A file
+// rotated in the meantime was synced when it was closed.
+func (m *MKV) commit() error {
+	m.mutex.Lock()
+	cur := m.cur
+	seq := m.seq
+	err := cur.Flush()
+	if err == nil {
+		m.uncommitted = 0
+	}
+	m.mutex.Unlock()
+	if err == nil {
+		err = cur.syncFile()
+	}
+	if err != nil {
+		m.mutex.RLock()
+		rotated := m.cur != cur
+		m.mutex.RUnlock()
+		if rotated {
+			err = nil
+		}
+	}
+	m.committed(seq, err)
+	return err
+}
+
+// committed records the result of a commit of the writes up to seq and wakes waiters
+func (m *MKV) committed(seq uint64, err error) {
+	c := m.commits
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil && seq > c.committed {
+		c.committed = seq
+	}
+	c.err = err
+	close(c.done)
+	c.done = make(chan struct{})
+}
+
+// WaitCommit waits until every write applied before the call is durable. With group
+// commit it waits for the next commit, with SyncWrite writes are durable once applied,
+// otherwise the current data file is synced right away.
+func (m *MKV) WaitCommit(ctx context.Context) error {
+	if m.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if m.config.SyncWrite {
+		return nil
+	}
+	m.mutex.RLock()
+	target := m.seq
+	m.mutex.RUnlock()
+	if m.commits.stop == nil {
+		return m.commit()
+	}
+	c := m.commits
+	for {
+		c.mutex.Lock()
+		if c.committed >= target {
+			c.mutex.Unlock()
+			return nil
+		}
+		done := c.done
+		c.mutex.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mutex.Lock()
+		err := c.err
+		committed := c.committed
+		c.mutex.Unlock()
+		if err != nil && committed < target {
+			return err
+		}
+	}
+}
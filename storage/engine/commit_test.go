@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.CommitInterval = time.Hour
+	config.CommitWrites = 10
+	fs := &crashFileSystem{synced: make(map[string]int64)}
+	config.FileSystem = fs
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte("value"))
+		require.Nil(t, err)
+	}
+	// the tenth write asks for a commit
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = s.WaitCommit(ctx)
+	require.Nil(t, err)
+	err = s.Put([]byte("lost"), []byte("value"))
+	require.Nil(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.WaitCommit(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// crash without closing, the write after the commit is lost
+	s.stopCommitter()
+	err = fs.crash()
+	require.Nil(t, err)
+	err = s.lock.Unlock()
+	require.Nil(t, err)
+	config.FileSystem = nil
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Len(t, s.index, 10)
+	_, err = s.Get([]byte("lost"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// close commits and releases waiters
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	done := make(chan error)
+	go func() {
+		done <- s.WaitCommit(context.Background())
+	}()
+	err = s.Close()
+	require.Nil(t, err)
+	require.Nil(t, <-done)
+}
+
+func TestWaitCommit(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	fs := &crashFileSystem{synced: make(map[string]int64)}
+	config.FileSystem = fs
+
+	// without group commit the write is synced right away
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	err = s.WaitCommit(context.Background())
+	require.Nil(t, err)
+	err = fs.crash()
+	require.Nil(t, err)
+	err = s.lock.Unlock()
+	require.Nil(t, err)
+	config.FileSystem = nil
+	s, err = Open(config)
+	require.Nil(t, err)
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	err = s.Close()
+	require.Nil(t, err)
+}
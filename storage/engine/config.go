@@ -1,9 +1,16 @@
 package engine
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -12,16 +19,120 @@ const (
 	defaultMergeRatio      = 0.5
 	defaultMergeSpace      = 1 << 32
 	defaultMergeInterval   = time.Hour
+	defaultFileMode        = os.FileMode(0600)
+	defaultDirMode         = os.FileMode(0700)
 )
 
 type Config struct {
-	RootDirectory       string        `json:"root_directory"`
-	DataFileMaxSize     int64         `json:"data_file_max_size"`
-	AutoMerging         bool          `json:"auto_merging"`
-	SyncWrite           bool          `json:"sync_write"`
+	RootDirectory string `json:"root_directory"`
+	// DataFileMaxSize rotates the current data file once it reaches this size, a record
+	// larger than DataFileMaxSize is written to a data file of its own
+	DataFileMaxSize int64 `json:"data_file_max_size"`
+	AutoMerging     bool  `json:"auto_merging"`
+	// SyncWrite syncs every write before it returns. Without it a write reaches the page
+	// cache before it returns, so it survives the process crashing but not the machine,
+	// unless WriteBufferSize holds it back in memory.
+	SyncWrite   bool `json:"sync_write"`
+	Preallocate bool `json:"preallocate"`
+	// WriteBufferSize buffers up to this many bytes of appends to the current data file in
+	// memory, which makes small writes faster. Buffered writes are lost if the process
+	// crashes before the buffer is written, which happens when it is full, on Sync, on
+	// commits of CommitInterval and CommitWrites and on rotation. 0 writes through.
+	WriteBufferSize     int           `json:"write_buffer_size"`
+	ReadOnly            bool          `json:"read_only"`
 	MergeRatioThreshold float64       `json:"merge_ratio_threshold"`
 	MergeSpaceThreshold int64         `json:"merge_space_threshold"`
 	MergeInterval       time.Duration `json:"merge_interval"`
+	// AdaptiveMerge scales MergeRatioThreshold and MergeSpaceThreshold on every check of
+	// auto merging. With less than 30% of the disk free they are lowered in proportion,
+	// down to a quarter, so space is reclaimed earlier. Writes faster than their long term
+	// average raise them up to twice, so merges wait for bursts of writes to pass, unless
+	// less than 10% of the disk is free. Stats reports the thresholds applied.
+	AdaptiveMerge bool `json:"adaptive_merge"`
+	// IndexFlushInterval saves the index periodically while the store is open, so
+	// reopening after a crash only replays data files written since, 0 disables it.
+	// Stores keeping versions rebuild the index from data files regardless.
+	IndexFlushInterval time.Duration `json:"index_flush_interval"`
+	// MergeWindowStart and MergeWindowEnd restrict auto merging to a daily window,
+	// given as offsets from local midnight, e.g. 2h and 5h, equal values allow any time
+	MergeWindowStart time.Duration `json:"merge_window_start"`
+	MergeWindowEnd   time.Duration `json:"merge_window_end"`
+	// MergeMaxFiles bounds the data files a single merge processes, the oldest files are
+	// merged first, so merges pause writes briefly and repeated merges compact the store.
+	// 0 merges all files.
+	MergeMaxFiles int `json:"merge_max_files"`
+	// MergeFilter drops the keys it returns false for while merging, they are left out of
+	// the merged files and deleted as the merge is swapped in, so a merge purges e.g. the
+	// objects of a removed user. Keys written again during the merge keep the new value.
+	// Only keys with records in the merged files are passed, content addressed values are
+	// not, they are deleted with their last link. It is called with the store locked, so
+	// it must not use the store.
+	MergeFilter func(key []byte) bool `json:"-"`
+	// CompactOnOpen merges all data files before Open returns if the reusable space reached
+	// MergeRatioThreshold and MergeSpaceThreshold, so a store opened rarely starts compacted.
+	// Auto merges start after it, so they never race it.
+	CompactOnOpen bool `json:"compact_on_open"`
+	// MaxMergeMBPerSec throttles the merge copy so it does not starve foreground I/O, 0 is unlimited
+	MaxMergeMBPerSec int `json:"max_merge_mb_per_sec"`
+	// ShardSize keeps data and hint files in a subdirectory per ShardSize file ids, named by
+	// the first id, so directories stay small with thousands of data files. 0 keeps all files
+	// in RootDirectory. A store can't be opened with another ShardSize than it was written with.
+	ShardSize int `json:"shard_size"`
+	// MaxValueSize rejects larger values with ErrValueTooLarge, 0 is unlimited
+	MaxValueSize int64 `json:"max_value_size"`
+	// MaxVersions is the number of versions kept per key including the current one,
+	// overwritten values stay readable with GetVersion, 0 or 1 disables versioning
+	MaxVersions int `json:"max_versions"`
+	// CompactRecords writes keys and values up to MaxCompactSize bytes with 1 byte sizes,
+	// which saves 4 bytes per record. Records of either layout are read regardless.
+	CompactRecords bool `json:"compact_records"`
+	// ScrubInterval starts a background pass verifying the checksums of all records of the
+	// immutable data files every ScrubInterval, so corruption is found before it is read.
+	// Corrupt records are logged and every pass is reported to OnScrub, 0 disables it.
+	ScrubInterval time.Duration `json:"scrub_interval"`
+	// MaxScrubMBPerSec throttles scrubbing so it does not compete with foreground I/O, 0 is unlimited
+	MaxScrubMBPerSec int `json:"max_scrub_mb_per_sec"`
+	// OnScrub is called with the report of every scrub pass
+	OnScrub func(report VerifyReport) `json:"-"`
+	// CommitInterval turns on group commit unless SyncWrite is set: writes return once
+	// appended and the current data file is synced every CommitInterval, so a crash loses
+	// the writes of one interval at most. WaitCommit waits until earlier writes are synced.
+	CommitInterval time.Duration `json:"commit_interval"`
+	// CommitWrites syncs early once this many writes are pending, 0 syncs by interval only
+	CommitWrites int `json:"commit_writes"`
+	// VerifyWrites reads every record, tombstones included, back from its data file right
+	// after it is written and fails the write with ErrWriteVerify if it differs. The read is
+	// served by the page cache unless the file system bypasses it, so this catches corruption
+	// on the way to the file system, at the cost of a flush and a read per write. Meant for
+	// qualifying hardware rather than for production.
+	VerifyWrites bool `json:"verify_writes"`
+	// OnWrite is called after each successful Put or Delete, value is nil for a delete.
+	// It is called from a single goroutine in the order the writes were applied, outside
+	// the store lock, so it may read the store but must not write to it. Writes are queued
+	// in a bounded buffer, when the buffer is full writers block until OnWrite catches up.
+	OnWrite func(key []byte, value []byte, deleted bool) `json:"-"`
+	// FileSystem opens data files, the os file system is used if it is nil
+	FileSystem FileSystem `json:"-"`
+	// InMemory keeps the data files in memory and writes nothing to disk, every open starts
+	// an empty store whose data is gone once it is closed, RootDirectory only names the
+	// files. Meant for tests, which then need no directory of their own.
+	InMemory bool `json:"in_memory"`
+	// EncryptionKey encrypts the values of new records with AES-GCM, it is 16, 24 or 32
+	// bytes for AES-128, AES-192 or AES-256, given in base64 in json and the environment.
+	// The checksum of a record covers the ciphertext, so scrubbing and verifying need no
+	// key. Records written without a key stay readable, encrypted records can't be read
+	// without it. The first encrypted record raises the store to format version 2, which
+	// older binaries refuse, and Migrate(2) encrypts the older records. Every value gets a random 96 bit nonce, so a key should encrypt no more
+	// than about 2^32 values. Rotating the key, which means rewriting every record, isn't
+	// supported yet.
+	EncryptionKey []byte `json:"encryption_key,omitempty"`
+	// FileMode and DirMode are the permissions of the files and directories of the store,
+	// they are applied as given whatever the umask, 0 is 0600 and 0700
+	FileMode os.FileMode `json:"file_mode"`
+	DirMode  os.FileMode `json:"dir_mode"`
+	// Logger receives merge events, recovery actions and errors the store carries on
+	// after, the standard logger is used if it is nil
+	Logger Logger `json:"-"`
 }
 
 func DefaultConfig() *Config {
@@ -30,14 +141,33 @@ func DefaultConfig() *Config {
 		DataFileMaxSize:     defaultDataFileMaxSize,
 		AutoMerging:         false,
 		SyncWrite:           false,
+		Preallocate:         false,
+		ReadOnly:            false,
 		MergeRatioThreshold: defaultMergeRatio,
 		MergeSpaceThreshold: defaultMergeSpace,
 		MergeInterval:       defaultMergeInterval,
+		FileMode:            defaultFileMode,
+		DirMode:             defaultDirMode,
 	}
 }
 
+func (config *Config) fileMode() os.FileMode {
+	if config.FileMode == 0 {
+		return defaultFileMode
+	}
+	return config.FileMode
+}
+
+func (config *Config) dirMode() os.FileMode {
+	if config.DirMode == 0 {
+		return defaultDirMode
+	}
+	return config.DirMode
+}
+
+// LoadConfig reads a json config file, fields missing from it keep their default
 func LoadConfig(path string) (*Config, error) {
-	var cfg *Config
+	cfg := DefaultConfig()
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -55,3 +185,96 @@ func WithRootDirectory(dir string) Option {
 		config.RootDirectory = dir
 	}
 }
+
+// EnvPrefix prefixes the environment variables read by ApplyEnv
+const EnvPrefix = "MOS_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var fileModeType = reflect.TypeOf(os.FileMode(0))
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// ApplyEnv overrides fields by environment variables named by EnvPrefix and the upper
+// case json name of the field, e.g. MOS_ROOT_DIRECTORY or MOS_SYNC_WRITE. Durations are
+// given like 10s, file modes in octal like 0640, bytes in base64, numbers must not be negative. Fields stay unchanged if a value is invalid.
+func (config *Config) ApplyEnv() error {
+	updated := *config
+	v := reflect.ValueOf(&updated).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := EnvPrefix + strings.ToUpper(tag)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+	*config = updated
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errors.Errorf("%s is negative", value)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	if field.Type() == fileModeType {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return err
+		}
+		field.SetUint(uint64(os.FileMode(mode) & os.ModePerm))
+		return nil
+	}
+	if field.Type() == bytesType {
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		field.SetBytes(b)
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.Errorf("%s is negative", value)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if f < 0 {
+			return errors.Errorf("%s is negative", value)
+		}
+		field.SetFloat(f)
+	default:
+		return errors.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("MOS_ROOT_DIRECTORY", "/tmp/mos-env")
+	t.Setenv("MOS_SYNC_WRITE", "true")
+	t.Setenv("MOS_DATA_FILE_MAX_SIZE", "1024")
+	t.Setenv("MOS_MERGE_RATIO_THRESHOLD", "0.25")
+	t.Setenv("MOS_MERGE_INTERVAL", "10m")
+	t.Setenv("MOS_MAX_VERSIONS", "3")
+	t.Setenv("MOS_FILE_MODE", "0640")
+
+	config := DefaultConfig()
+	err := config.ApplyEnv()
+	require.Nil(t, err)
+	require.Equal(t, "/tmp/mos-env", config.RootDirectory)
+	require.True(t, config.SyncWrite)
+	require.Equal(t, int64(1024), config.DataFileMaxSize)
+	require.Equal(t, 0.25, config.MergeRatioThreshold)
+	require.Equal(t, 10*time.Minute, config.MergeInterval)
+	require.Equal(t, 3, config.MaxVersions)
+	require.Equal(t, os.FileMode(0640), config.FileMode)
+	require.Equal(t, int64(defaultMergeSpace), config.MergeSpaceThreshold)
+
+	// an invalid value changes nothing
+	for name, value := range map[string]string{
+		"MOS_SYNC_WRITE":         "maybe",
+		"MOS_DATA_FILE_MAX_SIZE": "-1",
+		"MOS_MERGE_INTERVAL":     "10",
+		"MOS_DIR_MODE":           "0799",
+	} {
+		t.Setenv(name, value)
+		config := DefaultConfig()
+		err := config.ApplyEnv()
+		require.NotNil(t, err, name)
+		require.Equal(t, DefaultConfig().RootDirectory, config.RootDirectory)
+		os.Unsetenv(name)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	err := os.WriteFile(path, []byte(`{"root_directory": "/tmp/mos-file", "sync_write": true}`), 0600)
+	require.Nil(t, err)
+	config, err := LoadConfig(path)
+	require.Nil(t, err)
+	require.Equal(t, "/tmp/mos-file", config.RootDirectory)
+	require.True(t, config.SyncWrite)
+	require.Equal(t, int64(defaultDataFileMaxSize), config.DataFileMaxSize)
+}
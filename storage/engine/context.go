@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lockCtx acquires the write lock unless ctx is done first
+func (m *MKV) lockCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		// ctx can't be canceled
+		m.mutex.Lock()
+		return nil
+	}
+	if m.mutex.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		m.mutex.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// release the lock once the goroutine gets it
+		go func() {
+			<-locked
+			m.mutex.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// rLockCtx acquires the read lock unless ctx is done first
+func (m *MKV) rLockCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		m.mutex.RLock()
+		return nil
+	}
+	if m.mutex.TryRLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		m.mutex.RLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			m.mutex.RUnlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// PutCtx works like Put, it gives up if ctx is done before the write starts,
+// a started write is never left partial
+func (m *MKV) PutCtx(ctx context.Context, key []byte, value []byte) error {
+	_, err := m.PutNCtx(ctx, key, value)
+	return err
+}
+
+// PutNCtx works like PutN and respects ctx like PutCtx
+func (m *MKV) PutNCtx(ctx context.Context, key []byte, value []byte) (int64, error) {
+	return m.PutNCtxWithFlag(ctx, key, value, 0)
+}
+
+// PutNCtxWithFlag works like PutNCtx and tags the record with userFlag, see PutWithFlag
+func (m *MKV) PutNCtxWithFlag(ctx context.Context, key []byte, value []byte, userFlag byte) (int64, error) {
+	if err := m.checkPut(key, value, userFlag); err != nil {
+		return 0, err
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return 0, err
+	}
+	// the lock may have been acquired just as ctx was done
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return 0, err
+	}
+	size, err := m.put(key, value, userFlag<<userFlagShift, m.seq+1)
+	if err != nil {
+		m.mutex.Unlock()
+		return 0, err
+	}
+	m.unlockAndNotify(key, value, false)
+	return size, nil
+}
+
+// GetCtx works like Get, it gives up if ctx is done before the read starts
+func (m *MKV) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := m.rLockCtx(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	value, _, err := m.get(key)
+	return value, err
+}
+
+// DeleteCtx works like Delete, it gives up if ctx is done before the tombstone is written
+func (m *MKV) DeleteCtx(ctx context.Context, key []byte) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if err := m.delete(key, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.unlockAndNotify(key, nil, true)
+	return nil
+}
+
+// DeletePrefixCtx works like DeletePrefix and only deletes the keys match returns true
+// for, all keys with prefix if match is nil. The tombstones are appended in one lock span,
+// match is called with the lock held, so it must not use the store. Deleted links release
+// their values like Unlink, values still linked are kept.
+func (m *MKV) DeletePrefixCtx(ctx context.Context, prefix []byte, match func(key []byte) bool) (int, error) {
+	if m.config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return 0, err
+	}
+	var keys [][]byte
+	for key := range m.index {
+		if strings.HasPrefix(key, string(prefix)) && (match == nil || match([]byte(key))) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	writes, err := m.deleteKeys(keys)
+	m.unlockAndNotifyWrites(writes...)
+	return len(writes), err
+}
+
+// ObjectInfo describes the stored version of a key
+type ObjectInfo struct {
+	Checksum uint32
+	// UserFlag is the flag the object was put with
+	UserFlag byte
+	// ModTime is never earlier than the write, see Entry.ModTime
+	ModTime time.Time
+}
+
+func objectInfo(record *Record, entry *Entry) *ObjectInfo {
+	return &ObjectInfo{
+		Checksum: record.Checksum(),
+		UserFlag: record.UserFlag(),
+		ModTime:  time.Unix(0, entry.ModTime),
+	}
+}
+
+// GetWithInfo works like GetCtx and also returns the stored version of key
+func (m *MKV) GetWithInfo(ctx context.Context, key []byte) ([]byte, *ObjectInfo, error) {
+	if err := m.rLockCtx(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer m.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	record, entry, err := m.getRecord(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record.Value(), objectInfo(record, entry), nil
+}
+
+// DeleteIf deletes key only if cond accepts its stored version, cond runs
+// under the write lock so the key can't change in between, the error of cond
+// is returned and nothing is deleted if it fails
+func (m *MKV) DeleteIf(ctx context.Context, key []byte, cond func(info *ObjectInfo) error) error {
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	record, entry, err := m.getRecord(key)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if err := cond(objectInfo(record, entry)); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if err := m.delete(key, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.unlockAndNotify(key, nil, true)
+	return nil
+}
+
+// PutIfAbsentCtx works like PutIfAbsent and tags the record with userFlag, value is
+// only written if none of others exists either
+func (m *MKV) PutIfAbsentCtx(ctx context.Context, key []byte, value []byte, userFlag byte, others ...[]byte) (bool, error) {
+	if err := m.checkPut(key, value, userFlag); err != nil {
+		return false, err
+	}
+	return m.putIfAbsent(ctx, key, value, userFlag, others...)
+}
+
+func (m *MKV) putIfAbsent(ctx context.Context, key []byte, value []byte, userFlag byte, others ...[]byte) (bool, error) {
+	if err := m.lockCtx(ctx); err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return false, err
+	}
+	for _, k := range append([][]byte{key}, others...) {
+		if _, ok := m.index[string(k)]; ok {
+			m.mutex.Unlock()
+			return false, nil
+		}
+	}
+	if _, err := m.put(key, value, userFlag<<userFlagShift, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return false, err
+	}
+	m.unlockAndNotify(key, value, false)
+	return true, nil
+}
+
+// PutAndGetPrevious puts value and returns the value it replaced, existed is false if key
+// had none. The replaced value is read with the lock of the put held, so of concurrent
+// puts each gets the value of the put applied before it.
+func (m *MKV) PutAndGetPrevious(key []byte, value []byte) (previous []byte, existed bool, err error) {
+	previous, info, err := m.PutAndGetPreviousCtx(context.Background(), key, value, NormalFlag)
+	return previous, info != nil, err
+}
+
+// PutAndGetPreviousCtx works like PutAndGetPrevious and tags the record with userFlag,
+// the replaced value is described like GetWithInfo, info is nil if key had none. value
+// is only written if none of others exists, otherwise it fails with ErrPreconditionFailed.
+func (m *MKV) PutAndGetPreviousCtx(ctx context.Context, key []byte, value []byte, userFlag byte, others ...[]byte) ([]byte, *ObjectInfo, error) {
+	if err := m.checkPut(key, value, userFlag); err != nil {
+		return nil, nil, err
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return nil, nil, err
+	}
+	for _, k := range others {
+		if _, ok := m.index[string(k)]; ok {
+			m.mutex.Unlock()
+			return nil, nil, ErrPreconditionFailed
+		}
+	}
+	var previous []byte
+	var info *ObjectInfo
+	record, entry, err := m.getRecord(key)
+	if err == nil {
+		previous, info = record.Value(), objectInfo(record, entry)
+	} else if err != ErrKeyNotFound {
+		m.mutex.Unlock()
+		return nil, nil, err
+	}
+	if _, err := m.put(key, value, userFlag<<userFlagShift, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return nil, nil, err
+	}
+	m.unlockAndNotify(key, value, false)
+	return previous, info, nil
+}
+
+// checkPut checks the arguments of a put
+func (m *MKV) checkPut(key []byte, value []byte, userFlag byte) error {
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	return m.checkRecord(key, value, userFlag)
+}
+
+// checkRecord checks the sizes and flag of a record
+func (m *MKV) checkRecord(key []byte, value []byte, userFlag byte) error {
+	if userFlag > MaxUserFlag {
+		return ErrInvalidFlag
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if m.tooLarge(int64(len(value))) {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// AppendCtx works like Append, it gives up waiting for the lock once ctx is done
+func (m *MKV) AppendCtx(ctx context.Context, key []byte, suffix []byte) error {
+	return m.update(ctx, key, func(value []byte, found bool) ([]byte, error) {
+		if m.tooLarge(int64(len(value) + len(suffix))) {
+			return nil, ErrValueTooLarge
+		}
+		updated := make([]byte, 0, len(value)+len(suffix))
+		return append(append(updated, value...), suffix...), nil
+	})
+}
+
+// update replaces the value of key by the result of f under the write lock, keeping
+// the user flag. found is false and value nil if key doesn't exist.
+func (m *MKV) update(ctx context.Context, key []byte, f func(value []byte, found bool) ([]byte, error)) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	var value []byte
+	var flag byte
+	record, _, err := m.getRecord(key)
+	if err != nil && err != ErrKeyNotFound {
+		m.mutex.Unlock()
+		return err
+	}
+	if err == nil {
+		value = record.Value()
+		flag = record.UserFlag() << userFlagShift
+	}
+	updated, err := f(value, err == nil)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if _, err := m.put(key, updated, flag, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.unlockAndNotify(key, updated, false)
+	return nil
+}
+
+// CopyCtx works like Copy, it gives up waiting for the lock once ctx is done
+func (m *MKV) CopyCtx(ctx context.Context, src []byte, dst []byte) error {
+	return m.copy(ctx, src, dst, false)
+}
+
+// MoveCtx works like Move, it gives up waiting for the lock once ctx is done
+func (m *MKV) MoveCtx(ctx context.Context, src []byte, dst []byte) error {
+	return m.copy(ctx, src, dst, true)
+}
+
+// copy writes the value and user flag of src to dst and deletes src if move is set,
+// all in one lock span, so no write sees the copy half done. Hashes and links may be
+// copied from but not written or moved.
+func (m *MKV) copy(ctx context.Context, src []byte, dst []byte, move bool) error {
+	if len(src) > MaxKeySize || len(dst) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if reservedKey(dst) || (move && reservedKey(src)) {
+		return ErrReservedKey
+	}
+	if err := m.lockCtx(ctx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	record, _, err := m.getRecord(src)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	// moving a key onto itself would delete it
+	if move && bytes.Equal(src, dst) {
+		m.mutex.Unlock()
+		return nil
+	}
+	if _, err := m.put(dst, record.Value(), record.UserFlag()<<userFlagShift, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if !move {
+		m.unlockAndNotify(dst, record.Value(), false)
+		return nil
+	}
+	if err := m.delete(src, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.unlockAndNotifyWrites(write{key: dst, value: record.Value()}, write{key: src, deleted: true})
+	return nil
+}
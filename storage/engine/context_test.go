@@ -0,0 +1,396 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	key := []byte("key")
+	value := []byte("value")
+	err = s.PutCtx(context.Background(), key, value)
+	require.Nil(t, err)
+
+	// a writer holds the lock
+	s.mutex.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = s.PutCtx(ctx, key, []byte("new value"))
+	require.Equal(t, context.DeadlineExceeded, err)
+	_, err = s.GetCtx(ctx, key)
+	require.Equal(t, context.DeadlineExceeded, err)
+	err = s.DeleteCtx(ctx, key)
+	require.Equal(t, context.DeadlineExceeded, err)
+	size := s.cur.Size()
+	s.mutex.Unlock()
+
+	// nothing was written and the lock is free again
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = s.PutCtx(ctx, key, []byte("new value"))
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, size, s.cur.Size())
+	v, err := s.Get(key)
+	require.Nil(t, err)
+	require.Equal(t, value, v)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestDeleteIf(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	ctx := context.Background()
+	key := []byte("key")
+	start := time.Now()
+	err = s.Put(key, []byte("value"))
+	require.Nil(t, err)
+	_, info, err := s.GetWithInfo(ctx, key)
+	require.Nil(t, err)
+	require.Equal(t, generateChecksum(NormalFlag, key, []byte("value")), info.Checksum)
+	require.False(t, info.ModTime.Before(start))
+
+	err = s.DeleteIf(ctx, key, func(info *ObjectInfo) error {
+		return ErrPreconditionFailed
+	})
+	require.Equal(t, ErrPreconditionFailed, err)
+	_, err = s.Get(key)
+	require.Nil(t, err)
+
+	// loaded entries are never older than their write
+	err = s.Close()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	_, reopened, err := s.GetWithInfo(ctx, key)
+	require.Nil(t, err)
+	require.Equal(t, info.Checksum, reopened.Checksum)
+	require.False(t, reopened.ModTime.Before(info.ModTime.Truncate(time.Second)))
+
+	err = s.DeleteIf(ctx, key, func(info *ObjectInfo) error {
+		return nil
+	})
+	require.Nil(t, err)
+	_, err = s.Get(key)
+	require.Equal(t, ErrKeyNotFound, err)
+	err = s.DeleteIf(ctx, key, func(info *ObjectInfo) error {
+		return nil
+	})
+	require.Equal(t, ErrKeyNotFound, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestUserFlag(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	ctx := context.Background()
+	key := []byte("key")
+	err = s.PutWithFlag(key, []byte("value"), MaxUserFlag)
+	require.Nil(t, err)
+	err = s.PutWithFlag(key, []byte("value"), MaxUserFlag+1)
+	require.Equal(t, ErrInvalidFlag, err)
+	_, info, err := s.GetWithInfo(ctx, key)
+	require.Nil(t, err)
+	require.Equal(t, MaxUserFlag, info.UserFlag)
+
+	// the flag survives a merge and a reopen and is no tombstone
+	err = s.Merge()
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	value, info, err := s.GetWithInfo(ctx, key)
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, MaxUserFlag, info.UserFlag)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestMaxValueSize(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxValueSize = 4
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("1234"))
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("12345"))
+	require.Equal(t, ErrValueTooLarge, err)
+	err = s.PutData(EncodeRecordWithChecksum(NewRecordWithoutChecksum(NormalFlag, []byte("key"), []byte("12345"))), "key")
+	require.Equal(t, ErrValueTooLarge, err)
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("1234"), value)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestMaxKeySize(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	key := make([]byte, MaxKeySize+1)
+	err = s.Put(key, []byte("value"))
+	require.Equal(t, ErrKeyTooLarge, err)
+	err = s.PutData([]byte{}, string(key))
+	require.Equal(t, ErrKeyTooLarge, err)
+	err = s.Delete(key)
+	require.Equal(t, ErrKeyTooLarge, err)
+	err = s.Put(key[:MaxKeySize], []byte("value"))
+	require.Nil(t, err)
+
+	// nothing corrupt was written
+	err = s.Close()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	value, err := s.Get(key[:MaxKeySize])
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	report, err := s.Verify()
+	require.Nil(t, err)
+	require.Equal(t, int64(0), report.Corrupt)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestCopyMove(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	events, cancel := s.Subscribe()
+	defer cancel()
+	err = s.PutWithFlag([]byte("src"), []byte("value"), 3)
+	require.Nil(t, err)
+
+	err = s.Copy([]byte("src"), []byte("copy"))
+	require.Nil(t, err)
+	value, info, err := s.GetWithInfo(context.Background(), []byte("copy"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, byte(3), info.UserFlag)
+
+	err = s.Move([]byte("src"), []byte("moved"))
+	require.Nil(t, err)
+	_, err = s.Get([]byte("src"))
+	require.Equal(t, ErrKeyNotFound, err)
+	value, err = s.Get([]byte("moved"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// moving a key onto itself keeps it
+	err = s.Move([]byte("moved"), []byte("moved"))
+	require.Nil(t, err)
+	_, err = s.Get([]byte("moved"))
+	require.Nil(t, err)
+	err = s.Copy([]byte("src"), []byte("other"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	expected := []ChangeEvent{
+		{Key: []byte("src"), Value: []byte("value"), Seq: 1},
+		{Key: []byte("copy"), Value: []byte("value"), Seq: 2},
+		{Key: []byte("moved"), Value: []byte("value"), Seq: 3},
+		{Key: []byte("src"), Deleted: true, Seq: 4},
+	}
+	for _, e := range expected {
+		event := <-events
+		require.Equal(t, e.Key, event.Key)
+		require.Equal(t, e.Value, event.Value)
+		require.Equal(t, e.Deleted, event.Deleted)
+		require.Equal(t, e.Seq, event.Seq)
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	written, err := s.PutIfAbsent([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	require.True(t, written)
+	written, err = s.PutIfAbsent([]byte("key"), []byte("new value"))
+	require.Nil(t, err)
+	require.False(t, written)
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// other keys guard the write as well
+	written, err = s.PutIfAbsentCtx(context.Background(), []byte("other"), []byte("value"), 1, []byte("key"))
+	require.Nil(t, err)
+	require.False(t, written)
+	_, err = s.Get([]byte("other"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// exactly one of the racing writers creates the key
+	for round := 0; round < 100; round++ {
+		key := []byte(fmt.Sprintf("race%d", round))
+		n := 8
+		var wg sync.WaitGroup
+		var created int32
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				written, err := s.PutIfAbsent(key, []byte(fmt.Sprintf("value%d", i)))
+				require.Nil(t, err)
+				if written {
+					atomic.AddInt32(&created, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), created)
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestPutAndGetPrevious(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	previous, existed, err := s.PutAndGetPrevious([]byte("key"), []byte("first"))
+	require.Nil(t, err)
+	require.False(t, existed)
+	require.Nil(t, previous)
+	previous, existed, err = s.PutAndGetPrevious([]byte("key"), []byte("second"))
+	require.Nil(t, err)
+	require.True(t, existed)
+	require.Equal(t, []byte("first"), previous)
+
+	previous, info, err := s.PutAndGetPreviousCtx(context.Background(), []byte("key"), []byte("third"), 2)
+	require.Nil(t, err)
+	require.Equal(t, []byte("second"), previous)
+	require.Equal(t, byte(0), info.UserFlag)
+	_, info, err = s.GetWithInfo(context.Background(), []byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, byte(2), info.UserFlag)
+
+	// nothing is written if a guard key exists
+	require.Nil(t, s.Put([]byte("guard"), []byte("value")))
+	_, _, err = s.PutAndGetPreviousCtx(context.Background(), []byte("key"), []byte("fourth"), 0, []byte("guard"))
+	require.Equal(t, ErrPreconditionFailed, err)
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("third"), value)
+	previous, _, err = s.PutAndGetPreviousCtx(context.Background(), []byte("key"), []byte("fourth"), 0, []byte("missing"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("third"), previous)
+
+	// of concurrent puts each gets the value of another, every value is returned once
+	// except the last one put
+	n := 100
+	returned := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			previous, existed, err := s.PutAndGetPrevious([]byte("swapped"), []byte(fmt.Sprint(i)))
+			require.Nil(t, err)
+			if !existed {
+				previous = []byte("none")
+			}
+			returned <- string(previous)
+		}(i)
+	}
+	wg.Wait()
+	close(returned)
+	seen := make(map[string]bool)
+	for previous := range returned {
+		require.False(t, seen[previous])
+		seen[previous] = true
+	}
+	last, err := s.Get([]byte("swapped"))
+	require.Nil(t, err)
+	require.True(t, seen["none"])
+	require.False(t, seen[string(last)])
+	require.Len(t, seen, n)
+}
+
+func TestAppendIncrement(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.PutWithFlag([]byte("log"), []byte("a"), 2)
+	require.Nil(t, err)
+	n := 8
+	rounds := 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				err := s.Append([]byte("log"), []byte("b"))
+				require.Nil(t, err)
+				_, err = s.Increment([]byte("counter"), 2)
+				require.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	value, info, err := s.GetWithInfo(context.Background(), []byte("log"))
+	require.Nil(t, err)
+	require.Len(t, value, 1+n*rounds)
+	require.Equal(t, byte(2), info.UserFlag)
+	counter, err := s.Increment([]byte("counter"), -1)
+	require.Nil(t, err)
+	require.Equal(t, int64(2*n*rounds-1), counter)
+
+	// appending creates a missing key
+	err = s.Append([]byte("new"), []byte("value"))
+	require.Nil(t, err)
+	value, err = s.Get([]byte("new"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	_, err = s.Increment([]byte("new"), 1)
+	require.Equal(t, ErrNotCounter, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
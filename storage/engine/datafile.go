@@ -1,11 +1,13 @@
 package engine
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/pkg/errors"
 	"golang.org/x/exp/mmap"
@@ -13,6 +15,9 @@ import (
 
 const (
 	dataFileExtension = "%08d.data"
+	// writeBufferSize is the write buffer of the files of a merged store, they aren't
+	// read until the merge is swapped in, which closes them
+	writeBufferSize = 1 << 20
 )
 
 var errReadOnly = errors.New("DataFile is read only")
@@ -20,45 +25,141 @@ var errReadOnly = errors.New("DataFile is read only")
 // DataFile is used as a log file
 type DataFile struct {
 	id     int
-	file   *os.File
+	fs     FileSystem
+	file   File
 	reader *mmap.ReaderAt
-	end    int64
+	// mapped maps the file instead of reader on linux, GetNoCopy pins values in it,
+	// so it is unmapped once the file is closed and the last pinned value released
+	mapped    []byte
+	mapMutex  sync.Mutex
+	pins      int
+	mapClosed bool
+	readOnly  bool
+	// buffer holds appended data which has not been written to file yet,
+	// it starts at offset flushed
+	buffer      []byte
+	bufferSize  int
+	flushed     int64
+	end         int64
+	preallocate int64
+	shardSize   int
+	fileMode    os.FileMode
+	dirMode     os.FileMode
 }
 
-func NewDataFile(dir string, id int, readOnly bool) (*DataFile, error) {
+type DataFileOption func(df *DataFile)
+
+// WithPreallocate preallocates size bytes on disk for a writable data file,
+// unused space is released on Close
+func WithPreallocate(size int64) DataFileOption {
+	return func(df *DataFile) {
+		df.preallocate = size
+	}
+}
+
+// WithWriteBuffer buffers up to size bytes of appends to a writable data file in memory,
+// they are written to file when the buffer is full, on Flush, Sync and Close. Buffered
+// data is lost if the process dies before.
+func WithWriteBuffer(size int) DataFileOption {
+	return func(df *DataFile) {
+		df.bufferSize = size
+	}
+}
+
+// WithFileSystem opens the data file with fs instead of the os file system
+func WithFileSystem(fs FileSystem) DataFileOption {
+	return func(df *DataFile) {
+		df.fs = fs
+	}
+}
+
+// WithFileMode creates the data file with fileMode and its shard directory with dirMode
+func WithFileMode(fileMode os.FileMode, dirMode os.FileMode) DataFileOption {
+	return func(df *DataFile) {
+		df.fileMode = fileMode
+		df.dirMode = dirMode
+	}
+}
+
+// WithShardSize keeps the data file in the subdirectory of dir holding shardSize ids
+func WithShardSize(shardSize int) DataFileOption {
+	return func(df *DataFile) {
+		df.shardSize = shardSize
+	}
+}
+
+// dataFileDir returns the directory of data file id, it is a subdirectory of dir
+// named by the first id of the shard if shardSize is positive, else dir itself
+func dataFileDir(dir string, id int, shardSize int) string {
+	if shardSize <= 0 {
+		return dir
+	}
+	return filepath.Join(dir, fmt.Sprintf("%08d", id-id%shardSize))
+}
+
+func NewDataFile(dir string, id int, readOnly bool, options ...DataFileOption) (*DataFile, error) {
+	df := &DataFile{
+		id:       id,
+		fs:       osFileSystem{},
+		readOnly: readOnly,
+		fileMode: defaultFileMode,
+		dirMode:  defaultDirMode,
+	}
+	for _, option := range options {
+		option(df)
+	}
+	dir = dataFileDir(dir, id, df.shardSize)
 	filename := filepath.Join(dir, fmt.Sprintf(dataFileExtension, id))
-	var (
-		file   *os.File
-		reader *mmap.ReaderAt
-		end    int64
-		err    error
-	)
+	var err error
 	if !readOnly {
-		file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+		if df.shardSize > 0 {
+			if err := mkdirAll(df.fs, dir, df.dirMode); err != nil {
+				return nil, err
+			}
+		}
+		df.file, err = df.fs.OpenFile(filename, os.O_RDWR|os.O_CREATE, df.fileMode)
 		if err != nil {
 			return nil, err
 		}
+		// the mode is applied whatever the umask, to files which have one
+		if file, ok := df.file.(interface{ Chmod(os.FileMode) error }); ok {
+			if err := file.Chmod(df.fileMode); err != nil {
+				df.file.Close()
+				return nil, err
+			}
+		}
+		df.buffer = make([]byte, 0, df.bufferSize)
 	} else {
-		file, err = os.Open(filename)
+		df.file, err = df.fs.OpenFile(filename, os.O_RDONLY, 0)
 		if err != nil {
 			return nil, err
 		}
-		reader, err = mmap.Open(filename)
-		if err != nil {
-			return nil, err
+		// only files of the os file system can be mapped
+		if _, ok := df.fs.(osFileSystem); ok {
+			if df.mapped, err = mmapFile(df.file); err != nil {
+				df.file.Close()
+				return nil, err
+			}
+			if df.mapped == nil {
+				if df.reader, err = mmap.Open(filename); err != nil {
+					return nil, err
+				}
+			}
 		}
+		df.preallocate = 0
 	}
-	stat, err := file.Stat()
+	stat, err := df.file.Stat()
 	if err != nil {
 		return nil, err
 	}
-	end = stat.Size()
-	return &DataFile{
-		id:     id,
-		file:   file,
-		reader: reader,
-		end:    end,
-	}, nil
+	df.flushed = stat.Size()
+	df.end = stat.Size()
+	if df.preallocate > df.end {
+		if err := fallocate(df.file, df.preallocate); err != nil {
+			return nil, err
+		}
+	}
+	return df, nil
 }
 
 func (df *DataFile) ID() int {
@@ -73,25 +174,129 @@ func (df *DataFile) Size() int64 {
 	return df.end
 }
 
+// Close flushes the write buffer and closes the file, the file stays open
+// if the buffer can't be flushed so no buffered data is lost
 func (df *DataFile) Close() error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
 	defer df.file.Close()
+	if df.preallocate > 0 {
+		if err := df.file.Truncate(df.end); err != nil {
+			return err
+		}
+	}
 	if df.reader != nil {
 		return df.reader.Close()
 	}
-	return nil
+	return df.closeMapping()
+}
+
+// closeMapping unmaps the file unless values are pinned, the last unpin unmaps it then
+func (df *DataFile) closeMapping() error {
+	df.mapMutex.Lock()
+	defer df.mapMutex.Unlock()
+	df.mapClosed = true
+	if df.mapped == nil || df.pins > 0 {
+		return nil
+	}
+	data := df.mapped
+	df.mapped = nil
+	return munmap(data)
+}
+
+// pin returns the size bytes at offset in place if the file is mapped, they stay
+// mapped until unpin is called
+func (df *DataFile) pin(offset int64, size int64) ([]byte, bool) {
+	df.mapMutex.Lock()
+	defer df.mapMutex.Unlock()
+	if df.mapped == nil || df.mapClosed || offset+size > int64(len(df.mapped)) {
+		return nil, false
+	}
+	df.pins++
+	return df.mapped[offset : offset+size : offset+size], true
+}
+
+func (df *DataFile) unpin() {
+	df.mapMutex.Lock()
+	defer df.mapMutex.Unlock()
+	df.pins--
+	if df.pins == 0 && df.mapClosed && df.mapped != nil {
+		// munmap only fails for invalid mappings
+		_ = munmap(df.mapped)
+		df.mapped = nil
+	}
+}
+
+// ModTime returns the modification time of the file in unix nanoseconds
+func (df *DataFile) ModTime() (int64, error) {
+	info, err := df.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.ModTime().UnixNano(), nil
+}
+
+// Flush writes buffered data to file
+func (df *DataFile) Flush() error {
+	if len(df.buffer) == 0 {
+		return nil
+	}
+	n, err := df.file.WriteAt(df.buffer, df.flushed)
+	df.flushed += int64(n)
+	df.buffer = df.buffer[:copy(df.buffer, df.buffer[n:])]
+	return err
 }
 
 func (df *DataFile) Sync() error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
+	return df.file.Sync()
+}
+
+// syncFile syncs the file without flushing the write buffer first, so it may be
+// called without the store lock
+func (df *DataFile) syncFile() error {
 	return df.file.Sync()
 }
 
+// ReadAt reads from file, data which is still in the write buffer is read from buffer
+func (df *DataFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= df.flushed {
+		start := offset - df.flushed
+		if start >= int64(len(df.buffer)) {
+			return 0, io.EOF
+		}
+		n := copy(p, df.buffer[start:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if offset+int64(len(p)) <= df.flushed {
+		return df.file.ReadAt(p, offset)
+	}
+	n, err := df.file.ReadAt(p[:df.flushed-offset], offset)
+	if err != nil {
+		return n, err
+	}
+	m, err := df.ReadAt(p[n:], df.flushed)
+	return n + m, err
+}
+
 func (df *DataFile) ReadEntireRecordAt(offset int64, size int64) (*Record, error) {
 	bytes := make([]byte, size)
 	var err error
-	if df.reader != nil {
+	if df.mapped != nil {
+		if offset+size > int64(len(df.mapped)) {
+			return nil, io.EOF
+		}
+		copy(bytes, df.mapped[offset:])
+	} else if df.reader != nil {
 		_, err = df.reader.ReadAt(bytes, offset)
 	} else {
-		_, err = df.file.ReadAt(bytes, offset)
+		_, err = df.ReadAt(bytes, offset)
 	}
 	if err != nil {
 		return nil, err
@@ -106,20 +311,25 @@ func (df *DataFile) ReadRecordAt(offset int64) (*Record, error) {
 	//} else {
 	//	ra = df.file
 	//}
-	ra = df.file
+	ra = df
 
-	header := make([]byte, keyBegin)
-	n, err := ra.ReadAt(header, offset)
+	header, err := readRecordHeader(ra, offset)
 	if err != nil {
 		return nil, err
 	}
-	offset += int64(n)
+	offset += int64(len(header))
 	flag := header[flagPos]
-	ksize := binary.BigEndian.Uint16(header[keySizeBegin:valueSizeBegin])
-	vsize := binary.BigEndian.Uint32(header[valueSizeBegin:keyBegin])
+	ksize := keySize(header)
+	vsize := valueSize(header)
+	// corrupt sizes must not allocate more than the file holds, a record past the end
+	// reads like a truncated one
+	remaining := df.Size() - offset - checksumSize
+	if remaining < 0 || uint64(ksize) > uint64(remaining) || vsize > uint64(remaining)-uint64(ksize) {
+		return nil, io.EOF
+	}
 
-	payload := make([]byte, uint32(ksize)+vsize)
-	n, err = ra.ReadAt(payload, offset)
+	payload := make([]byte, uint64(ksize)+vsize)
+	n, err := ra.ReadAt(payload, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -141,41 +351,109 @@ func (df *DataFile) ReadRecordAt(offset int64) (*Record, error) {
 	}, nil
 }
 
+// readRecordHeader reads the header of the record at offset, wide headers are
+// read in two steps as the flag gives their size. Compact records are at least
+// keyBegin bytes long with their checksum, so their header is read in one step.
+func readRecordHeader(ra io.ReaderAt, offset int64) ([]byte, error) {
+	header := make([]byte, wideKeyBegin)
+	if _, err := ra.ReadAt(header[:keyBegin], offset); err != nil {
+		return nil, err
+	}
+	if !isWide(header[flagPos]) {
+		return header[:headerSize(header[flagPos])], nil
+	}
+	if _, err := ra.ReadAt(header[keyBegin:], offset+keyBegin); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
 func (df *DataFile) Read(p []byte) (n int, err error) {
 	return df.file.Read(p)
 }
 
 func (df *DataFile) AppendRecord(record *Record) (int64, int64, error) {
-	if df.reader != nil {
+	if df.readOnly {
 		return 0, 0, errReadOnly
 	}
-	bytes := EncodeRecordWithChecksum(record)
-	offset := df.end
-	size, err := df.file.WriteAt(bytes, offset)
-	if err != nil {
-		return 0, 0, err
-	}
-	df.end += int64(size)
-	return offset, int64(size), nil
+	return df.write(EncodeRecordWithChecksum(record))
 }
 
 func (df *DataFile) Append(data []byte) (int64, int64, error) {
-	if df.reader != nil {
+	if df.readOnly {
 		return 0, 0, errReadOnly
 	}
+	return df.write(data)
+}
+
+// Truncate discards data from size on, it is used to roll back a failed append
+func (df *DataFile) Truncate(size int64) error {
+	if df.readOnly {
+		return errReadOnly
+	}
+	if size >= df.end {
+		return nil
+	}
+	if size >= df.flushed {
+		df.buffer = df.buffer[:size-df.flushed]
+		df.end = size
+		return nil
+	}
+	if err := df.file.Truncate(size); err != nil {
+		return err
+	}
+	df.buffer = df.buffer[:0]
+	df.flushed = size
+	df.end = size
+	return nil
+}
+
+// verify flushes the write buffer and reads data back from the file at offset, it
+// fails with ErrWriteVerify if the file returns other bytes
+func (df *DataFile) verify(data []byte, offset int64) error {
+	if err := df.Flush(); err != nil {
+		return err
+	}
+	actual := make([]byte, len(data))
+	if _, err := df.file.ReadAt(actual, offset); err != nil {
+		return err
+	}
+	if !bytes.Equal(data, actual) {
+		return ErrWriteVerify
+	}
+	return nil
+}
+
+// write appends data to the write buffer, the buffer is flushed when it is full,
+// data larger than the buffer is written to file directly, all data if there is no buffer
+func (df *DataFile) write(data []byte) (int64, int64, error) {
+	if len(df.buffer)+len(data) > cap(df.buffer) {
+		if err := df.Flush(); err != nil {
+			return 0, 0, err
+		}
+	}
 	offset := df.end
-	size, err := df.file.WriteAt(data, offset)
-	if err != nil {
-		return 0, 0, err
+	if len(data) > cap(df.buffer) {
+		size, err := df.file.WriteAt(data, offset)
+		if err != nil {
+			// don't leave a partial record behind
+			if size > 0 {
+				_ = df.file.Truncate(offset)
+			}
+			return 0, 0, err
+		}
+		df.end += int64(size)
+		df.flushed = df.end
+		return offset, int64(size), nil
 	}
-	df.end += int64(size)
-	return offset, int64(size), nil
+	df.buffer = append(df.buffer, data...)
+	df.end += int64(len(data))
+	return offset, int64(len(data)), nil
 }
 
 func RecoverDataFile(file *DataFile) (bool, error) {
 	corrupted := false
 	offset := int64(0)
-	var err error
 	for !corrupted {
 		record, err := file.ReadRecordAt(offset)
 		if err != nil {
@@ -192,15 +470,8 @@ func RecoverDataFile(file *DataFile) (bool, error) {
 	if offset == file.Size() {
 		return false, nil
 	}
-	data := make([]byte, offset)
-	_, err = io.ReadFull(file, data)
-	if err != nil {
-		return false, err
-	}
-	err = os.WriteFile(file.Name(), data, 0600)
-	if err != nil {
+	if err := file.Truncate(offset); err != nil {
 		return false, err
 	}
-	file.end = offset
 	return true, nil
 }
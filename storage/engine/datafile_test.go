@@ -177,3 +177,105 @@ func TestRecoverDataFile(t *testing.T) {
 	err = os.Remove(name)
 	require.Nil(t, err)
 }
+
+func TestDataFileBufferedWrite(t *testing.T) {
+	dir := "test"
+	err := os.MkdirAll(dir, 0700)
+	require.Nil(t, err)
+	err = os.RemoveAll(filepath.Join(dir, fmt.Sprintf(dataFileExtension, 0)))
+	require.Nil(t, err)
+	df, err := NewDataFile(dir, 0, false, WithWriteBuffer(writeBufferSize))
+	require.Nil(t, err)
+
+	flag := byte(0)
+	key := []byte(fmt.Sprintf("%016d", 123))
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	expected := NewRecordWithoutChecksum(flag, key, value)
+	for i := 0; i < 100; i++ {
+		offset, size, err := df.AppendRecord(expected)
+		require.Nil(t, err)
+
+		// record is still in the write buffer
+		actual, err := df.ReadEntireRecordAt(offset, size)
+		require.Nil(t, err)
+		require.False(t, actual.Corrupted())
+		require.Equal(t, value, actual.Value())
+		actual, err = df.ReadRecordAt(offset)
+		require.Nil(t, err)
+		require.False(t, actual.Corrupted())
+		require.Equal(t, value, actual.Value())
+	}
+	stat, err := os.Stat(df.Name())
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stat.Size())
+
+	err = df.Sync()
+	require.Nil(t, err)
+	stat, err = os.Stat(df.Name())
+	require.Nil(t, err)
+	require.Equal(t, df.Size(), stat.Size())
+
+	// record larger than the write buffer is written to file directly
+	value = make([]byte, writeBufferSize)
+	expected = NewRecordWithoutChecksum(flag, key, value)
+	offset, size, err := df.AppendRecord(expected)
+	require.Nil(t, err)
+	stat, err = os.Stat(df.Name())
+	require.Nil(t, err)
+	require.Equal(t, offset+size, stat.Size())
+	actual, err := df.ReadEntireRecordAt(offset, size)
+	require.Nil(t, err)
+	require.False(t, actual.Corrupted())
+	require.Equal(t, value, actual.Value())
+
+	name := df.Name()
+	err = df.Close()
+	require.Nil(t, err)
+	err = os.Remove(name)
+	require.Nil(t, err)
+
+	// without a write buffer every append reaches the file
+	df, err = NewDataFile(dir, 0, false)
+	require.Nil(t, err)
+	offset, size, err = df.AppendRecord(NewRecordWithoutChecksum(flag, key, []byte("value")))
+	require.Nil(t, err)
+	stat, err = os.Stat(df.Name())
+	require.Nil(t, err)
+	require.Equal(t, offset+size, stat.Size())
+	err = df.Close()
+	require.Nil(t, err)
+	err = os.Remove(name)
+	require.Nil(t, err)
+}
+
+func TestDataFilePreallocate(t *testing.T) {
+	dir := "test"
+	err := os.MkdirAll(dir, 0700)
+	require.Nil(t, err)
+	err = os.RemoveAll(filepath.Join(dir, fmt.Sprintf(dataFileExtension, 0)))
+	require.Nil(t, err)
+	df, err := NewDataFile(dir, 0, false, WithPreallocate(1<<24))
+	require.Nil(t, err)
+	// preallocation doesn't change file size
+	stat, err := os.Stat(df.Name())
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stat.Size())
+
+	flag := byte(0)
+	key := []byte(fmt.Sprintf("%016d", 123))
+	value := []byte(fmt.Sprintf("%065536d", 123))
+	record := NewRecordWithoutChecksum(flag, key, value)
+	for i := 0; i < 100; i++ {
+		_, _, err := df.AppendRecord(record)
+		require.Nil(t, err)
+	}
+	size := df.Size()
+	name := df.Name()
+	err = df.Close()
+	require.Nil(t, err)
+	stat, err = os.Stat(name)
+	require.Nil(t, err)
+	require.Equal(t, size, stat.Size())
+	err = os.Remove(name)
+	require.Nil(t, err)
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package engine
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the bytes available to the store and the size of the file
+// system holding dir
+func diskSpace(dir string) (free uint64, total uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package engine
+
+// diskSpace is only supported on linux, the disk space is unknown elsewhere
+func diskSpace(dir string) (free uint64, total uint64, err error) {
+	return 0, 0, nil
+}
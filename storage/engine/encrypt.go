@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrEncrypted         = errors.New("value is encrypted and no encryption key is set")
+	ErrInvalidEncryption = errors.New("invalid encryption key, it must be 16, 24 or 32 bytes")
+)
+
+// newAEAD returns the AES-GCM cipher of key, it is nil if key is empty
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidEncryption
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals value with a random nonce, which is stored in front of the ciphertext.
+// The record key is authenticated too, so a value can't be moved to another key.
+func (m *MKV) encrypt(key []byte, value []byte) ([]byte, error) {
+	nonceSize := m.aead.NonceSize()
+	sealed := make([]byte, nonceSize, nonceSize+len(value)+m.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	return m.aead.Seal(sealed, sealed, value, key), nil
+}
+
+// markEncrypted raises the format version before the first encrypted record is written,
+// so binaries which don't decrypt refuse the store instead of serving ciphertext. It must
+// be called with the lock held.
+func (m *MKV) markEncrypted() error {
+	if m.meta.FormatVersion >= formatEncrypted {
+		return nil
+	}
+	version := m.meta.FormatVersion
+	m.meta.FormatVersion = formatEncrypted
+	if m.config.InMemory {
+		return nil
+	}
+	if err := SaveMeta(m.meta, m.config.RootDirectory, m.config.fileMode()); err != nil {
+		m.meta.FormatVersion = version
+		return err
+	}
+	return nil
+}
+
+// decrypt returns record with its value decrypted, the checksum of the returned record
+// covers the plain value, so it doesn't change when merges encrypt the value again
+func (m *MKV) decrypt(record *Record) (*Record, error) {
+	if !isEncrypted(record.flag) {
+		return record, nil
+	}
+	if m.aead == nil {
+		return nil, ErrEncrypted
+	}
+	nonceSize := m.aead.NonceSize()
+	if len(record.value) < nonceSize {
+		return nil, errors.Errorf("decrypt key %s error: value too short", record.key)
+	}
+	value, err := m.aead.Open(nil, record.value[:nonceSize], record.value[nonceSize:], record.key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypt key %s error", record.key)
+	}
+	plain := NewRecordWithoutChecksum(record.flag&^(1<<bitEncrypted), record.key, value)
+	plain.checksum = generateChecksum(plain.flag, plain.key, plain.value)
+	return plain, nil
+}
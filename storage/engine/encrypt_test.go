@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 256
+	config.EncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	secret := []byte(strings.Repeat("secret", 10))
+	for i := 0; i < 5; i++ {
+		err = s.Put([]byte("key"), secret)
+		require.Nil(t, err)
+	}
+	value, info, err := s.GetWithInfo(context.Background(), []byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, secret, value)
+
+	// merge copies the ciphertext and the checksum stays the checksum of the value
+	err = s.Merge()
+	require.Nil(t, err)
+	value, merged, err := s.GetWithInfo(context.Background(), []byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, secret, value)
+	require.Equal(t, info.Checksum, merged.Checksum)
+
+	r, size, err := s.OpenReaderAt([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, int64(len(secret)), size)
+	value, err = ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	require.Nil(t, err)
+	require.Equal(t, secret, value)
+
+	err = s.Copy([]byte("key"), []byte("copy"))
+	require.Nil(t, err)
+	value, err = s.Get([]byte("copy"))
+	require.Nil(t, err)
+	require.Equal(t, secret, value)
+	err = s.Close()
+	require.Nil(t, err)
+
+	files, err := filepath.Glob(filepath.Join(config.RootDirectory, "*.data"))
+	require.Nil(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		require.Nil(t, err)
+		require.NotContains(t, string(data), "secret")
+	}
+
+	noKey := *config
+	noKey.EncryptionKey = nil
+	s, err = Open(&noKey)
+	require.Nil(t, err)
+	_, err = s.Get([]byte("key"))
+	require.Equal(t, ErrEncrypted, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	wrongKey := *config
+	wrongKey.EncryptionKey = []byte("fedcba9876543210fedcba9876543210")
+	s, err = Open(&wrongKey)
+	require.Nil(t, err)
+	_, err = s.Get([]byte("key"))
+	require.NotNil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	invalid := *config
+	invalid.EncryptionKey = []byte("short")
+	_, err = Open(&invalid)
+	require.NotNil(t, err)
+}
+
+func TestEncryptionFormatVersion(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	require.Nil(t, s.Put([]byte("plain"), []byte("value")))
+	require.Nil(t, s.Close())
+
+	// opening with a key changes nothing, the first encrypted record raises the version
+	// before it is written, so binaries reading version 1 only refuse the store
+	config.EncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	s, err = Open(config)
+	require.Nil(t, err)
+	meta, err := LoadMeta(config.RootDirectory)
+	require.Nil(t, err)
+	require.Equal(t, 1, meta.FormatVersion)
+	require.Nil(t, s.Put([]byte("key"), []byte("secret")))
+	meta, err = LoadMeta(config.RootDirectory)
+	require.Nil(t, err)
+	require.Equal(t, formatEncrypted, meta.FormatVersion)
+	s.mutex.RLock()
+	record, err := s.readRawRecord(s.index["key"])
+	s.mutex.RUnlock()
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+
+	// encrypted records put as they are raise the version of a store without key
+	other := DefaultConfig()
+	other.RootDirectory = filepath.Join(config.RootDirectory, "other")
+	s, err = Open(other)
+	require.Nil(t, err)
+	defer s.Close()
+	require.Nil(t, s.PutData(EncodeRecordWithChecksum(record), "key"))
+	meta, err = LoadMeta(other.RootDirectory)
+	require.Nil(t, err)
+	require.Equal(t, formatEncrypted, meta.FormatVersion)
+	_, err = s.Get([]byte("key"))
+	require.Equal(t, ErrEncrypted, err)
+}
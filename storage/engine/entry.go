@@ -6,23 +6,31 @@ const (
 	idBegin     = 0
 	offsetBegin = 8
 	sizeBegin   = 8 + 8
-	sizeEnd     = 8 + 8 + 8
+	seqBegin    = 8 + 8 + 8
+	sizeEnd     = 8 + 8 + 8 + 8
 )
 
 type Entry struct {
 	ID     uint64
 	Offset uint64
 	Size   uint64
+	// Seq is the sequence number of the write which produced the entry
+	Seq uint64
+	// ModTime is when the entry was written in unix nanoseconds, it isn't encoded,
+	// entries loaded from disk get the modification time of their data file
+	ModTime int64
 }
 
 func DecodeEntry(bytes []byte) *Entry {
 	id := binary.BigEndian.Uint64(bytes[idBegin:offsetBegin])
 	offset := binary.BigEndian.Uint64(bytes[offsetBegin:sizeBegin])
-	size := binary.BigEndian.Uint64(bytes[sizeBegin:sizeEnd])
+	size := binary.BigEndian.Uint64(bytes[sizeBegin:seqBegin])
+	seq := binary.BigEndian.Uint64(bytes[seqBegin:sizeEnd])
 	return &Entry{
 		ID:     id,
 		Offset: offset,
 		Size:   size,
+		Seq:    seq,
 	}
 }
 
@@ -30,6 +38,7 @@ func EncodeEntry(entry *Entry) []byte {
 	bytes := make([]byte, sizeEnd)
 	binary.BigEndian.PutUint64(bytes[idBegin:offsetBegin], entry.ID)
 	binary.BigEndian.PutUint64(bytes[offsetBegin:sizeBegin], entry.Offset)
-	binary.BigEndian.PutUint64(bytes[sizeBegin:sizeEnd], entry.Size)
+	binary.BigEndian.PutUint64(bytes[sizeBegin:seqBegin], entry.Size)
+	binary.BigEndian.PutUint64(bytes[seqBegin:sizeEnd], entry.Seq)
 	return bytes
 }
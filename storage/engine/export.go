@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Export writes the current value of every key to w ordered by key, in the record
+// format of data files, so Import reads it back with user flags intact. Each key is
+// read under the read lock, writes during the export may or may not be included.
+func (m *MKV) Export(w io.Writer) (int64, error) {
+	m.mutex.RLock()
+	keys := make([]string, 0, len(m.index))
+	for key := range m.index {
+		keys = append(keys, key)
+	}
+	m.mutex.RUnlock()
+	sort.Strings(keys)
+	var written int64
+	for _, key := range keys {
+		m.mutex.RLock()
+		record, _, err := m.getRecord([]byte(key))
+		m.mutex.RUnlock()
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		if record.Corrupted() {
+			return written, errors.Errorf("export key %s error: corrupt record", key)
+		}
+		n, err := w.Write(EncodeRecordWithChecksum(record))
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Import puts every record read from r, which is in the format written by Export,
+// and returns the number of imported keys. It stops at the first corrupt record.
+func (m *MKV) Import(r io.Reader) (int64, error) {
+	var imported int64
+	for {
+		record, err := readRecord(r)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		if record.Corrupted() {
+			return imported, errors.Errorf("import record %d error: corrupt record", imported)
+		}
+		if record.IsDeleted() {
+			continue
+		}
+		if err := m.PutWithFlag(record.key, record.value, record.UserFlag()); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+}
+
+// readRecord reads the next record from r, it returns io.EOF if r ends before
+// the record and io.ErrUnexpectedEOF if r ends within it
+func readRecord(r io.Reader) (*Record, error) {
+	header := make([]byte, 1, wideKeyBegin)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	header = header[:headerSize(header[flagPos])]
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return nil, noEOF(err)
+	}
+	ksize := keySize(header)
+	bytes := make([]byte, uint64(len(header))+uint64(ksize)+valueSize(header)+checksumSize)
+	copy(bytes, header)
+	if _, err := io.ReadFull(r, bytes[len(header):]); err != nil {
+		return nil, noEOF(err)
+	}
+	return DecodeRecord(bytes), nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
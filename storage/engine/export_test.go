@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	n := 10
+	for i := 0; i < n; i++ {
+		err := s.PutWithFlag([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), byte(i))
+		require.Nil(t, err)
+	}
+	err = s.Put([]byte("key0"), []byte("new value"))
+	require.Nil(t, err)
+	err = s.Delete([]byte("key1"))
+	require.Nil(t, err)
+	stats := s.Stats()
+	require.Equal(t, n-1, stats.Keys)
+	require.Equal(t, 1, stats.DataFiles)
+	require.Equal(t, s.cur.Size(), stats.DiskBytes)
+	require.True(t, stats.LiveBytes < stats.DiskBytes)
+	// every live record has a 7 byte header and a 4 byte checksum
+	require.Equal(t, int64(11*(n-1)), stats.OverheadBytes)
+	require.Equal(t, stats.DiskBytes-stats.LiveBytes, stats.GarbageBytes)
+	require.Equal(t, int64(0), stats.VersionBytes)
+
+	var buf bytes.Buffer
+	written, err := s.Export(&buf)
+	require.Nil(t, err)
+	require.Equal(t, int64(buf.Len()), written)
+	require.Equal(t, stats.LiveBytes, written)
+	err = s.Close()
+	require.Nil(t, err)
+
+	config.RootDirectory = filepath.Join(config.RootDirectory, "import")
+	s, err = Open(config)
+	require.Nil(t, err)
+	exported := buf.Bytes()
+	imported, err := s.Import(bytes.NewReader(exported))
+	require.Nil(t, err)
+	require.Equal(t, int64(n-1), imported)
+	value, info, err := s.GetWithInfo(context.Background(), []byte("key0"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("new value"), value)
+	require.Equal(t, byte(0), info.UserFlag)
+	value, info, err = s.GetWithInfo(context.Background(), []byte("key5"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value5"), value)
+	require.Equal(t, byte(5), info.UserFlag)
+	_, err = s.Get([]byte("key1"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// a truncated or corrupt export is rejected
+	_, err = s.Import(bytes.NewReader(exported[:len(exported)-1]))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	exported[len(exported)-1] ^= 0xff
+	_, err = s.Import(bytes.NewReader(exported))
+	require.NotNil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
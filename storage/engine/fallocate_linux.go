@@ -0,0 +1,23 @@
+//go:build linux
+
+package engine
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocate allocates disk blocks for file without changing its size,
+// filesystems which don't support it are ignored
+func fallocate(file File, size int64) error {
+	f, ok := file.(*os.File)
+	if !ok {
+		return nil
+	}
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil
+	}
+	return err
+}
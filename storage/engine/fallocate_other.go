@@ -0,0 +1,8 @@
+//go:build !linux
+
+package engine
+
+// fallocate is only supported on linux
+func fallocate(file File, size int64) error {
+	return nil
+}
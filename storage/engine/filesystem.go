@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is the part of *os.File a DataFile uses
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileSystem opens files for data files, tests use it to inject failures
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// dirFileSystem is a FileSystem which keeps its own directories, the directory operations
+// of the store go to the os file system for other file systems
+type dirFileSystem interface {
+	FileSystem
+	Remove(name string) error
+	RemoveAll(dir string) error
+	Rename(oldpath string, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+	Glob(pattern string) ([]string, error)
+	MkdirAll(dir string, mode os.FileMode) error
+}
+
+// mkdirAll creates dir with mode whatever the umask, missing parents are created
+// as os.MkdirAll does
+func mkdirAll(fs FileSystem, dir string, mode os.FileMode) error {
+	if d, ok := fs.(dirFileSystem); ok {
+		return d.MkdirAll(dir, mode)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
+
+func removeFile(fs FileSystem, name string) error {
+	if d, ok := fs.(dirFileSystem); ok {
+		return d.Remove(name)
+	}
+	return os.Remove(name)
+}
+
+func removeAll(fs FileSystem, dir string) error {
+	if d, ok := fs.(dirFileSystem); ok {
+		return d.RemoveAll(dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+func renameFile(fs FileSystem, oldpath string, newpath string) error {
+	if d, ok := fs.(dirFileSystem); ok {
+		return d.Rename(oldpath, newpath)
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func statFile(fs FileSystem, name string) (os.FileInfo, error) {
+	if d, ok := fs.(dirFileSystem); ok {
+		return d.Stat(name)
+	}
+	return os.Stat(name)
+}
+
+func glob(fs FileSystem, pattern string) ([]string, error) {
+	if d, ok := fs.(dirFileSystem); ok {
+		return d.Glob(pattern)
+	}
+	return filepath.Glob(pattern)
+}
+
+// fsyncDir syncs the directory so created, renamed and removed entries are durable
+func fsyncDir(fs FileSystem, dir string) error {
+	// directories of a dirFileSystem have no entries of their own to sync
+	if _, ok := fs.(dirFileSystem); ok {
+		return nil
+	}
+	file, err := fs.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
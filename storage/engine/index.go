@@ -9,13 +9,27 @@ import (
 
 const indexFileName = "index"
 
-func SaveIndex(index map[string]*Entry, dir string) error {
+// SaveIndex replaces the index file atomically, a crash leaves the previous one
+func SaveIndex(index map[string]*Entry, dir string, mode os.FileMode) error {
 	name := filepath.Join(dir, indexFileName)
-	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err := writeIndex(index, name+".tmp", mode); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return fsyncDir(osFileSystem{}, dir)
+}
+
+func writeIndex(index map[string]*Entry, name string, mode os.FileMode) error {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	if err := file.Chmod(mode); err != nil {
+		return err
+	}
 	for key, entry := range index {
 		bytes := make([]byte, 2+len(key)+sizeEnd)
 		binary.BigEndian.PutUint16(bytes[0:2], uint16(len(key)))
@@ -19,10 +19,11 @@ func TestIndex(t *testing.T) {
 		}
 		index[key] = entry
 	}
-	err := SaveIndex(index, "test")
+	dir := t.TempDir()
+	err := SaveIndex(index, dir, defaultFileMode)
 	require.Nil(t, err)
 
-	actual, err := LoadIndex("test")
+	actual, err := LoadIndex(dir)
 	require.Nil(t, err)
 	require.Equal(t, index, actual)
 }
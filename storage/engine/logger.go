@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logger receives merge events, recovery actions and errors the store carries on after
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// stdLogger writes to a standard logger, prefixing messages with their level
+type stdLogger struct {
+	logger *log.Logger
+}
+
+// NewLogger returns a Logger writing to logger
+func NewLogger(logger *log.Logger) Logger {
+	return &stdLogger{logger: logger}
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logger.Output(2, "INFO "+fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Output(2, "WARN "+fmt.Sprintf(format, args...))
+}
+
+// logger returns the configured Logger, the standard logger is used if it is nil
+func (config *Config) logger() Logger {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	return NewLogger(log.Default())
+}
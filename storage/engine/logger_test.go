@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Infof(format string, args ...interface{}) {
+	l.record("INFO "+format, args...)
+}
+
+func (l *recordLogger) Warnf(format string, args ...interface{}) {
+	l.record("WARN "+format, args...)
+}
+
+func (l *recordLogger) record(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) find(prefix string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	logger := &recordLogger{}
+	config.Logger = logger
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	err = s.Merge()
+	require.Nil(t, err)
+	require.True(t, logger.find("INFO merging"))
+	require.True(t, logger.find("INFO merged"))
+	err = s.Close()
+	require.Nil(t, err)
+
+	// a torn write is truncated when the store is opened
+	files, err := filepath.Glob(filepath.Join(config.RootDirectory, "*.data"))
+	require.Nil(t, err)
+	file, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 3})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	require.False(t, logger.find("WARN truncated"))
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.True(t, logger.find("WARN truncated"))
+	err = s.Close()
+	require.Nil(t, err)
+}
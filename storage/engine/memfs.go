@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFileSystem keeps files in memory for stores with Config.InMemory set, directories
+// exist implicitly as prefixes of file names
+type memFileSystem struct {
+	mutex sync.Mutex
+	files map[string]*memData
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{files: make(map[string]*memData)}
+}
+
+// memData is the content of a file, shared by all its open handles
+type memData struct {
+	mutex   sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (fs *memFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	data, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		data = &memData{modTime: time.Now()}
+		fs.files[name] = data
+	}
+	return &memFile{name: name, data: data, readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0}, nil
+}
+
+func (fs *memFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+// RemoveAll removes the files below dir
+func (fs *memFileSystem) RemoveAll(dir string) error {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for name := range fs.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(fs.files, name)
+		}
+	}
+	return nil
+}
+
+func (fs *memFileSystem) Rename(oldpath string, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	data, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = data
+	return nil
+}
+
+func (fs *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	data, ok := fs.files[name]
+	fs.mutex.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return data.stat(name), nil
+}
+
+func (fs *memFileSystem) Glob(pattern string) ([]string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var names []string
+	for name := range fs.files {
+		ok, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *memFileSystem) MkdirAll(dir string, mode os.FileMode) error {
+	return nil
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memFile is an open handle of a file of a memFileSystem
+type memFile struct {
+	name     string
+	data     *memData
+	readOnly bool
+	// offset is the position of Read
+	offset int64
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.data.mutex.RLock()
+	defer f.data.mutex.RUnlock()
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.data.mutex.Lock()
+	defer f.data.mutex.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	copy(f.data.data[off:], p)
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.readOnly {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	f.data.mutex.Lock()
+	defer f.data.mutex.Unlock()
+	if size <= int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	} else {
+		f.data.data = append(f.data.data, make([]byte, size-int64(len(f.data.data)))...)
+	}
+	f.data.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.data.stat(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (info *memFileInfo) Name() string       { return info.name }
+func (info *memFileInfo) Size() int64        { return info.size }
+func (info *memFileInfo) Mode() os.FileMode  { return defaultFileMode }
+func (info *memFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memFileInfo) IsDir() bool        { return false }
+func (info *memFileInfo) Sys() interface{}   { return nil }
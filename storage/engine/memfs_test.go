@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory(t *testing.T) {
+	config := DefaultConfig()
+	config.RootDirectory = filepath.Join(os.TempDir(), "mos-in-memory")
+	config.InMemory = true
+	config.DataFileMaxSize = 1 << 10
+	config.ShardSize = 2
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	// data files rotate and are merged in memory
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			err := s.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d-%d", i, round)))
+			require.Nil(t, err)
+		}
+	}
+	require.Nil(t, s.Delete([]byte("key0")))
+	require.Greater(t, len(s.DataFiles()), 2)
+	require.Nil(t, s.Merge())
+	for i := 1; i < 100; i++ {
+		value, err := s.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("value%d-2", i), string(value))
+	}
+	_, err = s.Get([]byte("key0"))
+	require.Equal(t, ErrKeyNotFound, err)
+	report, err := s.Verify()
+	require.Nil(t, err)
+	require.Zero(t, report.Corrupt)
+	require.Nil(t, s.FlushIndex())
+
+	require.Nil(t, s.Truncate())
+	_, err = s.Get([]byte("key1"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Nil(t, s.Put([]byte("key"), []byte("value")))
+	require.Nil(t, s.Close())
+	_, err = os.Stat(config.RootDirectory)
+	require.True(t, os.IsNotExist(err))
+
+	// every open starts empty
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	_, err = s.Get([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	config.ReadOnly = true
+	_, err = Open(config)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A merge is swapped in by moving the files of the merged store in place of the merged
+// files. The journal saved before lists both, so a crash while swapping is finished at
+// the next open instead of leaving merged files removed and their replacements unmoved.
+const mergeJournalName = "merge.json"
+
+type mergeJournal struct {
+	// Dir is the directory of the merged store below the root directory
+	Dir string `json:"dir"`
+	// Merged are the ids of the replaced files, IDs the ids of the files in Dir
+	Merged []int `json:"merged"`
+	IDs    []int `json:"ids"`
+}
+
+func saveMergeJournal(fs FileSystem, dir string, journal *mergeJournal, mode os.FileMode) error {
+	name := filepath.Join(dir, mergeJournalName)
+	bytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name+".tmp", bytes, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(name+".tmp", mode); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return fsyncDir(fs, dir)
+}
+
+func loadMergeJournal(dir string) (*mergeJournal, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, mergeJournalName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	journal := new(mergeJournal)
+	if err := json.Unmarshal(bytes, journal); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func removeMergeJournal(fs FileSystem, dir string) error {
+	if err := os.Remove(filepath.Join(dir, mergeJournalName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fsyncDir(fs, dir)
+}
+
+// replaceMerged moves the files of the merged store in place of the merged files and
+// removes the merged files without replacement. A data file is moved after its hint file,
+// so a merged data file left in the merged store marks its id as not done, and replacing
+// can be repeated after a crash.
+func replaceMerged(fs FileSystem, root string, shardSize int, journal *mergeJournal) error {
+	replaced := make(map[int]bool, len(journal.IDs))
+	for _, id := range journal.IDs {
+		replaced[id] = true
+		from := dataFileDir(filepath.Join(root, journal.Dir), id, shardSize)
+		to := dataFileDir(root, id, shardSize)
+		data, hint := fmt.Sprintf(dataFileExtension, id), fmt.Sprintf(hintFileExtension, id)
+		if _, err := statFile(fs, filepath.Join(from, data)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// a hint of the merged file would describe the wrong records
+		if err := removeFile(fs, filepath.Join(to, hint)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := renameFile(fs, filepath.Join(from, hint), filepath.Join(to, hint)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := renameFile(fs, filepath.Join(from, data), filepath.Join(to, data)); err != nil {
+			return err
+		}
+	}
+	for _, id := range journal.Merged {
+		if replaced[id] {
+			continue
+		}
+		dir := dataFileDir(root, id, shardSize)
+		for _, name := range []string{fmt.Sprintf(dataFileExtension, id), fmt.Sprintf(hintFileExtension, id)} {
+			if err := removeFile(fs, filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finishMerge completes the swap of a merge interrupted by a crash and removes the
+// directories of merges which never got to the swap
+func finishMerge(config *Config) error {
+	journal, err := loadMergeJournal(config.RootDirectory)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		config.logger().Warnf("finishing merge of %d data files interrupted while swapping", len(journal.Merged))
+		if err := replaceMerged(osFileSystem{}, config.RootDirectory, config.ShardSize, journal); err != nil {
+			return err
+		}
+		for _, ids := range [][]int{journal.Merged, journal.IDs} {
+			for _, id := range ids {
+				if err := fsyncDir(osFileSystem{}, dataFileDir(config.RootDirectory, id, config.ShardSize)); err != nil {
+					return err
+				}
+			}
+		}
+		// an index saved since refers to the replaced files
+		if err := os.Remove(filepath.Join(config.RootDirectory, indexFileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := removeMergeJournal(osFileSystem{}, config.RootDirectory); err != nil {
+			return err
+		}
+	}
+	dirs, err := filepath.Glob(filepath.Join(config.RootDirectory, "merge*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
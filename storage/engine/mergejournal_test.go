@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// crashingRenameFileSystem works on the disk until renames renames are done, the ones
+// after fail like a crash in the middle of a swap
+type crashingRenameFileSystem struct {
+	renames int
+}
+
+func (fs *crashingRenameFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (fs *crashingRenameFileSystem) Remove(name string) error { return os.Remove(name) }
+
+func (fs *crashingRenameFileSystem) RemoveAll(dir string) error { return nil }
+
+func (fs *crashingRenameFileSystem) Rename(oldpath string, newpath string) error {
+	if fs.renames == 0 {
+		return errors.New("crashed")
+	}
+	fs.renames--
+	return os.Rename(oldpath, newpath)
+}
+
+func (fs *crashingRenameFileSystem) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (fs *crashingRenameFileSystem) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (fs *crashingRenameFileSystem) MkdirAll(dir string, mode os.FileMode) error {
+	return os.MkdirAll(dir, mode)
+}
+
+func TestMergeJournal(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 10
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("value%d", round)))
+			require.Nil(t, err)
+		}
+	}
+	require.Nil(t, s.Close())
+
+	// the swap stops after moving the first merged data file and its hint
+	fs := &crashingRenameFileSystem{renames: 2}
+	config.FileSystem = fs
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.NotNil(t, s.Merge())
+	require.FileExists(t, filepath.Join(config.RootDirectory, mergeJournalName))
+	s.Close()
+
+	// a read only open can't put the files right
+	config.FileSystem = nil
+	config.ReadOnly = true
+	_, err = Open(config)
+	require.NotNil(t, err)
+
+	config.ReadOnly = false
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.NoFileExists(t, filepath.Join(config.RootDirectory, mergeJournalName))
+	dirs, err := filepath.Glob(filepath.Join(config.RootDirectory, "merge*"))
+	require.Nil(t, err)
+	require.Empty(t, dirs)
+	for i := 0; i < 100; i++ {
+		value, err := s.Get([]byte(fmt.Sprintf("%016d", i)))
+		require.Nil(t, err)
+		require.Equal(t, []byte("value2"), value)
+	}
+	require.Nil(t, s.Close())
+}
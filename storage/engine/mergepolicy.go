@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// below adaptiveFreeTarget of the disk free the merge thresholds are lowered in
+	// proportion, down to adaptiveMinScale of the configured ones
+	adaptiveFreeTarget = 0.3
+	adaptiveMinScale   = 0.25
+	// merges aren't deferred once less than adaptiveMinFree of the disk is free
+	adaptiveMinFree = 0.1
+	// writes faster than usual raise the thresholds up to adaptiveMaxScale times
+	adaptiveMaxScale = 2
+	// weights of the latest throughput in the fast and the slow moving average
+	fastWeight = 0.5
+	slowWeight = 0.1
+)
+
+// mergePolicy scales the merge thresholds if Config.AdaptiveMerge is set. Scarce disk
+// space lowers them, so space is reclaimed earlier, and a burst of writes raises them,
+// so merges don't compete with the writes for I/O. Writes are judged busy by comparing
+// the throughput since the last check, averaged over few and over many checks.
+type mergePolicy struct {
+	mutex sync.Mutex
+	// fast and slow average the write throughput in bytes per second
+	fast    float64
+	slow    float64
+	scale   float64
+	written int64
+	checked time.Time
+}
+
+func newMergePolicy() *mergePolicy {
+	return &mergePolicy{scale: 1}
+}
+
+// update computes the scale of the thresholds at now, written is the number of bytes
+// written since open, free and total are the disk space of the store, total is 0 if
+// it is unknown
+func (p *mergePolicy) update(now time.Time, written int64, free uint64, total uint64) float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if elapsed := now.Sub(p.checked).Seconds(); !p.checked.IsZero() && elapsed > 0 {
+		rate := float64(written-p.written) / elapsed
+		if p.slow == 0 {
+			p.fast, p.slow = rate, rate
+		} else {
+			p.fast += fastWeight * (rate - p.fast)
+			p.slow += slowWeight * (rate - p.slow)
+		}
+	}
+	p.written = written
+	p.checked = now
+
+	freeRatio := 1.0
+	if total > 0 {
+		freeRatio = float64(free) / float64(total)
+	}
+	scale := 1.0
+	if freeRatio < adaptiveFreeTarget {
+		scale = math.Max(adaptiveMinScale, freeRatio/adaptiveFreeTarget)
+	}
+	if freeRatio >= adaptiveMinFree && p.slow > 0 && p.fast > p.slow {
+		scale *= math.Min(adaptiveMaxScale, p.fast/p.slow)
+	}
+	p.scale = scale
+	return scale
+}
+
+func (p *mergePolicy) currentScale() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.scale
+}
+
+// mergeThresholds returns the merge ratio and space thresholds auto merging applies
+func (m *MKV) mergeThresholds() (float64, int64) {
+	scale := 1.0
+	if m.policy != nil {
+		scale = m.policy.currentScale()
+	}
+	return math.Min(1, m.config.MergeRatioThreshold*scale), int64(float64(m.config.MergeSpaceThreshold) * scale)
+}
+
+// updateMergePolicy feeds the policy with the bytes written and the disk space, a
+// failure to read the disk space is logged and the space taken as unknown
+func (m *MKV) updateMergePolicy() {
+	if m.policy == nil {
+		return
+	}
+	var free, total uint64
+	if !m.config.InMemory {
+		var err error
+		if free, total, err = diskSpace(m.config.RootDirectory); err != nil {
+			m.config.logger().Warnf("get disk space error: %s", err)
+		}
+	}
+	m.mutex.RLock()
+	written := m.bytesWritten
+	m.mutex.RUnlock()
+	m.policy.update(time.Now(), written, free, total)
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePolicy(t *testing.T) {
+	p := newMergePolicy()
+	now := time.Now()
+	var written int64
+	// a steady write rate with plenty of disk leaves the thresholds as configured
+	for i := 0; i < 10; i++ {
+		written += 1000
+		now = now.Add(time.Second)
+		require.Equal(t, 1.0, p.update(now, written, 80, 100))
+	}
+
+	// a burst of writes defers merges
+	written += 100000
+	now = now.Add(time.Second)
+	require.Equal(t, 2.0, p.update(now, written, 80, 100))
+	require.Equal(t, 2.0, p.currentScale())
+
+	// scarce disk space lowers the thresholds, a burst still defers merges
+	written += 100000
+	now = now.Add(time.Second)
+	scale := p.update(now, written, 15, 100)
+	require.Greater(t, scale, 0.5)
+	require.LessOrEqual(t, scale, 1.0)
+
+	// but not once the disk is nearly full
+	written += 100000
+	now = now.Add(time.Second)
+	require.Equal(t, adaptiveMinScale, p.update(now, written, 5, 100))
+
+	// an unknown disk space is taken as plenty
+	p = newMergePolicy()
+	require.Equal(t, 1.0, p.update(now, 0, 0, 0))
+}
+
+func TestAdaptiveMergeStats(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.AdaptiveMerge = true
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	require.Equal(t, s.RecordSize([]byte("key"), []byte("value")), s.bytesWritten)
+
+	stats := s.Stats()
+	require.Equal(t, config.MergeRatioThreshold, stats.MergeRatioThreshold)
+	require.Equal(t, config.MergeSpaceThreshold, stats.MergeSpaceThreshold)
+
+	s.policy.update(time.Now(), s.bytesWritten, 5, 100)
+	stats = s.Stats()
+	require.Equal(t, config.MergeRatioThreshold*adaptiveMinScale, stats.MergeRatioThreshold)
+	require.Equal(t, int64(float64(config.MergeSpaceThreshold)*adaptiveMinScale), stats.MergeSpaceThreshold)
+}
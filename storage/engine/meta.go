@@ -3,12 +3,47 @@ package engine
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+
+	"github.com/pkg/errors"
 )
 
+// FormatVersion is the newest layout of data, hint and index files the store reads, it is
+// raised whenever older binaries would misread the files. A store keeps the oldest version
+// its records need, so older binaries read it as long as they can. Stores written before
+// the version was recorded have the layout of version 1.
+const FormatVersion = 2
+
+// formatEncrypted is the version of stores with encrypted records, older binaries would
+// serve their ciphertext
+const formatEncrypted = 2
+
+// ChecksumCRC32 is the checksum of records, CRC-32 with the IEEE polynomial
+const ChecksumCRC32 = "crc32"
+
+var ErrUnsupportedFormat = errors.New("store format not supported")
+
 type Meta struct {
-	IndexUpToDate bool  `json:"index_up_to_date"`
-	ReusableSpace int64 `json:"reusable_space"`
+	IndexUpToDate bool   `json:"index_up_to_date"`
+	ReusableSpace int64  `json:"reusable_space"`
+	Seq           uint64 `json:"seq"`
+	// FormatVersion and ChecksumType are the format the store was written with
+	FormatVersion int    `json:"format_version,omitempty"`
+	ChecksumType  string `json:"checksum_type,omitempty"`
+	// Checkpoint is set when the index file was saved, the index file holds all
+	// records before it, it is nil if the index file doesn't match the data files
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Checkpoint is the position of the store when the index file was saved
+type Checkpoint struct {
+	// FileID is the data file written to, records of later files aren't indexed
+	FileID int `json:"file_id"`
+	// Offset is the size of the data file, records from it on aren't indexed
+	Offset int64 `json:"offset"`
+	// Seq is the sequence number of the last indexed write
+	Seq uint64 `json:"seq"`
 }
 
 const metaFileName = "meta.json"
@@ -29,11 +64,41 @@ func LoadMeta(dir string) (*Meta, error) {
 	return meta, nil
 }
 
-func SaveMeta(meta *Meta, dir string) error {
+// checkFormat fails with ErrUnsupportedFormat if the store was written in a format this
+// binary doesn't read
+func checkFormat(meta *Meta) error {
+	if meta.FormatVersion > FormatVersion {
+		return errors.Wrapf(ErrUnsupportedFormat, "format version %d is newer than %d", meta.FormatVersion, FormatVersion)
+	}
+	if meta.ChecksumType != "" && meta.ChecksumType != ChecksumCRC32 {
+		return errors.Wrapf(ErrUnsupportedFormat, "checksum type %s", meta.ChecksumType)
+	}
+	return nil
+}
+
+// setFormat records the format of a new store or of one written before formats were
+// recorded as version 1, the version is raised once records need a newer one
+func setFormat(meta *Meta) {
+	if meta.FormatVersion == 0 {
+		meta.FormatVersion = 1
+	}
+	if meta.ChecksumType == "" {
+		meta.ChecksumType = ChecksumCRC32
+	}
+}
+
+func SaveMeta(meta *Meta, dir string, mode os.FileMode) error {
 	name := filepath.Join(dir, metaFileName)
 	bytes, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(name, bytes, 0600)
+	// a torn meta file would fail every open, so it is replaced atomically
+	if err := ioutil.WriteFile(name+".tmp", bytes, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(name+".tmp", mode); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
 }
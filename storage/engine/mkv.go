@@ -1,6 +1,9 @@
 package engine
 
 import (
+	"container/heap"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -21,8 +24,20 @@ const lockFile = ".lock"
 const hintFileExtension = "%08d.hint"
 
 var (
-	ErrKeyNotFound = errors.New("key not found")
-	ErrDirLocked   = errors.New("dir is locked")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrDirLocked          = errors.New("dir is locked")
+	ErrReadOnly           = errors.New("store is read only")
+	ErrMergeInProgress    = errors.New("merge in progress")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrInvalidFlag        = errors.New("invalid user flag")
+	ErrValueTooLarge      = errors.New("value too large")
+	ErrKeyTooLarge        = errors.New("key too large")
+	ErrValueGone          = errors.New("value was replaced and merged away")
+	ErrNotCounter         = errors.New("value is not a counter")
+	ErrWriteVerify        = errors.New("written record reads back differently")
+	ErrMergeAborted       = errors.New("merge aborted by close")
+	// ErrStopScan stops ScanFrom without an error
+	ErrStopScan = errors.New("stop scan")
 )
 
 type MKV struct {
@@ -33,9 +48,47 @@ type MKV struct {
 	cur       *DataFile
 	dataFiles map[int]*DataFile
 	index     map[string]*Entry
-	isMerging bool
-	ticker    *time.Ticker
-	closeChan chan struct{}
+	versions  *versions
+	// refs counts the links to content addressed values by hash
+	refs map[string]int64
+	// aead encrypts values if Config.EncryptionKey is set
+	aead cipher.AEAD
+	// policy scales the merge thresholds if Config.AdaptiveMerge is set
+	policy *mergePolicy
+	// bytesWritten counts the bytes of the records written since open
+	bytesWritten int64
+	isMerging    bool
+	// mergeDone is closed when the running merge returns, merges stop between keys
+	// once mergeAbort is closed
+	mergeDone  chan struct{}
+	mergeAbort chan struct{}
+	// merges counts the merges swapped in
+	merges uint64
+	// hintErrors counts the hint files which couldn't be written on rotation
+	hintErrors int64
+	ticker     *time.Ticker
+	// flushTicker drives FlushIndex, flushMutex serializes flushes
+	flushTicker *time.Ticker
+	flushMutex  sync.Mutex
+	closeChan   chan struct{}
+	// backgroundDone is closed when runBackGround returns
+	backgroundDone chan struct{}
+
+	seq uint64
+	// deletes holds the deletes since open whose tombstones weren't merged yet,
+	// changes up to changesFloor are no longer fully known, see ChangedSince
+	deletes      map[string]tombstone
+	changesFloor uint64
+	// commits tracks durable writes, uncommitted counts the writes since the last commit
+	commits          *committer
+	scrubs           *scrubber
+	uncommitted      int
+	notifyMutex      sync.Mutex
+	writes           chan ChangeEvent
+	writesClosed     bool
+	writesDone       chan struct{}
+	subscribersMutex sync.Mutex
+	subscribers      map[chan ChangeEvent]struct{}
 }
 
 func Open(config *Config, options ...Option) (*MKV, error) {
@@ -45,7 +98,17 @@ func Open(config *Config, options ...Option) (*MKV, error) {
 	for _, option := range options {
 		option(config)
 	}
-	if err := os.MkdirAll(config.RootDirectory, 0700); err != nil {
+	aead, err := newAEAD(config.EncryptionKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "open kv engine error")
+	}
+	if config.InMemory {
+		return openInMemory(config, aead)
+	}
+	if config.ReadOnly {
+		return openReadOnly(config, aead)
+	}
+	if err := mkdirAll(osFileSystem{}, config.RootDirectory, config.dirMode()); err != nil {
 		return nil, errors.Wrap(err, "open KVEngine error")
 	}
 
@@ -57,20 +120,47 @@ func Open(config *Config, options ...Option) (*MKV, error) {
 	if !ok {
 		return nil, ErrDirLocked
 	}
+	// until the store is made, a failed open leaves the dir unlocked and no file open
+	var files []*DataFile
+	var cur *DataFile
+	opened := false
+	defer func() {
+		if opened {
+			return
+		}
+		for _, file := range files {
+			file.Close()
+		}
+		if cur != nil && len(files) == 0 {
+			cur.Close()
+		}
+		lock.Unlock()
+	}()
+	if err := os.Chmod(lock.Path(), config.fileMode()); err != nil {
+		return nil, errors.Wrap(err, "open KVEngine error")
+	}
 
+	if err := finishMerge(config); err != nil {
+		return nil, errors.Wrap(err, "open kv engine error: finish merge")
+	}
 	meta, err := LoadMeta(config.RootDirectory)
 	if err != nil {
 		return nil, err
 	}
-	files, err := LoadDataFiles(config.RootDirectory)
+	// a newer format could be misread and overwritten
+	if err := checkFormat(meta); err != nil {
+		return nil, errors.Wrap(err, "open kv engine error")
+	}
+	files, err = LoadDataFiles(config.RootDirectory, dataFileOptions(config)...)
 	if err != nil {
 		return nil, err
 	}
-	var cur *DataFile
+	var seq uint64
 	dataFiles := make(map[int]*DataFile)
 	index := make(map[string]*Entry)
+	versions := newVersions(config.MaxVersions)
 	if len(files) == 0 {
-		cur, err = NewDataFile(config.RootDirectory, 0, false)
+		cur, err = NewDataFile(config.RootDirectory, 0, false, dataFileOptions(config)...)
 		if err != nil {
 			return nil, errors.Wrap(err, "open kv engine error: ")
 		}
@@ -87,63 +177,243 @@ func Open(config *Config, options ...Option) (*MKV, error) {
 			return nil, errors.Wrap(err, "open kv engine error: ")
 		}
 		if recovered {
+			config.logger().Warnf("truncated corrupt tail of data file %d at %d bytes", cur.ID(), cur.Size())
 			if Exists(filepath.Join(config.RootDirectory, indexFileName)) {
 				if err := os.Remove(filepath.Join(config.RootDirectory, indexFileName)); err != nil {
 					return nil, errors.Wrap(err, "open kv engine error: ")
 				}
 			}
 		}
-		if meta.IndexUpToDate && Exists(filepath.Join(config.RootDirectory, indexFileName)) {
-			index, err = LoadIndex(config.RootDirectory)
-			if err != nil {
-				return nil, errors.Wrap(err, "open kv engine error: ")
-			}
-		} else {
-			if err := LoadIndexFromDataFiles(index, files); err != nil {
-				return nil, errors.Wrap(err, "open kv engine error: ")
-			}
+		index, seq, err = loadIndex(config.RootDirectory, meta, files, versions)
+		if err != nil {
+			return nil, errors.Wrap(err, "open kv engine error: ")
+		}
+	}
+	// the index file is stale once the store is written, it is up to date again after close,
+	// so a crash rebuilds the index from data files
+	meta.IndexUpToDate = false
+	setFormat(meta)
+	if err := SaveMeta(meta, config.RootDirectory, config.fileMode()); err != nil {
+		return nil, errors.Wrap(err, "open kv engine error: ")
+	}
+	m := &MKV{
+		lock:         lock,
+		config:       config,
+		cur:          cur,
+		meta:         meta,
+		dataFiles:    dataFiles,
+		index:        index,
+		versions:     versions,
+		aead:         aead,
+		isMerging:    false,
+		seq:          seq,
+		deletes:      make(map[string]tombstone),
+		changesFloor: seq,
+		commits:      newCommitter(seq),
+		mergeAbort:   make(chan struct{}),
+	}
+	if err := m.loadRefs(); err != nil {
+		return nil, errors.Wrap(err, "open kv engine error: ")
+	}
+	opened = true
+	m.startWrites()
+	// compacting before the background starts, so no auto merge is in progress already
+	if config.CompactOnOpen && m.needsMerge() {
+		if err := m.merge(context.Background(), false, true, nil); err != nil {
+			m.Close()
+			return nil, errors.Wrap(err, "open kv engine error: compact")
 		}
 	}
+	m.startBackground()
+	return m, nil
+}
+
+// openInMemory opens an empty store keeping its data files in memory, nothing is
+// written to disk and the data is gone once the store is closed
+func openInMemory(config *Config, aead cipher.AEAD) (*MKV, error) {
+	if config.ReadOnly {
+		return nil, errors.New("open kv engine error: an in memory store can't be read only")
+	}
+	// the store of a merge shares the file system of the merged store
+	if _, ok := config.FileSystem.(*memFileSystem); !ok {
+		inMemory := *config
+		inMemory.FileSystem = newMemFileSystem()
+		config = &inMemory
+	}
+	cur, err := NewDataFile(config.RootDirectory, 0, false, dataFileOptions(config)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "open kv engine error: ")
+	}
 	m := &MKV{
-		lock:      lock,
-		config:    config,
-		cur:       cur,
-		meta:      meta,
-		dataFiles: dataFiles,
-		index:     index,
-		isMerging: false,
-	}
-	if config.AutoMerging {
-		m.ticker = time.NewTicker(config.MergeInterval)
+		config:     config,
+		cur:        cur,
+		meta:       new(Meta),
+		dataFiles:  make(map[int]*DataFile),
+		index:      make(map[string]*Entry),
+		versions:   newVersions(config.MaxVersions),
+		refs:       make(map[string]int64),
+		aead:       aead,
+		deletes:    make(map[string]tombstone),
+		commits:    newCommitter(0),
+		mergeAbort: make(chan struct{}),
+	}
+	setFormat(m.meta)
+	m.start()
+	return m, nil
+}
+
+// start starts the background work of a writable store
+func (m *MKV) start() {
+	m.startWrites()
+	m.startBackground()
+}
+
+// startWrites starts what writes need, the change notifications and the committer
+func (m *MKV) startWrites() {
+	if m.config.AdaptiveMerge {
+		m.policy = newMergePolicy()
+	}
+	m.startNotify()
+	m.startCommitter()
+}
+
+// startBackground starts the scrubber, auto merges and index flushes
+func (m *MKV) startBackground() {
+	m.startScrubber()
+	if m.config.AutoMerging || m.config.IndexFlushInterval > 0 {
+		if m.config.AutoMerging {
+			m.ticker = time.NewTicker(m.config.MergeInterval)
+		}
+		if m.config.IndexFlushInterval > 0 {
+			m.flushTicker = time.NewTicker(m.config.IndexFlushInterval)
+		}
 		m.closeChan = make(chan struct{})
+		m.backgroundDone = make(chan struct{})
 		go m.runBackGround()
 	}
+}
+
+// openReadOnly opens a store with a shared dir lock, so multiple read only stores can coexist
+// while a writer is excluded, all data files are opened read only and the data files,
+// index and meta are never modified
+func openReadOnly(config *Config, aead cipher.AEAD) (*MKV, error) {
+	if _, err := os.Stat(config.RootDirectory); err != nil {
+		return nil, errors.Wrap(err, "open KVEngine error")
+	}
+	lock := flock.New(filepath.Join(config.RootDirectory, lockFile))
+	ok, err := lock.TryRLock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDirLocked
+	}
+	m, err := loadReadOnly(config, aead)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	m.lock = lock
+	m.startNotify()
+	return m, nil
+}
+
+func loadReadOnly(config *Config, aead cipher.AEAD) (*MKV, error) {
+	// the files of an interrupted swap are only put right by a writable open
+	if Exists(filepath.Join(config.RootDirectory, mergeJournalName)) {
+		return nil, errors.New("open kv engine error: a merge was interrupted, open the store writable to finish it")
+	}
+	meta, err := LoadMeta(config.RootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFormat(meta); err != nil {
+		return nil, errors.Wrap(err, "open kv engine error")
+	}
+	files, err := loadDataFiles(config.RootDirectory, true, dataFileOptions(config)...)
+	if err != nil {
+		return nil, err
+	}
+	dataFiles := make(map[int]*DataFile)
+	for _, file := range files {
+		dataFiles[file.ID()] = file
+	}
+	versions := newVersions(config.MaxVersions)
+	index, seq, err := loadIndex(config.RootDirectory, meta, files, versions)
+	if err != nil {
+		return nil, errors.Wrap(err, "open kv engine error: ")
+	}
+	m := &MKV{
+		config:       config,
+		meta:         meta,
+		dataFiles:    dataFiles,
+		index:        index,
+		versions:     versions,
+		aead:         aead,
+		seq:          seq,
+		changesFloor: seq,
+		commits:      newCommitter(seq),
+		mergeAbort:   make(chan struct{}),
+	}
+	if err := m.loadRefs(); err != nil {
+		return nil, errors.Wrap(err, "open kv engine error: ")
+	}
 	return m, nil
 }
 
-func LoadDataFiles(dir string) ([]*DataFile, error) {
-	names, err := filepath.Glob(fmt.Sprintf("%s/*.data", dir))
+func dataFileOptions(config *Config) []DataFileOption {
+	var options []DataFileOption
+	if config.Preallocate {
+		options = append(options, WithPreallocate(config.DataFileMaxSize))
+	}
+	if config.FileSystem != nil {
+		options = append(options, WithFileSystem(config.FileSystem))
+	}
+	if config.ShardSize > 0 {
+		options = append(options, WithShardSize(config.ShardSize))
+	}
+	if config.WriteBufferSize > 0 {
+		options = append(options, WithWriteBuffer(config.WriteBufferSize))
+	}
+	options = append(options, WithFileMode(config.fileMode(), config.dirMode()))
+	return options
+}
+
+// LoadDataFiles opens all data files in dir, the last one is opened writable with options
+func LoadDataFiles(dir string, options ...DataFileOption) ([]*DataFile, error) {
+	return loadDataFiles(dir, false, options...)
+}
+
+func loadDataFiles(dir string, readOnly bool, options ...DataFileOption) ([]*DataFile, error) {
+	layout := DataFile{fs: osFileSystem{}}
+	for _, option := range options {
+		option(&layout)
+	}
+	names, err := listFiles(layout.fs, dir, ".data")
 	if err != nil {
 		return nil, err
 	}
 	if len(names) == 0 {
 		return nil, nil
 	}
-	sort.Strings(names)
 	files := make([]*DataFile, len(names))
 	for i, name := range names {
 		id, err := ParseID(name)
 		if err != nil {
 			return nil, err
 		}
+		// opening a store with another layout would start a new data file next to the old ones
+		if filepath.Clean(filepath.Dir(name)) != filepath.Clean(dataFileDir(dir, id, layout.shardSize)) {
+			return nil, errors.Errorf("data file %s doesn't match shard size %d", name, layout.shardSize)
+		}
 		var file *DataFile
-		if i == len(names)-1 {
-			file, err = NewDataFile(dir, id, false)
+		if i == len(names)-1 && !readOnly {
+			file, err = NewDataFile(dir, id, false, options...)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			file, err = NewDataFile(dir, id, true)
+			file, err = NewDataFile(dir, id, true, WithShardSize(layout.shardSize))
 			if err != nil {
 				return nil, err
 			}
@@ -155,64 +425,166 @@ func LoadDataFiles(dir string) ([]*DataFile, error) {
 }
 
 func LoadIndexFromDataFiles(index map[string]*Entry, files []*DataFile) error {
+	_, err := loadIndexFromDataFiles(index, files, 0, nil)
+	return err
+}
+
+// loadIndexFromDataFiles replays records of files in order, records are numbered
+// following seq in replay order, the last sequence number is returned.
+// Overwritten entries are kept in v.
+func loadIndexFromDataFiles(index map[string]*Entry, files []*DataFile, seq uint64, v *versions) (uint64, error) {
 	for _, file := range files {
-		offset := int64(0)
-		for {
-			record, err := file.ReadRecordAt(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			if record.IsDeleted() {
-				delete(index, string(record.key))
-			}
-			entry := &Entry{
-				ID:     uint64(file.ID()),
-				Offset: uint64(offset),
-				Size:   uint64(record.Size()),
-			}
-			index[string(record.key)] = entry
-			offset += record.Size()
+		var err error
+		seq, err = loadIndexFromDataFile(index, file, 0, seq, v)
+		if err != nil {
+			return 0, err
 		}
 	}
-	return nil
+	return seq, nil
 }
 
+// LoadIndexFromDataFile replays records of file, which are newer than all entries in index
 func LoadIndexFromDataFile(index map[string]*Entry, file *DataFile) error {
-	offset := int64(0)
+	_, err := loadIndexFromDataFile(index, file, 0, maxSeq(index), nil)
+	return err
+}
+
+// loadIndexFromDataFile replays records of file starting at offset
+func loadIndexFromDataFile(index map[string]*Entry, file *DataFile, offset int64, seq uint64, v *versions) (uint64, error) {
 	for {
 		record, err := file.ReadRecordAt(offset)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return 0, err
 		}
+		seq++
 		if record.IsDeleted() {
 			delete(index, string(record.key))
+			v.drop(string(record.key))
+			offset += record.Size()
+			continue
 		}
 		entry := &Entry{
 			ID:     uint64(file.ID()),
 			Offset: uint64(offset),
 			Size:   uint64(record.Size()),
+			Seq:    seq,
+		}
+		if old, ok := index[string(record.key)]; ok {
+			v.retire(string(record.key), old)
 		}
 		index[string(record.key)] = entry
 		offset += record.Size()
 	}
+	return seq, nil
+}
+
+func maxSeq(index map[string]*Entry) uint64 {
+	var seq uint64
+	for _, entry := range index {
+		if entry.Seq > seq {
+			seq = entry.Seq
+		}
+	}
+	return seq
+}
+
+// loadIndex loads index from the index file if it is up to date, after a checkpoint
+// it replays the records written since, otherwise rebuilds it from
+// data files. Sequence numbers of records written after meta was saved are lost in a rebuild,
+// so they are renumbered following meta.Seq, as every write appends one record this never
+// reuses a sequence number. The highest sequence number in use is returned.
+func loadIndex(dir string, meta *Meta, files []*DataFile, v *versions) (map[string]*Entry, uint64, error) {
+	// stores written before entries had sequence numbers have no seq in meta,
+	// their index file can't be decoded. Older versions are only in data files.
+	if v == nil && !meta.IndexUpToDate && meta.Checkpoint != nil && Exists(filepath.Join(dir, indexFileName)) {
+		index, err := LoadIndex(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+		// only records after the checkpoint are replayed, so they get the sequence
+		// numbers they were written with
+		seq := meta.Checkpoint.Seq
+		for _, file := range files {
+			if file.ID() < meta.Checkpoint.FileID {
+				continue
+			}
+			offset := int64(0)
+			if file.ID() == meta.Checkpoint.FileID {
+				offset = meta.Checkpoint.Offset
+			}
+			seq, err = loadIndexFromDataFile(index, file, offset, seq, v)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return index, seq, setModTimes(index, files, v)
+	}
+	if v == nil && meta.IndexUpToDate && meta.Seq > 0 && Exists(filepath.Join(dir, indexFileName)) {
+		index, err := LoadIndex(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+		seq := maxSeq(index)
+		if meta.Seq > seq {
+			seq = meta.Seq
+		}
+		return index, seq, setModTimes(index, files, v)
+	}
+	index := make(map[string]*Entry)
+	seq, err := loadIndexFromDataFiles(index, files, meta.Seq, v)
+	if err != nil {
+		return nil, 0, err
+	}
+	return index, seq, setModTimes(index, files, v)
+}
+
+// setModTimes sets the modification time of loaded entries to the one of
+// their data file, which is never earlier than the write itself
+func setModTimes(index map[string]*Entry, files []*DataFile, v *versions) error {
+	modTimes := make(map[uint64]int64, len(files))
+	for _, file := range files {
+		modTime, err := file.ModTime()
+		if err != nil {
+			return err
+		}
+		modTimes[uint64(file.ID())] = modTime
+	}
+	for _, entry := range index {
+		entry.ModTime = modTimes[entry.ID]
+	}
+	if v != nil {
+		for _, entries := range v.entries {
+			for _, entry := range entries {
+				entry.ModTime = modTimes[entry.ID]
+			}
+		}
+	}
 	return nil
 }
 
 func getHintFilenames(dir string) ([]string, error) {
-	names, err := filepath.Glob(fmt.Sprintf("%s/*.hint", dir))
+	return listFiles(osFileSystem{}, dir, ".hint")
+}
+
+// listFiles returns the files of fs with extension ext in dir and its shard directories,
+// ordered by id
+func listFiles(fs FileSystem, dir string, ext string) ([]string, error) {
+	names, err := glob(fs, filepath.Join(dir, "*"+ext))
 	if err != nil {
 		return nil, err
 	}
-	if len(names) == 0 {
-		return names, nil
+	// shard directories are named by digits only, unlike merge directories
+	sharded, err := glob(fs, filepath.Join(dir, "[0-9]*", "*"+ext))
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(names)
+	names = append(names, sharded...)
+	sort.Slice(names, func(i, j int) bool {
+		return filepath.Base(names[i]) < filepath.Base(names[j])
+	})
 	return names, nil
 }
 
@@ -264,16 +636,29 @@ func (m *MKV) createHintFile(id int) error {
 			hint[key] = entry
 		}
 	}
-	return SaveHint(hint, m.config.RootDirectory, id)
+	return SaveHint(hint, dataFileDir(m.config.RootDirectory, id, m.config.ShardSize), id, m.config.fileMode())
 }
 
-func SaveHint(hint map[string]*Entry, dir string, id int) error {
+// SaveHint writes the hint file of data file id, a partly written hint file is removed
+// so it is never loaded
+func SaveHint(hint map[string]*Entry, dir string, id int, mode os.FileMode) error {
 	name := filepath.Join(dir, fmt.Sprintf(hintFileExtension, id))
-	file, err := os.Create(name)
+	if err := writeHint(hint, name, mode); err != nil {
+		os.Remove(name)
+		return errors.Wrapf(err, "save hint file %d error", id)
+	}
+	return nil
+}
+
+func writeHint(hint map[string]*Entry, name string, mode os.FileMode) error {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	if err := file.Chmod(mode); err != nil {
+		return err
+	}
 	for key, entry := range hint {
 		bytes := make([]byte, 2+len(key)+sizeEnd)
 		binary.BigEndian.PutUint16(bytes[0:2], uint16(len(key)))
@@ -288,127 +673,404 @@ func SaveHint(hint map[string]*Entry, dir string, id int) error {
 	return file.Sync()
 }
 
-func (m *MKV) mayCreateNewDataFile() error {
-	if m.cur.Size() < m.config.DataFileMaxSize {
+// mayCreateNewDataFile rotates the current data file before a record of size bytes is
+// appended, once it reached DataFileMaxSize. Files exceed DataFileMaxSize by their last
+// record, a record larger than DataFileMaxSize is written to a file of its own.
+func (m *MKV) mayCreateNewDataFile(size int64) error {
+	oversized := size > m.config.DataFileMaxSize
+	if oversized {
+		m.config.logger().Warnf("record of %d bytes exceeds the data file max size of %d bytes, it gets a data file of its own", size, m.config.DataFileMaxSize)
+	}
+	if m.cur.Size() < m.config.DataFileMaxSize && !(oversized && m.cur.Size() > 0) {
 		return nil
 	}
-	err := m.cur.Close()
-	if err != nil {
+	if err := m.closeCurrent(); err != nil {
 		return err
 	}
-	id := m.cur.ID()
-	df, err := NewDataFile(m.config.RootDirectory, id, true)
-	if err != nil {
-		return err
+	if m.config.InMemory {
+		return m.openNewDataFile()
 	}
-	m.dataFiles[id] = df
-	_ = m.createHintFile(id)
-	id += 1
-	cur, err := NewDataFile(m.config.RootDirectory, id, false)
-	if err != nil {
-		return err
+	// the hint file only speeds up loading the index, the data file is read without it,
+	// so the write goes on and the failure is counted in Stats
+	if err := m.createHintFile(m.cur.ID()); err != nil {
+		m.hintErrors++
+		m.config.logger().Warnf("create hint file %d error: %s", m.cur.ID(), err)
 	}
-	m.cur = cur
-	return nil
+	return m.openNewDataFile()
 }
 
 func (m *MKV) Put(key []byte, value []byte) error {
+	_, err := m.PutN(key, value)
+	return err
+}
+
+// PutN works like Put and returns the size of the record written
+func (m *MKV) PutN(key []byte, value []byte) (int64, error) {
+	return m.PutNCtx(context.Background(), key, value)
+}
+
+// MaxValueSize returns the largest value accepted, 0 if any size is
+func (m *MKV) MaxValueSize() int64 {
+	return m.config.MaxValueSize
+}
+
+func (m *MKV) tooLarge(size int64) bool {
+	return m.config.MaxValueSize > 0 && size > m.config.MaxValueSize
+}
+
+// ReadOnly reports whether the store was opened read only
+func (m *MKV) ReadOnly() bool {
+	return m.config.ReadOnly
+}
+
+// FlushIndex saves the index and a checkpoint while the store stays open, so reopening
+// after a crash loads the index and only replays the records written since.
+// The current data file is synced first so no indexed record is lost in a crash,
+// reads and writes wait while the index is saved. Stores keeping versions don't use the index file.
+func (m *MKV) FlushIndex() error {
+	if m.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if m.versions != nil || m.config.InMemory {
+		return nil
+	}
+	m.flushMutex.Lock()
+	defer m.flushMutex.Unlock()
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if err := m.mayCreateNewDataFile(); err != nil {
+	if err := m.cur.Sync(); err != nil {
 		return err
 	}
-	record := NewRecordWithoutChecksum(NormalFlag, key, value)
-	offset, size, err := m.cur.AppendRecord(record)
-	if err != nil {
+	if err := SaveIndex(m.index, m.config.RootDirectory, m.config.fileMode()); err != nil {
+		return err
+	}
+	if err := m.saveRefs(); err != nil {
 		return err
 	}
+	m.meta.Checkpoint = m.checkpoint()
+	return SaveMeta(m.meta, m.config.RootDirectory, m.config.fileMode())
+}
+
+// checkpoint returns the current position of the store
+func (m *MKV) checkpoint() *Checkpoint {
+	return &Checkpoint{FileID: m.cur.ID(), Offset: m.cur.Size(), Seq: m.seq}
+}
+
+// PutIfAbsent writes value only if key doesn't exist, it reports whether value was written
+func (m *MKV) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	return m.PutIfAbsentCtx(context.Background(), key, value, 0)
+}
+
+// Append appends suffix to the value of key atomically, a missing key is created
+func (m *MKV) Append(key []byte, suffix []byte) error {
+	return m.AppendCtx(context.Background(), key, suffix)
+}
+
+// Increment adds delta to the counter stored under key as a big endian int64 and returns
+// the new value, a missing key counts from 0. Other values fail with ErrNotCounter.
+func (m *MKV) Increment(key []byte, delta int64) (int64, error) {
+	var counter int64
+	err := m.update(context.Background(), key, func(value []byte, found bool) ([]byte, error) {
+		if found && len(value) != 8 {
+			return nil, ErrNotCounter
+		}
+		if found {
+			counter = int64(binary.BigEndian.Uint64(value))
+		}
+		counter += delta
+		updated := make([]byte, 8)
+		binary.BigEndian.PutUint64(updated, uint64(counter))
+		return updated, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// PutWithFlag works like Put and tags the record with userFlag, which is up to
+// MaxUserFlag and is returned by GetWithInfo
+func (m *MKV) PutWithFlag(key []byte, value []byte, userFlag byte) error {
+	_, err := m.PutNCtxWithFlag(context.Background(), key, value, userFlag)
+	return err
+}
+
+// put appends key and value with flag as the write with sequence number seq
+func (m *MKV) put(key []byte, value []byte, flag byte, seq uint64) (int64, error) {
+	if m.config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	// merge copies encrypted values as they are
+	if m.aead != nil && !isEncrypted(flag) {
+		var err error
+		if value, err = m.encrypt(key, value); err != nil {
+			return 0, err
+		}
+		flag |= 1 << bitEncrypted
+	}
+	if isEncrypted(flag) {
+		if err := m.markEncrypted(); err != nil {
+			return 0, err
+		}
+	}
+	data := EncodeRecordWithChecksum(newRecord(flag, key, value, m.config.CompactRecords))
+	if err := m.mayCreateNewDataFile(int64(len(data))); err != nil {
+		return 0, err
+	}
+	offset, size, err := m.cur.Append(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.verifyWrite(data, offset); err != nil {
+		return 0, err
+	}
 	if m.config.SyncWrite {
 		if err := m.cur.Sync(); err != nil {
-			return err
+			return 0, m.rollback(offset, err)
 		}
 	}
 	entry := &Entry{
-		ID:     uint64(m.cur.ID()),
-		Offset: uint64(offset),
-		Size:   uint64(size),
+		ID:      uint64(m.cur.ID()),
+		Offset:  uint64(offset),
+		Size:    uint64(size),
+		Seq:     seq,
+		ModTime: time.Now().UnixNano(),
 	}
 	old, ok := m.index[string(key)]
 	if ok {
-		m.meta.ReusableSpace += int64(old.Size)
+		m.meta.ReusableSpace += m.versions.retire(string(key), old)
 	}
 	m.index[string(key)] = entry
+	delete(m.deletes, string(key))
+	// merge puts writes with their original, unordered sequence numbers
+	if seq > m.seq {
+		m.seq = seq
+	}
+	m.written(size)
+	return size, nil
+}
+
+// rollback discards the record appended at offset after the write failed,
+// so the current data file never holds a record which isn't indexed
+func (m *MKV) rollback(offset int64, err error) error {
+	if terr := m.cur.Truncate(offset); terr != nil {
+		return errors.Wrapf(err, "rollback error: %s", terr.Error())
+	}
+	return err
+}
+
+// verifyWrite reads back the record data appended at offset if VerifyWrites is set,
+// a record which reads back differently is rolled back
+func (m *MKV) verifyWrite(data []byte, offset int64) error {
+	if !m.config.VerifyWrites {
+		return nil
+	}
+	if err := m.cur.verify(data, offset); err != nil {
+		if err == ErrWriteVerify {
+			m.config.logger().Warnf("record of %d bytes at offset %d of data file %d reads back differently", len(data), offset, m.cur.ID())
+		}
+		return m.rollback(offset, err)
+	}
 	return nil
 }
 
 func (m *MKV) PutData(data []byte, key string) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if m.tooLarge(int64(valueSize(data))) {
+		return ErrValueTooLarge
+	}
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if err := m.mayCreateNewDataFile(); err != nil {
+	if err := m.putData(data, key, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.unlockAndNotify([]byte(key), DecodeRecord(data).Value(), false)
+	return nil
+}
+
+func (m *MKV) putData(data []byte, key string, seq uint64) error {
+	if m.config.ReadOnly {
+		return ErrReadOnly
+	}
+	// encoded records are encrypted like the values of other writes
+	record := DecodeRecord(data)
+	if m.aead != nil && !isEncrypted(record.flag) {
+		_, err := m.put([]byte(key), record.Value(), record.flag, seq)
+		return err
+	}
+	if isEncrypted(record.flag) {
+		if err := m.markEncrypted(); err != nil {
+			return err
+		}
+	}
+	if err := m.mayCreateNewDataFile(int64(len(data))); err != nil {
 		return err
 	}
 	offset, size, err := m.cur.Append(data)
 	if err != nil {
 		return err
 	}
+	if err := m.verifyWrite(data, offset); err != nil {
+		return err
+	}
 	if m.config.SyncWrite {
 		if err := m.cur.Sync(); err != nil {
-			return err
+			return m.rollback(offset, err)
 		}
 	}
 	entry := &Entry{
-		ID:     uint64(m.cur.ID()),
-		Offset: uint64(offset),
-		Size:   uint64(size),
+		ID:      uint64(m.cur.ID()),
+		Offset:  uint64(offset),
+		Size:    uint64(size),
+		Seq:     seq,
+		ModTime: time.Now().UnixNano(),
 	}
 	old, ok := m.index[key]
 	if ok {
-		m.meta.ReusableSpace += int64(old.Size)
+		m.meta.ReusableSpace += m.versions.retire(key, old)
 	}
 	m.index[key] = entry
+	delete(m.deletes, key)
+	m.seq = seq
+	m.written(size)
 	return nil
 }
 
 func (m *MKV) Get(key []byte) ([]byte, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+	return m.GetCtx(context.Background(), key)
+}
+
+func (m *MKV) get(key []byte) ([]byte, *Entry, error) {
+	record, entry, err := m.getRecord(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record.Value(), entry, nil
+}
+
+func (m *MKV) getRecord(key []byte) (*Record, *Entry, error) {
 	entry, ok := m.index[string(key)]
 	if !ok {
-		return nil, ErrKeyNotFound
-	}
-	id := int(entry.ID)
-	offset := int64(entry.Offset)
-	size := int64(entry.Size)
-	var df *DataFile
-	if id == m.cur.ID() {
-		df = m.cur
-	} else {
-		df = m.dataFiles[id]
+		return nil, nil, ErrKeyNotFound
 	}
-	record, err := df.ReadEntireRecordAt(offset, size)
+	record, err := m.readRecord(entry)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return record.Value(), err
+	return record, entry, nil
 }
 
-func (m *MKV) Delete(key []byte) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if err := m.mayCreateNewDataFile(); err != nil {
-		return err
-	}
-	record := NewRecordWithoutChecksum(NormalFlag, key, []byte{})
-	record.SetDeleted()
-	if _, _, err := m.cur.AppendRecord(record); err != nil {
-		return err
-	}
-	old, ok := m.index[string(key)]
-	if ok {
-		m.meta.ReusableSpace += int64(old.Size)
+// readRecord reads the record of entry with its value decrypted
+func (m *MKV) readRecord(entry *Entry) (*Record, error) {
+	record, err := m.readRawRecord(entry)
+	if err != nil {
+		return nil, err
 	}
-	delete(m.index, string(key))
-	return nil
+	return m.decrypt(record)
+}
+
+// readRawRecord reads the record of entry as it is stored
+func (m *MKV) readRawRecord(entry *Entry) (*Record, error) {
+	df := m.getDataFile(int(entry.ID))
+	return df.ReadEntireRecordAt(int64(entry.Offset), int64(entry.Size))
+}
+
+// GetVersion returns the nth version of key, 0 is the current value and 1 the
+// value it overwrote, older versions are only kept if Config.MaxVersions is set
+func (m *MKV) GetVersion(key []byte, n int) ([]byte, error) {
+	value, _, err := m.GetVersionWithInfo(key, n)
+	return value, err
+}
+
+// GetVersionWithInfo works like GetVersion and also describes the version like GetWithInfo
+func (m *MKV) GetVersionWithInfo(key []byte, n int) ([]byte, *ObjectInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if n == 0 {
+		record, entry, err := m.getRecord(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return record.Value(), objectInfo(record, entry), nil
+	}
+	if _, ok := m.index[string(key)]; !ok {
+		return nil, nil, ErrKeyNotFound
+	}
+	entry, ok := m.versions.get(string(key), n)
+	if !ok {
+		return nil, nil, ErrKeyNotFound
+	}
+	record, err := m.readRecord(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record.Value(), objectInfo(record, entry), nil
+}
+
+// getDataFile returns the data file with id, there is no current data file in read only mode
+func (m *MKV) getDataFile(id int) *DataFile {
+	if m.cur != nil && id == m.cur.ID() {
+		return m.cur
+	}
+	return m.dataFiles[id]
+}
+
+// Copy writes the value and user flag of src to dst, it returns ErrKeyNotFound if src doesn't exist
+func (m *MKV) Copy(src []byte, dst []byte) error {
+	return m.CopyCtx(context.Background(), src, dst)
+}
+
+// Move renames src to dst, the copy and the delete of src are applied together
+func (m *MKV) Move(src []byte, dst []byte) error {
+	return m.MoveCtx(context.Background(), src, dst)
+}
+
+func (m *MKV) Delete(key []byte) error {
+	return m.DeleteCtx(context.Background(), key)
+}
+
+// DeletePrefix deletes all keys starting with prefix at once and returns how many
+func (m *MKV) DeletePrefix(prefix []byte) (int, error) {
+	return m.DeletePrefixCtx(context.Background(), prefix, nil)
+}
+
+func (m *MKV) delete(key []byte, seq uint64) error {
+	if m.config.ReadOnly {
+		return ErrReadOnly
+	}
+	record := newRecord(NormalFlag, key, []byte{}, m.config.CompactRecords)
+	record.SetDeleted()
+	data := EncodeRecordWithChecksum(record)
+	if err := m.mayCreateNewDataFile(int64(len(data))); err != nil {
+		return err
+	}
+	offset, _, err := m.cur.Append(data)
+	if err != nil {
+		return err
+	}
+	// a tombstone lost to corruption brings the deleted value back
+	if err := m.verifyWrite(data, offset); err != nil {
+		return err
+	}
+	if m.config.SyncWrite {
+		if err := m.cur.Sync(); err != nil {
+			return m.rollback(offset, err)
+		}
+	}
+	old, ok := m.index[string(key)]
+	if ok {
+		m.meta.ReusableSpace += int64(old.Size)
+	}
+	m.meta.ReusableSpace += m.versions.drop(string(key))
+	delete(m.index, string(key))
+	if m.deletes != nil {
+		m.deletes[string(key)] = tombstone{id: m.cur.ID(), seq: seq}
+	}
+	m.seq = seq
+	m.written(int64(len(data)))
+	return nil
 }
 
 func (m *MKV) Walk(f func(key string, entry *Entry) error) error {
@@ -422,23 +1084,98 @@ func (m *MKV) Walk(f func(key string, entry *Entry) error) error {
 	return nil
 }
 
+// Scan calls f for every key starting with prefix in key order, f is called with the
+// read lock held, so it must not write to the store
+func (m *MKV) Scan(prefix string, f func(key string, entry *Entry) error) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var keys []string
+	for key := range m.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := f(key, m.index[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanFrom calls f in key order for every key starting with prefix which sorts after
+// start until f returns ErrStopScan. Keys are sorted as they are visited, so a scan
+// stopped early doesn't sort all of them. f is called with the read lock held.
+func (m *MKV) ScanFrom(prefix string, start string, f func(key string, entry *Entry) error) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var keys keyHeap
+	for key := range m.index {
+		if key > start && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	heap.Init(&keys)
+	for keys.Len() > 0 {
+		key := heap.Pop(&keys).(string)
+		if err := f(key, m.index[key]); err == ErrStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyHeap pops keys in order
+type keyHeap []string
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
 func (m *MKV) mayNeedMerge() {
+	m.updateMergePolicy()
+	if m.needsMerge() {
+		if err := m.Merge(); err != nil && err != ErrMergeInProgress && err != ErrMergeAborted {
+			m.config.logger().Warnf("auto merge error: %s", err)
+		}
+	}
+}
+
+// needsMerge reports whether the reusable space reached the merge thresholds
+func (m *MKV) needsMerge() bool {
+	ratio, space := m.mergeThresholds()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	size := m.cur.Size()
 	for _, df := range m.dataFiles {
 		size += df.Size()
 	}
-	if m.meta.ReusableSpace >= m.config.MergeSpaceThreshold && float64(m.meta.ReusableSpace)/float64(size) >= m.config.MergeRatioThreshold && !m.isMerging {
-		m.Merge()
-	}
+	return m.meta.ReusableSpace >= space && float64(m.meta.ReusableSpace)/float64(size) >= ratio && !m.isMerging
 }
 
+// closeCurrent makes the current data file immutable, it is synced regardless
+// of SyncWrite so no tail records are lost once it is rotated
 func (m *MKV) closeCurrent() error {
+	if err := m.cur.Sync(); err != nil {
+		return err
+	}
 	err := m.cur.Close()
 	if err != nil {
 		return err
 	}
 	id := m.cur.ID()
-	df, err := NewDataFile(m.config.RootDirectory, id, true)
+	df, err := NewDataFile(m.config.RootDirectory, id, true, dataFileOptions(m.config)...)
 	if err != nil {
 		return err
 	}
@@ -447,179 +1184,725 @@ func (m *MKV) closeCurrent() error {
 }
 
 func (m *MKV) openNewDataFile() error {
-	cur, err := NewDataFile(m.config.RootDirectory, m.cur.ID()+1, false)
+	cur, err := NewDataFile(m.config.RootDirectory, m.cur.ID()+1, false, dataFileOptions(m.config)...)
 	if err != nil {
 		return err
 	}
 	m.cur = cur
+	// make the new file entry durable, a new shard directory is an entry of the root
+	dir := dataFileDir(m.config.RootDirectory, cur.ID(), m.config.ShardSize)
+	if dir != m.config.RootDirectory {
+		if err := fsyncDir(m.fileSystem(), dir); err != nil {
+			return err
+		}
+	}
+	return fsyncDir(m.fileSystem(), m.config.RootDirectory)
+}
+
+// syncDataFileDirs syncs the directories holding the data files ids
+func (m *MKV) syncDataFileDirs(ids []int) error {
+	synced := make(map[string]bool)
+	for _, id := range ids {
+		dir := dataFileDir(m.config.RootDirectory, id, m.config.ShardSize)
+		if synced[dir] {
+			continue
+		}
+		if err := fsyncDir(m.fileSystem(), dir); err != nil {
+			return err
+		}
+		synced[dir] = true
+	}
 	return nil
 }
 
+func (m *MKV) fileSystem() FileSystem {
+	if m.config.FileSystem != nil {
+		return m.config.FileSystem
+	}
+	return osFileSystem{}
+}
+
+// DataFileInfo describes a data file of the store
+type DataFileInfo struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Garbage is the size of the records in the file which are neither the current
+	// value nor a kept version of a key, a merge of the file reclaims it
+	Garbage int64 `json:"garbage"`
+	Active  bool  `json:"active"`
+}
+
+// DataFiles describes all data files ordered by id, the active file is the one written to
+func (m *MKV) DataFiles() []DataFileInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	garbage := m.garbage()
+	infos := make([]DataFileInfo, 0, len(m.dataFiles)+1)
+	for _, df := range m.dataFiles {
+		infos = append(infos, DataFileInfo{ID: df.ID(), Path: df.Name(), Size: df.Size(), Garbage: garbage[df.ID()]})
+	}
+	if m.cur != nil {
+		infos = append(infos, DataFileInfo{ID: m.cur.ID(), Path: m.cur.Name(), Size: m.cur.Size(), Garbage: garbage[m.cur.ID()], Active: true})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// garbage returns the size of the records in each data file which are neither the
+// current value nor a kept version of a key, by file id. It reads the index only, it
+// must be called with the lock held.
+func (m *MKV) garbage() map[int]int64 {
+	garbage := make(map[int]int64, len(m.dataFiles)+1)
+	for id, df := range m.dataFiles {
+		garbage[id] = df.Size()
+	}
+	if m.cur != nil {
+		garbage[m.cur.ID()] = m.cur.Size()
+	}
+	for _, entry := range m.index {
+		garbage[int(entry.ID)] -= int64(entry.Size)
+	}
+	if m.versions != nil {
+		for _, entries := range m.versions.entries {
+			for _, entry := range entries {
+				garbage[int(entry.ID)] -= int64(entry.Size)
+			}
+		}
+	}
+	return garbage
+}
+
+// MergeEstimate reports the space a merge would reclaim, the garbage of the data files
+// it would process, and the number of these files, without doing any I/O
+func (m *MKV) MergeEstimate() (reclaimable int64, filesToMerge int) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ids := make([]int, 0, len(m.dataFiles)+1)
+	for id := range m.dataFiles {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if (m.config.MergeMaxFiles <= 0 || len(ids) == 0) && m.cur != nil {
+		// the current file is rotated and merged as well
+		ids = append(ids, m.cur.ID())
+	}
+	if m.config.MergeMaxFiles > 0 && len(ids) > m.config.MergeMaxFiles {
+		ids = ids[:m.config.MergeMaxFiles]
+	}
+	garbage := m.garbage()
+	for _, id := range ids {
+		reclaimable += garbage[id]
+	}
+	return reclaimable, len(ids)
+}
+
 func (m *MKV) Merge() error {
+	return m.merge(context.Background(), false, false, nil)
+}
+
+// MergeCtx works like Merge and stops once ctx is done, returning its error. The live
+// store is only changed when the merged files are swapped in, so a stopped merge
+// leaves it as it was.
+func (m *MKV) MergeCtx(ctx context.Context) error {
+	return m.merge(ctx, false, false, nil)
+}
+
+// MergeProgress describes how far a merge got, bytes are the sizes of the
+// live records copied, the total is estimated from the index when the merge
+// starts. Records are copied by key, so files are only done at the end.
+type MergeProgress struct {
+	BytesDone  int64 `json:"bytes_done"`
+	BytesTotal int64 `json:"bytes_total"`
+	FilesDone  int   `json:"files_done"`
+	FilesTotal int   `json:"files_total"`
+	// Reclaimed is set once the merged files are swapped in, to the size of the merged
+	// files less the size of the files replacing them
+	Reclaimed int64 `json:"reclaimed,omitempty"`
+}
+
+// MergeWithProgress works like Merge and calls progress after every copied key
+// and once more when the merged files are swapped in. progress is called from
+// the merging goroutine without the store lock held, it must not block for long.
+func (m *MKV) MergeWithProgress(progress func(MergeProgress)) error {
+	return m.merge(context.Background(), false, false, progress)
+}
+
+// CompactSorted works like Merge, but rewrites live data in sorted key order,
+// so values of adjacent keys become physically adjacent
+func (m *MKV) CompactSorted() error {
+	return m.merge(context.Background(), true, false, nil)
+}
+
+// Migrate rewrites all records in the layout of format version target and records it
+// in the meta. Every store reads as version 1, so there is nothing to rewrite for it.
+// Version formatEncrypted encrypts all records with EncryptionKey, those written before
+// the key was set included, a store with encrypted records may still hold plain ones, so
+// it is rewritten whatever its version. The records are rewritten by a merge of all data
+// files, which is swapped in through the merge journal, so after a crash the store opens
+// with either the old or the merged files and Migrate can be run again. MergeFilter
+// applies as to any merge.
+func (m *MKV) Migrate(target int) error {
+	if target < 1 || target > FormatVersion {
+		return errors.Wrapf(ErrUnsupportedFormat, "can't migrate to format version %d", target)
+	}
+	if target >= formatEncrypted && m.aead == nil {
+		return errors.Errorf("format version %d encrypts records, it needs an encryption key", target)
+	}
+	m.mutex.RLock()
+	current := m.meta.FormatVersion
+	m.mutex.RUnlock()
+	if current >= target && target < formatEncrypted {
+		return nil
+	}
+	if err := m.merge(context.Background(), false, true, nil); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.meta.FormatVersion >= target {
+		return nil
+	}
+	m.meta.FormatVersion = target
+	if m.config.InMemory {
+		return nil
+	}
+	return SaveMeta(m.meta, m.config.RootDirectory, m.config.fileMode())
+}
+
+// merge rewrites the live records of the oldest MergeMaxFiles data files, of all files
+// if all is set, in key order if sorted is set
+func (m *MKV) merge(ctx context.Context, sorted bool, all bool, progress func(MergeProgress)) error {
+	if m.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m.mutex.Lock()
 	if m.isMerging {
 		m.mutex.Unlock()
-		return nil
+		return ErrMergeInProgress
+	}
+	if m.mergeAborted() {
+		m.mutex.Unlock()
+		return ErrMergeAborted
 	}
 	m.isMerging = true
-	m.mutex.Unlock()
+	m.mergeDone = make(chan struct{})
 	defer func() {
+		m.mutex.Lock()
 		m.isMerging = false
+		close(m.mergeDone)
+		m.mergeDone = nil
+		m.mutex.Unlock()
 	}()
-	m.mutex.RLock()
-	err := m.closeCurrent()
+	filesToMerge, err := m.selectFilesToMerge(all)
 	if err != nil {
-		m.mutex.RUnlock()
+		m.mutex.Unlock()
 		return err
 	}
-	filesToMerge := make([]int, 0, len(m.dataFiles))
-	for k := range m.dataFiles {
-		filesToMerge = append(filesToMerge, k)
+	// the merged files are the oldest ones, so every file up to last is merged
+	last := filesToMerge[len(filesToMerge)-1]
+	p := MergeProgress{FilesTotal: len(filesToMerge)}
+	keys := make([]string, 0, len(m.index))
+	for key, entry := range m.index {
+		// older versions are merged even if the current one is newer
+		older := m.versions.list(key)
+		if int(entry.ID) > last && (len(older) == 0 || int(older[len(older)-1].ID) > last) {
+			continue
+		}
+		keys = append(keys, key)
+		for _, e := range append([]*Entry{entry}, older...) {
+			if int(e.ID) <= last {
+				p.BytesTotal += int64(e.Size)
+			}
+		}
 	}
-	err = m.openNewDataFile()
-	if err != nil {
-		m.mutex.RUnlock()
-		return err
+	m.mutex.Unlock()
+	if sorted {
+		sort.Strings(keys)
 	}
-	m.mutex.RUnlock()
-	sort.Ints(filesToMerge)
+	start := time.Now()
+	m.config.logger().Infof("merging %d data files, %d keys", len(filesToMerge), len(keys))
 
-	tmpDir, err := ioutil.TempDir(m.config.RootDirectory, "merge")
-	if err != nil {
-		return err
+	// merges don't overlap, so the directory of an in memory merge needs no unique name
+	tmpDir := filepath.Join(m.config.RootDirectory, "merge")
+	if !m.config.InMemory {
+		var err error
+		if tmpDir, err = ioutil.TempDir(m.config.RootDirectory, "merge"); err != nil {
+			return err
+		}
 	}
-	defer os.RemoveAll(tmpDir)
+	defer removeAll(m.fileSystem(), tmpDir)
 
 	// Create a merged database
 	config := DefaultConfig()
 	config.RootDirectory = tmpDir
+	config.DataFileMaxSize = m.config.DataFileMaxSize
+	config.MaxVersions = m.config.MaxVersions
+	config.ShardSize = m.config.ShardSize
+	config.CompactRecords = m.config.CompactRecords
+	config.FileMode = m.config.FileMode
+	config.DirMode = m.config.DirMode
+	config.Logger = m.config.Logger
+	config.EncryptionKey = m.config.EncryptionKey
+	config.WriteBufferSize = writeBufferSize
+	if m.config.InMemory {
+		config.InMemory = true
+		config.FileSystem = m.config.FileSystem
+	}
 	tmpDB, err := Open(config)
 	if err != nil {
 		return err
 	}
-	for key, entry := range m.index {
-		if int(entry.ID) > filesToMerge[len(filesToMerge)-1] {
-			continue
+	throttle := newThrottle(m.config.MaxMergeMBPerSec)
+	var dropped [][]byte
+	for _, key := range keys {
+		// the merged store is discarded, so the merge can stop between any two keys
+		if m.mergeAborted() {
+			tmpDB.Close()
+			return ErrMergeAborted
 		}
-		value, err := m.Get([]byte(key))
-		if err != nil {
+		if err := ctx.Err(); err != nil {
+			tmpDB.Close()
 			return err
 		}
-		err = tmpDB.Put([]byte(key), value)
+		m.mutex.RLock()
+		records, entries, err := m.mergeRecords(key, last)
+		// keys are filtered as they are copied, so dropped keys never get into the merged
+		// files. Content addressed values go with their last link, never by the filter.
+		drop := err == nil && m.config.MergeFilter != nil && !IsContentHash(key) && !m.config.MergeFilter([]byte(key))
+		m.mutex.RUnlock()
 		if err != nil {
+			tmpDB.Close()
 			return err
 		}
+		if drop {
+			dropped = append(dropped, []byte(key))
+			for _, entry := range entries {
+				p.BytesTotal -= int64(entry.Size)
+			}
+			continue
+		}
+		for i, record := range records {
+			// keep the sequence number of the merged write
+			size, err := tmpDB.put([]byte(key), record.Value(), record.flag, entries[i].Seq)
+			if err != nil {
+				tmpDB.Close()
+				return err
+			}
+			throttle.wait(size)
+			p.BytesDone += size
+		}
+		if progress != nil {
+			progress(p)
+		}
 	}
 	if err = tmpDB.Close(); err != nil {
 		return err
 	}
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if err := m.close(); err != nil {
+	// the merged store holds encrypted records if there is a key
+	if m.aead != nil {
+		if err := m.markEncrypted(); err != nil {
+			m.mutex.Unlock()
+			return err
+		}
+	}
+	// dropped links are read to release their values, so they go before their files do
+	deletes, err := m.dropFiltered(dropped, last)
+	if err != nil {
+		m.unlockAndNotifyWrites(deletes...)
+		return err
+	}
+	reclaimed, err := m.swapMerged(tmpDB, filesToMerge)
+	m.unlockAndNotifyWrites(deletes...)
+	if err != nil {
 		return err
 	}
+	m.config.logger().Infof("merged %d data files in %s, %d bytes copied, %d keys dropped", len(filesToMerge), time.Since(start), p.BytesDone, len(deletes))
+	if progress != nil {
+		p.FilesDone = p.FilesTotal
+		p.Reclaimed = reclaimed
+		progress(p)
+	}
+	return nil
+}
 
-	// Remove data files
-	for _, file := range m.dataFiles {
-		if file.ID() > filesToMerge[len(filesToMerge)-1] {
-			continue
+// selectFilesToMerge returns the ids of the oldest immutable data files, at most
+// MergeMaxFiles of them unless all is set. The current data file is rotated if all
+// files are to be merged or there is no immutable file.
+func (m *MKV) selectFilesToMerge(all bool) ([]int, error) {
+	all = all || m.config.MergeMaxFiles <= 0
+	if all || len(m.dataFiles) == 0 {
+		if err := m.closeCurrent(); err != nil {
+			return nil, err
 		}
-		err = os.Remove(file.Name())
-		if err != nil {
-			return err
+		if err := m.openNewDataFile(); err != nil {
+			return nil, err
 		}
 	}
+	ids := make([]int, 0, len(m.dataFiles))
+	for id := range m.dataFiles {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if !all && len(ids) > m.config.MergeMaxFiles {
+		ids = ids[:m.config.MergeMaxFiles]
+	}
+	return ids, nil
+}
 
-	// Rename all merged data files
-	files, err := ioutil.ReadDir(tmpDB.config.RootDirectory)
+// swapMerged replaces the merged data files by the ones of tmpDB and points the
+// entries of merged records to their new location. The merged files keep their
+// ids, which are lower than the ids of all remaining files, so the order of data
+// files is still the order of writes. It returns the space freed, the size of the merged
+// files less the size of the files replacing them. It must be called with the lock held.
+func (m *MKV) swapMerged(tmpDB *MKV, filesToMerge []int) (int64, error) {
+	last := filesToMerge[len(filesToMerge)-1]
+	merged, err := listFiles(m.fileSystem(), tmpDB.config.RootDirectory, ".data")
 	if err != nil {
-		return err
+		return 0, err
 	}
-	for _, file := range files {
-		if file.Name() == lockFile {
+	var ids []int
+	var mergedSize int64
+	for _, name := range merged {
+		info, err := statFile(m.fileSystem(), name)
+		if err != nil {
+			return 0, err
+		}
+		if info.Size() == 0 {
 			continue
 		}
-		err := os.Rename(filepath.Join(tmpDB.config.RootDirectory, file.Name()), filepath.Join(m.config.RootDirectory, file.Name()))
+		id, err := ParseID(name)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		ids = append(ids, id)
+		mergedSize += info.Size()
+	}
+	if len(ids) > 0 && ids[len(ids)-1] > last {
+		return 0, errors.Errorf("merged data needs %d files, only ids up to %d are free", len(ids), last)
+	}
+	// the index file refers to the files about to be replaced, the journal lets the
+	// next open finish the swap after a crash
+	m.meta.Checkpoint = nil
+	journal := &mergeJournal{Dir: filepath.Base(tmpDB.config.RootDirectory), Merged: filesToMerge, IDs: ids}
+	if !m.config.InMemory {
+		if err := SaveMeta(m.meta, m.config.RootDirectory, m.config.fileMode()); err != nil {
+			return 0, err
+		}
+		if err := saveMergeJournal(m.fileSystem(), m.config.RootDirectory, journal, m.config.fileMode()); err != nil {
+			return 0, err
 		}
 	}
-	m.meta.ReusableSpace = 0
-	m.meta.IndexUpToDate = true
-	return m.reload()
-}
 
-func (m *MKV) reload() error {
-	files, err := LoadDataFiles(m.config.RootDirectory)
-	if err != nil {
-		return err
+	var size int64
+	for _, id := range filesToMerge {
+		df := m.dataFiles[id]
+		size += df.Size()
+		if err := df.Close(); err != nil {
+			return 0, err
+		}
+		delete(m.dataFiles, id)
 	}
-	var cur *DataFile
-	dataFiles := make(map[int]*DataFile)
-	index := make(map[string]*Entry)
-	// load data files
-	if len(files) == 0 {
-		cur, err = NewDataFile(m.config.RootDirectory, 0, false)
+	// the shard directories of merged ids exist already
+	if err := replaceMerged(m.fileSystem(), m.config.RootDirectory, m.config.ShardSize, journal); err != nil {
+		return 0, err
+	}
+	if err := m.syncDataFileDirs(append(append([]int{}, filesToMerge...), ids...)); err != nil {
+		return 0, err
+	}
+	if !m.config.InMemory {
+		if err := removeMergeJournal(m.fileSystem(), m.config.RootDirectory); err != nil {
+			return 0, err
+		}
+	}
+	for _, id := range ids {
+		df, err := NewDataFile(m.config.RootDirectory, id, true, dataFileOptions(m.config)...)
 		if err != nil {
-			return err
+			return 0, err
 		}
-	} else {
-		cur = files[len(files)-1]
-		for i, file := range files {
-			if i == len(files)-1 {
+		m.dataFiles[id] = df
+	}
+
+	// Writes during the merge only went to newer files, so every entry left in
+	// a merged file has been merged with its sequence number
+	for key, current := range tmpDB.index {
+		locations := map[uint64]*Entry{current.Seq: current}
+		for _, entry := range tmpDB.versions.list(key) {
+			locations[entry.Seq] = entry
+		}
+		var entries []*Entry
+		if entry, ok := m.index[key]; ok {
+			entries = append(entries, entry)
+		}
+		entries = append(entries, m.versions.list(key)...)
+		for _, entry := range entries {
+			location, ok := locations[entry.Seq]
+			if !ok || int(entry.ID) > last {
 				continue
 			}
-			dataFiles[file.ID()] = file
+			entry.ID = location.ID
+			entry.Offset = location.Offset
+			entry.Size = location.Size
+		}
+	}
+	m.pruneDeletes(last)
+	m.merges++
+	m.meta.ReusableSpace -= size - mergedSize
+	if m.meta.ReusableSpace < 0 {
+		m.meta.ReusableSpace = 0
+	}
+	return size - mergedSize, nil
+}
+
+// dropFiltered deletes the keys MergeFilter dropped before the merged files are swapped
+// in, their records in merged files are gone. Keys written again during the merge are
+// kept, only their older versions in merged files are forgotten. Dropped links release
+// their values like Unlink. It must be called with the lock held.
+func (m *MKV) dropFiltered(keys [][]byte, last int) ([]write, error) {
+	var gone [][]byte
+	for _, key := range keys {
+		entry, ok := m.index[string(key)]
+		if !ok {
+			continue
 		}
-		index, err = LoadIndex(m.config.RootDirectory)
+		if int(entry.ID) > last {
+			m.versions.dropUpTo(string(key), last)
+			continue
+		}
+		gone = append(gone, key)
+	}
+	return m.deleteKeys(gone)
+}
+
+// mergeRecords reads the versions of key in data files up to last, oldest first,
+// versions beyond MaxVersions are already pruned so they are dropped by merge
+func (m *MKV) mergeRecords(key string, last int) ([]*Record, []*Entry, error) {
+	current, ok := m.index[key]
+	if !ok {
+		return nil, nil, nil
+	}
+	older := m.versions.list(key)
+	entries := make([]*Entry, 0, len(older)+1)
+	for i := len(older) - 1; i >= 0; i-- {
+		entries = append(entries, older[i])
+	}
+	entries = append(entries, current)
+	var records []*Record
+	var merged []*Entry
+	for _, entry := range entries {
+		if int(entry.ID) > last {
+			continue
+		}
+		// encrypted values are merged without the key
+		record, err := m.readRawRecord(entry)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		records = append(records, record)
+		merged = append(merged, entry)
 	}
-	m.cur = cur
-	m.dataFiles = dataFiles
-	m.index = index
-	return nil
+	return records, merged, nil
 }
 
 func (m *MKV) runBackGround() {
-	var once sync.Once
+	defer close(m.backgroundDone)
+	var merges, flushes <-chan time.Time
+	if m.ticker != nil {
+		merges = m.ticker.C
+	}
+	if m.flushTicker != nil {
+		flushes = m.flushTicker.C
+	}
 	for {
 		select {
-		case <-m.ticker.C:
-			once.Do(func() {
-				fmt.Println("merging")
-				m.mayNeedMerge()
-			})
+		case <-flushes:
+			// a failed flush leaves the last checkpoint, the next one retries
+			if err := m.FlushIndex(); err != nil {
+				m.config.logger().Warnf("flush index error: %s", err)
+			}
+		case now := <-merges:
+			if !inWindow(now, m.config.MergeWindowStart, m.config.MergeWindowEnd) {
+				continue
+			}
+			m.mayNeedMerge()
 		case <-m.closeChan:
 			return
 		}
 	}
 }
 
+// stopBackground stops runBackGround and waits for it to return, it must be
+// called without holding the mutex as a running merge needs it
+func (m *MKV) stopBackground() {
+	if m.closeChan == nil {
+		return
+	}
+	if m.ticker != nil {
+		m.ticker.Stop()
+	}
+	if m.flushTicker != nil {
+		m.flushTicker.Stop()
+	}
+	close(m.closeChan)
+	<-m.backgroundDone
+}
+
+// Truncate removes all keys and data files while the store stays open and locked, it
+// emits no change events. Sequence numbers continue where they were, so they are never
+// reused. Readers of removed values get ErrValueGone.
+func (m *MKV) Truncate() error {
+	if m.config.ReadOnly {
+		return ErrReadOnly
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.isMerging {
+		return ErrMergeInProgress
+	}
+	dir := m.config.RootDirectory
+	m.refs = make(map[string]int64)
+	m.meta = &Meta{Seq: m.seq}
+	setFormat(m.meta)
+	if !m.config.InMemory {
+		// the index and refs files must not outlive the data files they refer to
+		if err := os.Remove(filepath.Join(dir, indexFileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := m.saveRefs(); err != nil {
+			return err
+		}
+		if err := SaveMeta(m.meta, dir, m.config.fileMode()); err != nil {
+			return err
+		}
+	}
+	for id, df := range m.dataFiles {
+		if err := df.Close(); err != nil {
+			return err
+		}
+		delete(m.dataFiles, id)
+	}
+	if err := m.cur.Close(); err != nil {
+		return err
+	}
+	for _, ext := range []string{".data", ".hint"} {
+		names, err := listFiles(m.fileSystem(), dir, ext)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := removeFile(m.fileSystem(), name); err != nil {
+				return err
+			}
+			if filepath.Dir(name) != filepath.Clean(dir) {
+				// shard directories are removed once empty
+				removeFile(m.fileSystem(), filepath.Dir(name))
+			}
+		}
+	}
+	m.index = make(map[string]*Entry)
+	m.versions = newVersions(m.config.MaxVersions)
+	m.deletes = make(map[string]tombstone)
+	m.changesFloor = m.seq
+	// readers of removed values check again where their value is
+	m.merges++
+	cur, err := NewDataFile(dir, 0, false, dataFileOptions(m.config)...)
+	if err != nil {
+		return err
+	}
+	m.cur = cur
+	if err := m.syncDataFileDirs([]int{0}); err != nil {
+		return err
+	}
+	return fsyncDir(m.fileSystem(), dir)
+}
+
+// mergeAborted reports whether merges are to stop because the store is closed
+func (m *MKV) mergeAborted() bool {
+	select {
+	case <-m.mergeAbort:
+		return true
+	default:
+		return false
+	}
+}
+
+// abortMerge makes the running merge stop at the next key and later merges fail with
+// ErrMergeAborted, it waits for the running merge to return or ctx to be done
+func (m *MKV) abortMerge(ctx context.Context) error {
+	m.mutex.Lock()
+	if !m.mergeAborted() {
+		close(m.mergeAbort)
+	}
+	done := m.mergeDone
+	m.mutex.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close aborts a running merge and closes the store, see CloseCtx
 func (m *MKV) Close() error {
+	return m.CloseCtx(context.Background())
+}
+
+// CloseCtx aborts a running merge, which leaves the store as it was before the merge,
+// and closes the store. A merge stops between two keys, ctx bounds the wait for it. If
+// ctx is done first its error is returned and the store stays open without merging, so
+// it can be closed once more.
+func (m *MKV) CloseCtx(ctx context.Context) error {
+	if err := m.abortMerge(ctx); err != nil {
+		return err
+	}
+	m.stopScrubber()
+	m.stopBackground()
+	m.stopCommitter()
+	m.stopNotify()
 	m.mutex.Lock()
+	if m.config.ReadOnly {
+		defer func() {
+			m.mutex.Unlock()
+			m.lock.Unlock()
+		}()
+		for _, df := range m.dataFiles {
+			if err := df.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	defer func() {
 		m.mutex.Unlock()
-		m.lock.Unlock()
+		// an in memory store has no lock file
+		if m.lock != nil {
+			m.lock.Unlock()
+		}
 	}()
-	if err := m.close(); err != nil {
-		return err
-	}
-	if m.config.AutoMerging {
-		m.ticker.Stop()
-		m.closeChan <- struct{}{}
-	}
-	return nil
+	// close syncs the writes left, waiters are released either way
+	err := m.close()
+	m.committed(m.seq, err)
+	return err
 }
 
 func (m *MKV) close() error {
-	if err := SaveIndex(m.index, m.config.RootDirectory); err != nil {
+	if err := m.cur.Sync(); err != nil {
 		return err
 	}
-	m.meta.IndexUpToDate = true
-	if err := SaveMeta(m.meta, m.config.RootDirectory); err != nil {
-		return err
+	if !m.config.InMemory {
+		if err := m.persist(); err != nil {
+			return err
+		}
 	}
 	for _, df := range m.dataFiles {
 		if err := df.Close(); err != nil {
@@ -628,3 +1911,18 @@ func (m *MKV) close() error {
 	}
 	return m.cur.Close()
 }
+
+// persist saves the index, the counts of links and the meta, so the store opens
+// without reading the data files
+func (m *MKV) persist() error {
+	if err := SaveIndex(m.index, m.config.RootDirectory, m.config.fileMode()); err != nil {
+		return err
+	}
+	if err := m.saveRefs(); err != nil {
+		return err
+	}
+	m.meta.IndexUpToDate = true
+	m.meta.Seq = m.seq
+	m.meta.Checkpoint = m.checkpoint()
+	return SaveMeta(m.meta, m.config.RootDirectory, m.config.fileMode())
+}
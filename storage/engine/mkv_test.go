@@ -1,12 +1,19 @@
 package engine
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -454,3 +461,1717 @@ func TestLoadIndexFromHintFiles(t *testing.T) {
 		file.Close()
 	}
 }
+
+func TestCompactSorted(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(nil)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	n := 1000
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	for round := 0; round < 3; round++ {
+		for i := n - 1; i >= 0; i-- {
+			key := []byte(fmt.Sprintf("%016d", (i*7+round)%n))
+			err := s.Put(key, value)
+			require.Nil(t, err)
+		}
+	}
+	err = s.CompactSorted()
+	require.Nil(t, err)
+
+	keys := make([]string, 0, n)
+	err = s.Walk(func(key string, entry *Entry) error {
+		keys = append(keys, key)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, n, len(keys))
+	sort.Strings(keys)
+	var last *Entry
+	for _, key := range keys {
+		actual, err := s.Get([]byte(key))
+		require.Nil(t, err)
+		require.Equal(t, value, actual)
+		entry := s.index[key]
+		if last != nil {
+			require.True(t, entry.ID > last.ID || (entry.ID == last.ID && entry.Offset > last.Offset))
+		}
+		last = entry
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	expected := []byte(fmt.Sprintf("%01024d", 123))
+	{
+		s, err := Open(nil)
+		require.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%016d", i))
+			err := s.Put(key, expected)
+			require.Nil(t, err)
+		}
+		err = s.Close()
+		require.Nil(t, err)
+	}
+
+	config.ReadOnly = true
+	s1, err := Open(config)
+	require.Nil(t, err)
+	s2, err := Open(config)
+	require.Nil(t, err)
+	for _, s := range []*MKV{s1, s2} {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("%016d", i))
+			actual, err := s.Get(key)
+			require.Nil(t, err)
+			require.Equal(t, expected, actual)
+		}
+		key := []byte(fmt.Sprintf("%016d", 0))
+		require.Equal(t, ErrReadOnly, s.Put(key, expected))
+		require.Equal(t, ErrReadOnly, s.Delete(key))
+		require.Equal(t, ErrReadOnly, s.Merge())
+	}
+	err = s1.Close()
+	require.Nil(t, err)
+	err = s2.Close()
+	require.Nil(t, err)
+}
+
+func TestReadOnlyLock(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	readOnlyConfig := DefaultConfig()
+	readOnlyConfig.ReadOnly = true
+
+	// writer excludes readers
+	w, err := Open(config)
+	require.Nil(t, err)
+	_, err = Open(readOnlyConfig)
+	require.Equal(t, ErrDirLocked, err)
+	err = w.Close()
+	require.Nil(t, err)
+
+	// readers coexist and exclude writer
+	r1, err := Open(readOnlyConfig)
+	require.Nil(t, err)
+	r2, err := Open(readOnlyConfig)
+	require.Nil(t, err)
+	_, err = Open(config)
+	require.Equal(t, ErrDirLocked, err)
+	err = r1.Close()
+	require.Nil(t, err)
+	_, err = Open(config)
+	require.Equal(t, ErrDirLocked, err)
+	err = r2.Close()
+	require.Nil(t, err)
+
+	// writer can open after all readers are closed
+	w, err = Open(config)
+	require.Nil(t, err)
+	err = w.Close()
+	require.Nil(t, err)
+}
+
+func TestOnWrite(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	type write struct {
+		key     string
+		value   string
+		deleted bool
+	}
+	var writes []write
+	var s *MKV
+	config.OnWrite = func(key []byte, value []byte, deleted bool) {
+		// reading the store from the hook must not deadlock
+		if !deleted {
+			actual, err := s.Get(key)
+			if err == nil {
+				require.Equal(t, value, actual)
+			}
+		}
+		writes = append(writes, write{string(key), string(value), deleted})
+	}
+	s, err = Open(config)
+	require.Nil(t, err)
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%016d", i))
+		err := s.Put(key, key)
+		require.Nil(t, err)
+		err = s.Delete(key)
+		require.Nil(t, err)
+	}
+	// Close waits until all writes are handed to the hook
+	err = s.Close()
+	require.Nil(t, err)
+	require.Equal(t, 2*n, len(writes))
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%016d", i)
+		require.Equal(t, write{key, key, false}, writes[2*i])
+		require.Equal(t, write{key, "", true}, writes[2*i+1])
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+
+	events, cancel := s.Subscribe()
+	defer cancel()
+	slow, _ := s.Subscribe()
+	cancelled, cancel2 := s.Subscribe()
+	cancel2()
+	_, ok := <-cancelled
+	require.False(t, ok)
+
+	// fill the buffers of both subscribers
+	n := subscriberBufferSize
+	for i := 0; i < n/2; i++ {
+		key := []byte(fmt.Sprintf("%016d", i))
+		err := s.Put(key, key)
+		require.Nil(t, err)
+		err = s.Delete(key)
+		require.Nil(t, err)
+	}
+	var last uint64
+	for i := 0; i < n; i++ {
+		event := <-events
+		key := []byte(fmt.Sprintf("%016d", i/2))
+		require.Equal(t, key, event.Key)
+		if i%2 == 0 {
+			require.False(t, event.Deleted)
+			require.Equal(t, key, event.Value)
+		} else {
+			require.True(t, event.Deleted)
+			require.Nil(t, event.Value)
+		}
+		if last != 0 {
+			require.Equal(t, last+1, event.Seq)
+		}
+		last = event.Seq
+	}
+
+	// the subscriber which never reads is dropped once its buffer is full
+	key := []byte(fmt.Sprintf("%016d", n))
+	err = s.Put(key, key)
+	require.Nil(t, err)
+	event := <-events
+	require.Equal(t, last+1, event.Seq)
+	count := 0
+	for range slow {
+		count++
+	}
+	require.Equal(t, n, count)
+
+	err = s.Close()
+	require.Nil(t, err)
+	_, ok = <-events
+	require.False(t, ok)
+}
+
+func TestSeq(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%016d", i))
+		err := s.Put(key, value)
+		require.Nil(t, err)
+		require.Equal(t, uint64(i+1), s.index[string(key)].Seq)
+	}
+	err = s.Delete([]byte(fmt.Sprintf("%016d", 0)))
+	require.Nil(t, err)
+	// sequence numbers survive merge
+	err = s.Merge()
+	require.Nil(t, err)
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("%016d", i)
+		require.Equal(t, uint64(i+1), s.index[key].Seq)
+	}
+	err = s.Close()
+	require.Nil(t, err)
+
+	// reopen with index
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Equal(t, uint64(101), s.seq)
+	key := []byte(fmt.Sprintf("%016d", 1))
+	require.Equal(t, uint64(2), s.index[string(key)].Seq)
+	err = s.Put(key, value)
+	require.Nil(t, err)
+	require.Equal(t, uint64(102), s.index[string(key)].Seq)
+	// reopen without close replays data files since the checkpoint of close,
+	// the unsynced put is lost
+	err = s.lock.Unlock()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.True(t, s.seq >= 101)
+	last := s.seq
+	err = s.Put(key, value)
+	require.Nil(t, err)
+	require.Equal(t, last+1, s.index[string(key)].Seq)
+	_, err = s.Get([]byte(fmt.Sprintf("%016d", 0)))
+	require.Equal(t, ErrKeyNotFound, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestWriteError(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.WriteBufferSize = writeBufferSize
+	config.SyncWrite = true
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	err = s.Put([]byte("a"), value)
+	require.Nil(t, err)
+	size := s.cur.Size()
+
+	// writes to a file opened read only fail
+	file := s.cur.file
+	s.cur.file, err = os.Open(file.Name())
+	require.Nil(t, err)
+	err = s.Put([]byte("b"), value)
+	require.NotNil(t, err)
+	_, err = s.Get([]byte("b"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, size, s.cur.Size())
+
+	// buffered writes fail once the buffer has to be flushed
+	s.config.SyncWrite = false
+	large := make([]byte, writeBufferSize/2)
+	err = s.Put([]byte("c"), large)
+	require.Nil(t, err)
+	size = s.cur.Size()
+	err = s.Put([]byte("d"), large)
+	require.NotNil(t, err)
+	_, err = s.Get([]byte("d"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, size, s.cur.Size())
+	actual, err := s.Get([]byte("c"))
+	require.Nil(t, err)
+	require.Equal(t, large, actual)
+
+	err = s.cur.file.Close()
+	require.Nil(t, err)
+	s.cur.file = file
+	err = s.Close()
+	require.Nil(t, err)
+
+	// nothing but the successful writes reached the data file
+	s, err = Open(config)
+	require.Nil(t, err)
+	for key, expected := range map[string][]byte{"a": value, "c": large} {
+		actual, err := s.Get([]byte(key))
+		require.Nil(t, err)
+		require.Equal(t, expected, actual)
+	}
+	files, err := LoadDataFiles(config.RootDirectory)
+	require.Nil(t, err)
+	index := make(map[string]*Entry)
+	seq, err := loadIndexFromDataFiles(index, files, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), seq)
+	for _, file := range files {
+		file.Close()
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+// faultyFileSystem opens files which fail with ENOSPC once limit bytes have been written
+type faultyFileSystem struct {
+	limit int64
+}
+
+func (fs *faultyFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: fs}, nil
+}
+
+type faultyFile struct {
+	*os.File
+	fs *faultyFileSystem
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	if int64(len(p)) > f.fs.limit {
+		n, _ := f.File.WriteAt(p[:f.fs.limit], off)
+		f.fs.limit -= int64(n)
+		return n, syscall.ENOSPC
+	}
+	n, err := f.File.WriteAt(p, off)
+	f.fs.limit -= int64(n)
+	return n, err
+}
+
+func TestDiskFull(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.WriteBufferSize = writeBufferSize
+	fs := &faultyFileSystem{limit: 10 << 20}
+	config.FileSystem = fs
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	values := map[string][]byte{
+		"small": []byte(fmt.Sprintf("%065536d", 123)),
+		"large": make([]byte, 2*writeBufferSize),
+	}
+	for name, value := range values {
+		fs.limit = 10 << 20
+		stored := 0
+		for i := 0; ; i++ {
+			key := []byte(fmt.Sprintf("%s%016d", name, i))
+			size := s.cur.Size()
+			err := s.Put(key, value)
+			if err != nil {
+				require.Equal(t, syscall.ENOSPC, errors.Cause(err))
+				require.Equal(t, size, s.cur.Size())
+				_, err = s.Get(key)
+				require.Equal(t, ErrKeyNotFound, err)
+				break
+			}
+			stored++
+		}
+		require.True(t, stored > 0)
+	}
+	// free space and close, which flushes buffered writes
+	fs.limit = 1 << 40
+	err = s.Close()
+	require.Nil(t, err)
+
+	config.FileSystem = nil
+	s, err = Open(config)
+	require.Nil(t, err)
+	count := 0
+	err = s.Walk(func(key string, entry *Entry) error {
+		count++
+		value, _, err := s.get([]byte(key))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, values[strings.TrimRight(key, "0123456789")], value)
+		return nil
+	})
+	require.Nil(t, err)
+	require.True(t, count > 0)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+// crashFileSystem remembers how much of every file has been synced,
+// crash drops everything else like a power loss would
+type crashFileSystem struct {
+	mutex  sync.Mutex
+	synced map[string]int64
+}
+
+func (fs *crashFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.synced[name]; !ok && !info.IsDir() {
+		fs.synced[name] = info.Size()
+	}
+	return &crashFile{File: file, fs: fs}, nil
+}
+
+func (fs *crashFileSystem) crash() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for name, size := range fs.synced {
+		if err := os.Truncate(name, size); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type crashFile struct {
+	*os.File
+	fs *crashFileSystem
+}
+
+func (f *crashFile) Sync() error {
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		f.fs.mutex.Lock()
+		f.fs.synced[f.Name()] = info.Size()
+		f.fs.mutex.Unlock()
+	}
+	return f.File.Sync()
+}
+
+func TestCrashAfterRotation(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 20
+	fs := &crashFileSystem{synced: make(map[string]int64)}
+	config.FileSystem = fs
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	value := []byte(fmt.Sprintf("%04096d", 123))
+	for i := 0; i < 1000; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), value)
+		require.Nil(t, err)
+	}
+	require.True(t, len(s.dataFiles) > 0)
+	rotated := make([]string, 0, len(s.index))
+	for key, entry := range s.index {
+		if int(entry.ID) < s.cur.ID() {
+			rotated = append(rotated, key)
+		}
+	}
+	require.NotEmpty(t, rotated)
+
+	// crash without closing, unsynced writes are lost
+	err = fs.crash()
+	require.Nil(t, err)
+	err = s.lock.Unlock()
+	require.Nil(t, err)
+
+	config.FileSystem = nil
+	s, err = Open(config)
+	require.Nil(t, err)
+	for _, key := range rotated {
+		v, err := s.Get([]byte(key))
+		require.Nil(t, err)
+		require.Equal(t, value, v)
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+// dirSyncFileSystem counts syncs of directories
+type dirSyncFileSystem struct {
+	mutex sync.Mutex
+	syncs map[string]int
+}
+
+func (fs *dirSyncFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &dirSyncFile{File: file, fs: fs}, nil
+}
+
+type dirSyncFile struct {
+	*os.File
+	fs *dirSyncFileSystem
+}
+
+func (f *dirSyncFile) Sync() error {
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		f.fs.mutex.Lock()
+		f.fs.syncs[f.Name()]++
+		f.fs.mutex.Unlock()
+	}
+	return f.File.Sync()
+}
+
+func TestMergeSyncsDirectory(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	fs := &dirSyncFileSystem{syncs: make(map[string]int)}
+	config.FileSystem = fs
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i%10)), []byte(fmt.Sprintf("%01024d", i)))
+		require.Nil(t, err)
+	}
+	before := fs.syncs[config.RootDirectory]
+	err = s.Merge()
+	require.Nil(t, err)
+	// new current file, saved journal, swapped files and removed journal
+	require.Equal(t, before+4, fs.syncs[config.RootDirectory])
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestMergeInProgress(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	s.isMerging = true
+	err = s.Merge()
+	require.Equal(t, ErrMergeInProgress, err)
+	s.isMerging = false
+	err = s.Merge()
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestVersions(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxVersions = 3
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	key := []byte("key")
+	for i := 0; i < 5; i++ {
+		err := s.Put(key, []byte(fmt.Sprintf("%d", i)))
+		require.Nil(t, err)
+	}
+	check := func() {
+		for n := 0; n < 3; n++ {
+			value, err := s.GetVersion(key, n)
+			require.Nil(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("%d", 4-n)), value)
+		}
+		_, err := s.GetVersion(key, 3)
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+	check()
+	// only the pruned versions are garbage
+	size := NewRecordWithoutChecksum(NormalFlag, key, []byte("0")).Size()
+	require.Equal(t, 2*size, s.meta.ReusableSpace)
+
+	err = s.Merge()
+	require.Nil(t, err)
+	check()
+	err = s.Put([]byte("other"), []byte("value"))
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// versions are rebuilt from data files
+	s, err = Open(config)
+	require.Nil(t, err)
+	check()
+	err = s.Delete(key)
+	require.Nil(t, err)
+	_, err = s.GetVersion(key, 1)
+	require.Equal(t, ErrKeyNotFound, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// disabled versioning only keeps the current value
+	config.MaxVersions = 0
+	s, err = Open(config)
+	require.Nil(t, err)
+	err = s.Put(key, []byte("new"))
+	require.Nil(t, err)
+	err = s.Put(key, []byte("newer"))
+	require.Nil(t, err)
+	_, err = s.GetVersion(key, 1)
+	require.Equal(t, ErrKeyNotFound, err)
+	value, err := s.GetVersion(key, 0)
+	require.Nil(t, err)
+	require.Equal(t, []byte("newer"), value)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestCloseWithAutoMerging(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.AutoMerging = true
+	config.MergeInterval = time.Millisecond
+	config.MergeSpaceThreshold = 0
+	config.MergeRatioThreshold = 0
+
+	for i := 0; i < 20; i++ {
+		s, err := Open(config)
+		require.Nil(t, err)
+		for j := 0; j < 10; j++ {
+			err = s.Put([]byte("key"), []byte(fmt.Sprintf("value%d", j)))
+			require.Nil(t, err)
+		}
+		// give the ticker a chance to start a merge before closing
+		time.Sleep(time.Duration(i%3) * time.Millisecond)
+		done := make(chan error)
+		go func() {
+			done <- s.Close()
+		}()
+		select {
+		case err := <-done:
+			require.Nil(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("close did not return")
+		}
+	}
+}
+
+func TestIncrementalMerge(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 4096
+	config.MergeMaxFiles = 2
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	value := func(i, round int) []byte {
+		return []byte(fmt.Sprintf("%0512d", i*10+round))
+	}
+	n := 20
+	for round := 0; round < 3; round++ {
+		for i := 0; i < n; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i)), value(i, round))
+			require.Nil(t, err)
+		}
+	}
+	err = s.Delete([]byte(fmt.Sprintf("%016d", 0)))
+	require.Nil(t, err)
+	before := len(s.DataFiles())
+	_, filesToMerge := s.MergeEstimate()
+	require.Equal(t, 2, filesToMerge)
+	diskBytes := func() (size int64) {
+		for _, file := range s.DataFiles() {
+			size += file.Size
+		}
+		return size
+	}
+
+	check := func(s *MKV) {
+		_, err := s.Get([]byte(fmt.Sprintf("%016d", 0)))
+		require.Equal(t, ErrKeyNotFound, err)
+		for i := 1; i < n; i++ {
+			actual, err := s.Get([]byte(fmt.Sprintf("%016d", i)))
+			require.Nil(t, err)
+			require.Equal(t, value(i, 2), actual)
+		}
+	}
+	// each merge only rewrites the oldest files, the rest keeps its ids
+	for i := 0; i < before; i++ {
+		files := s.DataFiles()
+		// the estimate is the garbage of the merged files
+		reclaimable, _ := s.MergeEstimate()
+		require.Equal(t, files[0].Garbage+files[1].Garbage, reclaimable)
+		size := diskBytes()
+		err = s.Merge()
+		require.Nil(t, err)
+		check(s)
+		require.Equal(t, size-reclaimable, diskBytes())
+		require.Equal(t, files[len(files)-1], s.DataFiles()[len(s.DataFiles())-1])
+	}
+	require.True(t, len(s.DataFiles()) < before)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// the data files alone give the same result
+	err = os.Remove(filepath.Join(config.RootDirectory, indexFileName))
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	check(s)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestMergeProgress(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("value%d", round)))
+			require.Nil(t, err)
+		}
+	}
+	size := s.DataFiles()[0].Size
+	var reports []MergeProgress
+	err = s.MergeWithProgress(func(p MergeProgress) {
+		reports = append(reports, p)
+	})
+	require.Nil(t, err)
+	require.Len(t, reports, 11)
+	for i := 1; i < len(reports); i++ {
+		require.True(t, reports[i].BytesDone >= reports[i-1].BytesDone)
+	}
+	last := reports[len(reports)-1]
+	require.Equal(t, last.BytesTotal, last.BytesDone)
+	require.Equal(t, s.DataFiles()[0].Size, last.BytesTotal)
+	require.Equal(t, 1, last.FilesTotal)
+	require.Equal(t, last.FilesTotal, last.FilesDone)
+	require.Equal(t, 0, reports[0].FilesDone)
+	// the first round of writes is freed
+	require.Equal(t, size-last.BytesTotal, last.Reclaimed)
+	require.Equal(t, int64(0), reports[0].Reclaimed)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestFlushIndex(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 12
+	config.SyncWrite = true
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	value := func(i, round int) []byte {
+		return []byte(fmt.Sprintf("%0256d", i*10+round))
+	}
+	n := 100
+	for i := 0; i < n; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), value(i, 0))
+		require.Nil(t, err)
+	}
+	err = s.FlushIndex()
+	require.Nil(t, err)
+	checkpoint := s.meta.Checkpoint
+	require.True(t, checkpoint.FileID > 0)
+	require.True(t, checkpoint.Offset > 0)
+	for i := n / 2; i < n; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), value(i, 1))
+		require.Nil(t, err)
+	}
+	err = s.Delete([]byte(fmt.Sprintf("%016d", n-1)))
+	require.Nil(t, err)
+	seq := s.seq
+
+	// crash without closing, the first data file and the indexed part of the
+	// checkpoint file are zeroed to prove they aren't replayed
+	err = s.lock.Unlock()
+	require.Nil(t, err)
+	name := s.getDataFile(0).Name()
+	info, err := os.Stat(name)
+	require.Nil(t, err)
+	err = os.WriteFile(name, make([]byte, info.Size()), 0600)
+	require.Nil(t, err)
+	f, err := os.OpenFile(s.getDataFile(checkpoint.FileID).Name(), os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	_, err = f.WriteAt(make([]byte, checkpoint.Offset), 0)
+	require.Nil(t, err)
+	err = f.Close()
+	require.Nil(t, err)
+
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Equal(t, seq, s.seq)
+	require.Len(t, s.index, n-1)
+	for i := n / 2; i < n-1; i++ {
+		actual, err := s.Get([]byte(fmt.Sprintf("%016d", i)))
+		require.Nil(t, err)
+		require.Equal(t, value(i, 1), actual)
+	}
+	_, err = s.Get([]byte(fmt.Sprintf("%016d", n-1)))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// a merge invalidates the checkpoint
+	err = s.Merge()
+	require.Nil(t, err)
+	require.Nil(t, s.meta.Checkpoint)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestIndexFlushInterval(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.IndexFlushInterval = time.Millisecond
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		meta, err := LoadMeta(config.RootDirectory)
+		return err == nil && meta.Checkpoint != nil && meta.Checkpoint.Seq == 1
+	}, time.Second, time.Millisecond)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestShardSize(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 12
+	config.ShardSize = 4
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	value := func(i, round int) []byte {
+		return []byte(fmt.Sprintf("%0256d", i*10+round))
+	}
+	n := 100
+	for round := 0; round < 2; round++ {
+		for i := 0; i < n; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i)), value(i, round))
+			require.Nil(t, err)
+		}
+	}
+	require.True(t, s.cur.ID() >= 8)
+	names, err := filepath.Glob(filepath.Join(config.RootDirectory, "*.data"))
+	require.Nil(t, err)
+	require.Empty(t, names)
+	require.FileExists(t, filepath.Join(config.RootDirectory, "00000004", "00000005.data"))
+
+	err = s.Merge()
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// the layout is fixed once written
+	flat := *config
+	flat.ShardSize = 0
+	_, err = Open(&flat)
+	require.NotNil(t, err)
+
+	s, err = Open(config)
+	require.Nil(t, err)
+	for i := 0; i < n; i++ {
+		actual, err := s.Get([]byte(fmt.Sprintf("%016d", i)))
+		require.Nil(t, err)
+		require.Equal(t, value(i, 1), actual)
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestScan(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for _, key := range []string{"b/2", "a/1", "b/1", "c", "b/3"} {
+		err := s.Put([]byte(key), []byte("value"))
+		require.Nil(t, err)
+	}
+	err = s.Delete([]byte("b/3"))
+	require.Nil(t, err)
+	var keys []string
+	err = s.Scan("b/", func(key string, entry *Entry) error {
+		keys = append(keys, key)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"b/1", "b/2"}, keys)
+
+	stop := errors.New("stop")
+	err = s.Scan("", func(key string, entry *Entry) error {
+		return stop
+	})
+	require.Equal(t, stop, err)
+
+	// ScanFrom starts after start and stops without an error
+	keys = nil
+	err = s.ScanFrom("", "a/1", func(key string, entry *Entry) error {
+		keys = append(keys, key)
+		if len(keys) == 2 {
+			return ErrStopScan
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"b/1", "b/2"}, keys)
+	keys = nil
+	err = s.ScanFrom("b/", "b/1", func(key string, entry *Entry) error {
+		keys = append(keys, key)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"b/2"}, keys)
+	err = s.ScanFrom("", "", func(key string, entry *Entry) error {
+		return stop
+	})
+	require.Equal(t, stop, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestTruncate(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 12
+	config.ShardSize = 2
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	value := []byte(fmt.Sprintf("%0256d", 0))
+	for i := 0; i < 100; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), value)
+		require.Nil(t, err)
+	}
+	err = s.FlushIndex()
+	require.Nil(t, err)
+	r, _, err := s.OpenReaderAt([]byte(fmt.Sprintf("%016d", 0)))
+	require.Nil(t, err)
+	seq := s.seq
+
+	err = s.Truncate()
+	require.Nil(t, err)
+	require.Empty(t, s.index)
+	require.Len(t, s.DataFiles(), 1)
+	require.Equal(t, int64(0), s.Stats().DiskBytes)
+	_, err = s.Get([]byte(fmt.Sprintf("%016d", 0)))
+	require.Equal(t, ErrKeyNotFound, err)
+	_, err = r.ReadAt(make([]byte, 1), 0)
+	require.Equal(t, ErrValueGone, err)
+	names, err := filepath.Glob(filepath.Join(config.RootDirectory, "*", "*.data"))
+	require.Nil(t, err)
+	require.Len(t, names, 1)
+
+	// the store keeps working and numbering writes
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	require.Equal(t, seq+1, s.seq)
+	err = s.Close()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Len(t, s.index, 1)
+	actual, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), actual)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestHintFileError(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 10
+	logger := &recordLogger{}
+	config.Logger = logger
+
+	// a directory in place of the hint file of the first data file makes writing it fail
+	err = os.MkdirAll(filepath.Join(config.RootDirectory, fmt.Sprintf(hintFileExtension, 0)), 0700)
+	require.Nil(t, err)
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; s.Stats().DataFiles < 3; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), make([]byte, 100))
+		require.Nil(t, err)
+	}
+	require.Equal(t, int64(1), s.Stats().HintErrors)
+	require.True(t, logger.find("WARN create hint file 0 error"))
+	require.FileExists(t, filepath.Join(config.RootDirectory, fmt.Sprintf(hintFileExtension, 1)))
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestWritesDuringMerge(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	expected := make(map[string]string)
+	put := func(key string, value string) {
+		err := s.Put([]byte(key), []byte(value))
+		require.Nil(t, err)
+		expected[key] = value
+	}
+	for i := 0; i < 10; i++ {
+		put(fmt.Sprintf("%016d", i), "merged")
+	}
+	// the progress callback runs without the lock, so these writes land during the merge
+	// in files above the merged range
+	written := false
+	err = s.MergeWithProgress(func(p MergeProgress) {
+		if written {
+			return
+		}
+		written = true
+		put(fmt.Sprintf("%016d", 0), "overwritten")
+		put("during", "value")
+	})
+	require.Nil(t, err)
+	put("after", "value")
+	check := func() {
+		require.Len(t, s.index, len(expected))
+		for key, value := range expected {
+			actual, err := s.Get([]byte(key))
+			require.Nil(t, err, key)
+			require.Equal(t, []byte(value), actual, key)
+		}
+	}
+	check()
+
+	// reopen from the index file, then from data files
+	err = s.Close()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	check()
+	err = s.Close()
+	require.Nil(t, err)
+	err = os.Remove(filepath.Join(config.RootDirectory, indexFileName))
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	check()
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+// corruptFileSystem flips a bit of every write to data files while corrupt is set
+type corruptFileSystem struct {
+	corrupt bool
+}
+
+func (fs *corruptFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptFile{File: file, fs: fs}, nil
+}
+
+type corruptFile struct {
+	*os.File
+	fs *corruptFileSystem
+}
+
+func (f *corruptFile) WriteAt(p []byte, offset int64) (int, error) {
+	if f.fs.corrupt && len(p) > 0 {
+		p = append([]byte{}, p...)
+		p[len(p)-1] ^= 1
+	}
+	return f.File.WriteAt(p, offset)
+}
+
+func TestVerifyWrites(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	fs := &corruptFileSystem{}
+	config.FileSystem = fs
+	config.VerifyWrites = true
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	fs.corrupt = true
+	err = s.Put([]byte("key"), []byte("corrupt"))
+	require.Equal(t, ErrWriteVerify, err)
+	err = s.Delete([]byte("key"))
+	require.Equal(t, ErrWriteVerify, err)
+	fs.corrupt = false
+
+	// the failed writes were rolled back
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	report, err := s.Verify()
+	require.Nil(t, err)
+	require.Equal(t, int64(0), report.Corrupt)
+	err = s.Put([]byte("other"), []byte("value"))
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestFileModes(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 10
+	config.ShardSize = 2
+	config.FileMode = 0640
+	config.DirMode = 0750
+	// the modes are exact whatever the umask
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	put := func(files int) {
+		for i := 0; s.Stats().DataFiles < files; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i%4)), make([]byte, 100))
+			require.Nil(t, err)
+		}
+	}
+	// rotations after the merge leave hint files
+	put(3)
+	err = s.Merge()
+	require.Nil(t, err)
+	put(5)
+	err = s.FlushIndex()
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// a torn tail is recovered on open
+	files, err := listFiles(osFileSystem{}, config.RootDirectory, ".data")
+	require.Nil(t, err)
+	file, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 3})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	s, err = Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	kinds := make(map[string]int)
+	err = filepath.Walk(config.RootDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			require.Equal(t, os.FileMode(0750), info.Mode().Perm(), path)
+			kinds["dir"]++
+		} else {
+			require.Equal(t, os.FileMode(0640), info.Mode().Perm(), path)
+			kinds[filepath.Ext(path)]++
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	for _, kind := range []string{"dir", ".data", ".hint", ".json", ".lock", ""} {
+		require.NotZero(t, kinds[kind], kind)
+	}
+}
+
+func TestCloseDuringMerge(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	n := 1000
+	for i := 0; i < n; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte("value"))
+		require.Nil(t, err)
+	}
+	// a slow merge, which would take 10s to finish
+	started := make(chan struct{})
+	merged := make(chan error)
+	go func() {
+		once := sync.Once{}
+		merged <- s.MergeWithProgress(func(p MergeProgress) {
+			once.Do(func() { close(started) })
+			time.Sleep(10 * time.Millisecond)
+		})
+	}()
+	<-started
+	start := time.Now()
+	err = s.Close()
+	require.Nil(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, ErrMergeAborted, <-merged)
+
+	// the aborted merge left the store as it was
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Len(t, s.index, n)
+	tmpDirs, err := filepath.Glob(filepath.Join(config.RootDirectory, "merge*"))
+	require.Nil(t, err)
+	require.Empty(t, tmpDirs)
+	value, err := s.Get([]byte(fmt.Sprintf("%016d", n-1)))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// the wait for a merge stuck in a key is bounded by the context
+	release := make(chan struct{})
+	started = make(chan struct{})
+	go func() {
+		once := sync.Once{}
+		merged <- s.MergeWithProgress(func(p MergeProgress) {
+			once.Do(func() { close(started) })
+			<-release
+		})
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.CloseCtx(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	err = s.Merge()
+	require.Equal(t, ErrMergeInProgress, err)
+	close(release)
+	require.Equal(t, ErrMergeAborted, <-merged)
+	err = s.Merge()
+	require.Equal(t, ErrMergeAborted, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestMergeCtx(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	n := 100
+	for round := 0; round < 2; round++ {
+		for i := 0; i < n; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("value%d", round)))
+			require.Nil(t, err)
+		}
+	}
+	check := func() {
+		require.Len(t, s.index, n)
+		for i := 0; i < n; i++ {
+			value, err := s.Get([]byte(fmt.Sprintf("%016d", i)))
+			require.Nil(t, err)
+			require.Equal(t, []byte("value1"), value)
+		}
+	}
+	stats := s.Stats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.MergeCtx(ctx)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, len(s.DataFiles()))
+
+	// cancel after the first key is copied
+	ctx, cancel = context.WithCancel(context.Background())
+	copied := 0
+	err = s.merge(ctx, false, false, func(p MergeProgress) {
+		copied++
+		cancel()
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, copied)
+	check()
+	require.True(t, s.Stats().ReusableBytes > 0)
+	tmpDirs, err := filepath.Glob(filepath.Join(config.RootDirectory, "merge*"))
+	require.Nil(t, err)
+	require.Empty(t, tmpDirs)
+
+	// the store merges and reopens as usual afterwards
+	err = s.Merge()
+	require.Nil(t, err)
+	check()
+	require.True(t, s.Stats().DiskBytes < stats.DiskBytes)
+	err = s.Close()
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	check()
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestMergeFilter(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxVersions = 2
+	config.MergeFilter = func(key []byte) bool {
+		return !strings.HasPrefix(string(key), "gone/")
+	}
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	n := 100
+	for round := 0; round < 2; round++ {
+		for _, prefix := range []string{"gone/", "kept/"} {
+			for i := 0; i < n; i++ {
+				err := s.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte(fmt.Sprintf("value%d", round)))
+				require.Nil(t, err)
+			}
+		}
+	}
+	events, cancel := s.Subscribe()
+	defer cancel()
+	size := s.DataFiles()[0].Size
+	require.Nil(t, s.Merge())
+	// the merged files hold the kept keys only
+	files := s.DataFiles()
+	require.Less(t, files[0].Size, size/2+size/10)
+	event := <-events
+	require.True(t, event.Deleted)
+	require.True(t, strings.HasPrefix(string(event.Key), "gone/"))
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			_, err := s.Get([]byte(fmt.Sprintf("gone/%d", i)))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = s.GetVersion([]byte(fmt.Sprintf("gone/%d", i)), 1)
+			require.Equal(t, ErrKeyNotFound, err)
+			value, err := s.Get([]byte(fmt.Sprintf("kept/%d", i)))
+			require.Nil(t, err)
+			require.Equal(t, []byte("value1"), value)
+		}
+	}
+	check()
+	cancel()
+	require.Nil(t, s.Close())
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	check()
+}
+
+func TestMergeFilterRewritten(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxVersions = 2
+	config.MergeFilter = func(key []byte) bool {
+		return !strings.HasPrefix(string(key), "gone/")
+	}
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for round := 0; round < 2; round++ {
+		for _, prefix := range []string{"gone/", "kept/"} {
+			for i := 0; i < 10; i++ {
+				err := s.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte(fmt.Sprintf("value%d", round)))
+				require.Nil(t, err)
+			}
+		}
+	}
+	// a dropped key written again while merging keeps the new value
+	var once sync.Once
+	err = s.MergeWithProgress(func(p MergeProgress) {
+		once.Do(func() {
+			require.Nil(t, s.Put([]byte("gone/0"), []byte("rewritten")))
+		})
+	})
+	require.Nil(t, err)
+
+	check := func() {
+		value, err := s.Get([]byte("gone/0"))
+		require.Nil(t, err)
+		require.Equal(t, []byte("rewritten"), value)
+		// its versions in the merged files are gone
+		_, err = s.GetVersion([]byte("gone/0"), 1)
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = s.Get([]byte("gone/1"))
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+	check()
+	require.Nil(t, s.Close())
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	check()
+}
+
+func TestDeletePrefix(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	for _, prefix := range []string{"a/", "b/"} {
+		for i := 0; i < 10; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte("value"))
+			require.Nil(t, err)
+		}
+	}
+	reusable := s.Stats().ReusableBytes
+	n, err := s.DeletePrefix([]byte("a/"))
+	require.Nil(t, err)
+	require.Equal(t, 10, n)
+	require.Greater(t, s.Stats().ReusableBytes, reusable)
+	for i := 0; i < 10; i++ {
+		_, err := s.Get([]byte(fmt.Sprintf("a/%d", i)))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = s.Get([]byte(fmt.Sprintf("b/%d", i)))
+		require.Nil(t, err)
+	}
+
+	// match narrows the keys deleted
+	n, err = s.DeletePrefixCtx(context.Background(), []byte("b/"), func(key []byte) bool {
+		return string(key) != "b/0"
+	})
+	require.Nil(t, err)
+	require.Equal(t, 9, n)
+	_, err = s.Get([]byte("b/0"))
+	require.Nil(t, err)
+	n, err = s.DeletePrefix([]byte("c/"))
+	require.Nil(t, err)
+	require.Zero(t, n)
+}
+
+func TestFormatVersion(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	require.Nil(t, s.Put([]byte("key"), []byte("value")))
+	require.Nil(t, s.Close())
+	meta, err := LoadMeta(config.RootDirectory)
+	require.Nil(t, err)
+	// plain records need no newer version than 1
+	require.Equal(t, 1, meta.FormatVersion)
+	require.Equal(t, ChecksumCRC32, meta.ChecksumType)
+
+	// stores written before the format was recorded open and get it
+	meta.FormatVersion = 0
+	meta.ChecksumType = ""
+	require.Nil(t, SaveMeta(meta, config.RootDirectory, defaultFileMode))
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	meta, err = LoadMeta(config.RootDirectory)
+	require.Nil(t, err)
+	require.Equal(t, 1, meta.FormatVersion)
+
+	// newer formats are refused, the store is left as it is
+	for _, format := range []Meta{
+		{FormatVersion: FormatVersion + 1, ChecksumType: ChecksumCRC32},
+		{FormatVersion: FormatVersion, ChecksumType: "crc32c"},
+	} {
+		meta.FormatVersion = format.FormatVersion
+		meta.ChecksumType = format.ChecksumType
+		require.Nil(t, SaveMeta(meta, config.RootDirectory, defaultFileMode))
+		_, err = Open(config)
+		require.Equal(t, ErrUnsupportedFormat, errors.Cause(err))
+		config.ReadOnly = true
+		_, err = Open(config)
+		require.Equal(t, ErrUnsupportedFormat, errors.Cause(err))
+		config.ReadOnly = false
+		saved, err := LoadMeta(config.RootDirectory)
+		require.Nil(t, err)
+		require.Equal(t, meta, saved)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 10
+	config.MergeMaxFiles = 1
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("value%d", round)))
+			require.Nil(t, err)
+		}
+	}
+	require.Nil(t, s.Migrate(1))
+	require.Zero(t, s.merges)
+	require.Equal(t, ErrUnsupportedFormat, errors.Cause(s.Migrate(FormatVersion+1)))
+	// encrypting needs a key
+	require.NotNil(t, s.Migrate(formatEncrypted))
+	require.Zero(t, s.merges)
+
+	// a store of an older format is rewritten whole, whatever MergeMaxFiles
+	s.meta.FormatVersion = 0
+	require.Nil(t, s.Migrate(1))
+	require.Equal(t, uint64(1), s.merges)
+	require.Zero(t, s.Stats().ReusableBytes)
+	require.Nil(t, s.Migrate(1))
+	require.Equal(t, uint64(1), s.merges)
+	require.Nil(t, s.Close())
+
+	// migrating to formatEncrypted encrypts the records written without a key
+	config.EncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Nil(t, s.Migrate(formatEncrypted))
+	require.Equal(t, uint64(1), s.merges)
+	for i := 0; i < 100; i++ {
+		value, err := s.Get([]byte(fmt.Sprintf("%016d", i)))
+		require.Nil(t, err)
+		require.Equal(t, []byte("value1"), value)
+	}
+	require.Nil(t, s.Close())
+	meta, err := LoadMeta(config.RootDirectory)
+	require.Nil(t, err)
+	require.Equal(t, formatEncrypted, meta.FormatVersion)
+	files, err := filepath.Glob(filepath.Join(config.RootDirectory, "*.data"))
+	require.Nil(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		require.Nil(t, err)
+		require.NotContains(t, string(data), "value1")
+	}
+}
+
+func TestOversizedRecord(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1024
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("small"), []byte("value"))
+	require.Nil(t, err)
+	large := []byte(strings.Repeat("x", 64*1024))
+	err = s.Put([]byte("large"), large)
+	require.Nil(t, err)
+	err = s.Put([]byte("after"), []byte("value"))
+	require.Nil(t, err)
+
+	// the large record has a file of its own, the writes around it don't share it
+	require.Equal(t, uint64(0), s.index["small"].ID)
+	require.Equal(t, uint64(1), s.index["large"].ID)
+	require.Equal(t, uint64(2), s.index["after"].ID)
+	require.Equal(t, s.RecordSize([]byte("large"), large), s.dataFiles[1].Size())
+	err = s.Close()
+	require.Nil(t, err)
+
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	value, err := s.Get([]byte("large"))
+	require.Nil(t, err)
+	require.Equal(t, large, value)
+	err = s.Merge()
+	require.Nil(t, err)
+	value, err = s.Get([]byte("large"))
+	require.Nil(t, err)
+	require.Equal(t, large, value)
+}
+
+func TestOpenError(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+
+	// the meta can't be saved, the failed open leaves the dir unlocked
+	tmp := filepath.Join(config.RootDirectory, metaFileName+".tmp")
+	err = os.MkdirAll(filepath.Join(tmp, "dir"), 0700)
+	require.Nil(t, err)
+	_, err = Open(config)
+	require.NotNil(t, err)
+	err = os.RemoveAll(tmp)
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestCompactOnOpen(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1024
+	config.MergeSpaceThreshold = 1024
+	config.MergeRatioThreshold = 0.5
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err = s.Put([]byte("key"), []byte(fmt.Sprintf("value %d", i)))
+		require.Nil(t, err)
+	}
+	err = s.Put([]byte("deleted"), []byte("value"))
+	require.Nil(t, err)
+	err = s.Delete([]byte("deleted"))
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Greater(t, s.Stats().ReusableBytes, config.MergeSpaceThreshold)
+	err = s.Close()
+	require.Nil(t, err)
+
+	config.CompactOnOpen = true
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	require.Equal(t, int64(0), s.Stats().ReusableBytes)
+	value, err := s.Get([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value 99"), value)
+	_, err = s.Get([]byte("deleted"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Nil(t, s.Close())
+
+	// auto merges start after the compaction, so they can't make it fail
+	config.MergeInterval = time.Nanosecond
+	for round := 0; round < 20; round++ {
+		config.AutoMerging, config.CompactOnOpen = false, false
+		s, err = Open(config)
+		require.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			err = s.Put([]byte("key"), []byte(fmt.Sprintf("value %d", i)))
+			require.Nil(t, err)
+		}
+		require.Nil(t, s.Close())
+		config.AutoMerging, config.CompactOnOpen = true, true
+		s, err = Open(config)
+		require.Nil(t, err)
+		require.Equal(t, int64(0), s.Stats().ReusableBytes)
+		require.Nil(t, s.Close())
+	}
+	s, err = Open(config)
+	require.Nil(t, err)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package engine
+
+// mmapFile is only supported on linux, other platforms read data files through
+// golang.org/x/exp/mmap, which can't return values in place
+func mmapFile(file File) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package engine
+
+import "time"
+
+const (
+	writeEventBufferSize = 1024
+	subscriberBufferSize = 1024
+)
+
+// ChangeEvent describes a write applied to the store, Value is nil for a delete.
+// Seq increases by one for every write, so a gap means events were missed.
+// Key and Value are shared by all consumers and must not be modified.
+type ChangeEvent struct {
+	Key       []byte
+	Value     []byte
+	Deleted   bool
+	Timestamp time.Time
+	Seq       uint64
+}
+
+func (m *MKV) startNotify() {
+	m.writes = make(chan ChangeEvent, writeEventBufferSize)
+	m.writesDone = make(chan struct{})
+	m.subscribers = make(map[chan ChangeEvent]struct{})
+	go func() {
+		defer close(m.writesDone)
+		for event := range m.writes {
+			if m.config.OnWrite != nil {
+				m.config.OnWrite(event.Key, event.Value, event.Deleted)
+			}
+			m.publish(event)
+		}
+		m.subscribersMutex.Lock()
+		for ch := range m.subscribers {
+			close(ch)
+		}
+		m.subscribers = nil
+		m.subscribersMutex.Unlock()
+	}()
+}
+
+// publish hands event to every subscriber, a subscriber whose buffer is full
+// is dropped and its channel closed instead of blocking the others
+func (m *MKV) publish(event ChangeEvent) {
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (m *MKV) hasListeners() bool {
+	if m.config.OnWrite != nil {
+		return true
+	}
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	return len(m.subscribers) > 0
+}
+
+// write is a write applied to the store, value is nil for a delete
+type write struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+// unlockAndNotify releases the write lock and queues the write for OnWrite and subscribers,
+// notifyMutex is taken before the write lock is released to keep writes in order
+func (m *MKV) unlockAndNotify(key []byte, value []byte, deleted bool) {
+	m.unlockAndNotifyWrites(write{key: key, value: value, deleted: deleted})
+}
+
+// unlockAndNotifyWrites works like unlockAndNotify for writes applied in one lock span,
+// they took the last len(writes) sequence numbers
+func (m *MKV) unlockAndNotifyWrites(writes ...write) {
+	if !m.hasListeners() {
+		m.mutex.Unlock()
+		return
+	}
+	events := make([]ChangeEvent, len(writes))
+	for i, w := range writes {
+		events[i] = ChangeEvent{
+			Key:       append([]byte{}, w.key...),
+			Deleted:   w.deleted,
+			Timestamp: time.Now(),
+			Seq:       m.seq - uint64(len(writes)-1-i),
+		}
+		if !w.deleted {
+			events[i].Value = append([]byte{}, w.value...)
+		}
+	}
+	m.notifyMutex.Lock()
+	defer m.notifyMutex.Unlock()
+	m.mutex.Unlock()
+	if m.writesClosed {
+		return
+	}
+	for _, event := range events {
+		m.writes <- event
+	}
+}
+
+// stopNotify waits until all queued writes are handed out, then closes all subscriptions
+func (m *MKV) stopNotify() {
+	m.notifyMutex.Lock()
+	if !m.writesClosed {
+		m.writesClosed = true
+		close(m.writes)
+	}
+	m.notifyMutex.Unlock()
+	<-m.writesDone
+}
+
+// Subscribe returns a channel receiving every write applied to the store from now on,
+// and a func to cancel the subscription. A subscriber which doesn't keep up is not
+// buffered forever: once its buffer of 1024 events is full the subscription is dropped
+// and the channel closed, the consumer has to resync from the store. All channels are
+// closed when the store is closed.
+func (m *MKV) Subscribe() (<-chan ChangeEvent, func()) {
+	ch := make(chan ChangeEvent, subscriberBufferSize)
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	if m.subscribers == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	m.subscribers[ch] = struct{}{}
+	cancel := func() {
+		m.subscribersMutex.Lock()
+		defer m.subscribersMutex.Unlock()
+		if _, ok := m.subscribers[ch]; ok {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
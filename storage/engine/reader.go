@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// valueReader reads the value of an entry in place. Merge moves live entries,
+// so the location is looked up on every read. A value which is no longer the
+// current or a kept version of its key stays where it is until the next merge.
+type valueReader struct {
+	m      *MKV
+	key    string
+	entry  *Entry
+	merges uint64
+	// header is the size of the record header and key in front of the value
+	header int64
+	size   int64
+}
+
+// OpenReaderAt returns a reader for the value of key and the size of the value,
+// it reads the data file directly without loading the value or checking its checksum.
+// Reads fail with ErrValueGone once the value was replaced and a merge ran since.
+// An encrypted value can't be read in place, it is decrypted into memory instead.
+func (m *MKV) OpenReaderAt(key []byte) (io.ReaderAt, int64, error) {
+	r, size, _, err := m.OpenReaderAtWithInfo(context.Background(), key)
+	return r, size, err
+}
+
+// OpenReaderAtWithInfo works like OpenReaderAt and describes the value like GetWithInfo,
+// ctx bounds the wait for the lock
+func (m *MKV) OpenReaderAtWithInfo(ctx context.Context, key []byte) (io.ReaderAt, int64, *ObjectInfo, error) {
+	if err := m.rLockCtx(ctx); err != nil {
+		return nil, 0, nil, err
+	}
+	defer m.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, 0, nil, err
+	}
+	entry, ok := m.index[string(key)]
+	if !ok {
+		return nil, 0, nil, ErrKeyNotFound
+	}
+	df := m.getDataFile(int(entry.ID))
+	header, err := readRecordHeader(df, int64(entry.Offset))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if isEncrypted(header[flagPos]) {
+		record, err := m.readRecord(entry)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return bytes.NewReader(record.Value()), int64(len(record.Value())), objectInfo(record, entry), nil
+	}
+	checksum := make([]byte, checksumSize)
+	if _, err := df.ReadAt(checksum, int64(entry.Offset+entry.Size)-checksumSize); err != nil {
+		return nil, 0, nil, err
+	}
+	ksize := keySize(header)
+	r := &valueReader{
+		m:      m,
+		key:    string(key),
+		entry:  entry,
+		merges: m.merges,
+		header: int64(len(header)) + int64(ksize),
+		size:   int64(valueSize(header)),
+	}
+	info := &ObjectInfo{
+		Checksum: binary.BigEndian.Uint32(checksum),
+		UserFlag: header[flagPos] >> userFlagShift,
+		ModTime:  time.Unix(0, entry.ModTime),
+	}
+	return r, r.size, info, nil
+}
+
+// GetNoCopy works like Get, a value in an immutable data file is returned in place from
+// the mapping of the file rather than copied. The value must not be modified and is only
+// valid until release is called, the file stays mapped until then even if merged away,
+// so release must be called once the value is no longer used. Values which can't be
+// returned in place, such as those of the current data file, are copied.
+func (m *MKV) GetNoCopy(key []byte) ([]byte, func(), error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, ok := m.index[string(key)]
+	if !ok {
+		return nil, nil, ErrKeyNotFound
+	}
+	df := m.getDataFile(int(entry.ID))
+	if data, ok := df.pin(int64(entry.Offset), int64(entry.Size)); ok {
+		var once sync.Once
+		release := func() { once.Do(df.unpin) }
+		record := DecodeRecord(data)
+		if !isEncrypted(record.flag) {
+			return record.Value(), release, nil
+		}
+		release()
+	}
+	value, _, err := m.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, func() {}, nil
+}
+
+func (r *valueReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+		eof = io.EOF
+	}
+	r.m.mutex.RLock()
+	defer r.m.mutex.RUnlock()
+	if r.m.merges != r.merges && !r.m.reachable(r.key, r.entry) {
+		return 0, ErrValueGone
+	}
+	df := r.m.getDataFile(int(r.entry.ID))
+	if df == nil {
+		return 0, ErrValueGone
+	}
+	n, err := df.ReadAt(p, int64(r.entry.Offset)+r.header+off)
+	if err != nil {
+		return n, err
+	}
+	return n, eof
+}
+
+// reachable reports whether entry is the current or a kept version of key
+func (m *MKV) reachable(key string, entry *Entry) bool {
+	if m.index[key] == entry {
+		return true
+	}
+	for _, e := range m.versions.list(key) {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
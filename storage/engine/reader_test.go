@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenReaderAt(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("moved"), []byte("0123456789"))
+	require.Nil(t, err)
+	err = s.Put([]byte("replaced"), []byte("abcdef"))
+	require.Nil(t, err)
+
+	_, _, err = s.OpenReaderAt([]byte("missing"))
+	require.Equal(t, ErrKeyNotFound, err)
+	moved, size, err := s.OpenReaderAt([]byte("moved"))
+	require.Nil(t, err)
+	require.Equal(t, int64(10), size)
+	replaced, _, err := s.OpenReaderAt([]byte("replaced"))
+	require.Nil(t, err)
+
+	p := make([]byte, 4)
+	n, err := moved.ReadAt(p, 3)
+	require.Nil(t, err)
+	require.Equal(t, "3456", string(p[:n]))
+	n, err = moved.ReadAt(p, 8)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "89", string(p[:n]))
+
+	// a replaced value stays readable until it is merged away
+	err = s.Put([]byte("replaced"), []byte("new"))
+	require.Nil(t, err)
+	n, err = replaced.ReadAt(p, 0)
+	require.Nil(t, err)
+	require.Equal(t, "abcd", string(p[:n]))
+
+	err = s.Merge()
+	require.Nil(t, err)
+	n, err = moved.ReadAt(p, 0)
+	require.Nil(t, err)
+	require.Equal(t, "0123", string(p[:n]))
+	_, err = replaced.ReadAt(p, 0)
+	require.Equal(t, ErrValueGone, err)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestGetNoCopy(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 64
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("key"), []byte("0123456789"))
+	require.Nil(t, err)
+	err = s.Put([]byte("other"), []byte(strings.Repeat("x", 64)))
+	require.Nil(t, err)
+	err = s.Put([]byte("current"), []byte("abcdef"))
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	value, release, err := s.GetNoCopy([]byte("key"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("0123456789"), value)
+
+	// the pinned value stays mapped while its file is merged away
+	df := s.dataFiles[int(s.index["key"].ID)]
+	err = s.Put([]byte("key"), []byte("replaced"))
+	require.Nil(t, err)
+	err = s.Merge()
+	require.Nil(t, err)
+	require.Equal(t, []byte("0123456789"), value)
+	release()
+	release()
+	require.Nil(t, df.mapped)
+
+	value, release, err = s.GetNoCopy([]byte("current"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("abcdef"), value)
+	release()
+
+	_, _, err = s.GetNoCopy([]byte("missing"))
+	require.Equal(t, ErrKeyNotFound, err)
+}
@@ -3,59 +3,176 @@ package engine
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"math"
 )
 
-const bitDeleted = 0
+const (
+	bitDeleted = 0
+	// bitWide marks a record with an 8 byte value size, it is set for values larger
+	// than 4GiB only, so records of smaller values keep the original layout
+	bitWide = 1
+	// bitCompact marks a record with 1 byte key and value sizes, it is set for keys
+	// and values up to MaxCompactSize if Config.CompactRecords is set
+	bitCompact = 2
+	// bitEncrypted marks a record whose value is encrypted with Config.EncryptionKey,
+	// the value holds the nonce followed by the ciphertext
+	bitEncrypted = 3
+)
 
 const (
 	NormalFlag = byte(0)
 )
 
+// MaxKeySize is the largest key the 2 byte key size of a record holds
+const MaxKeySize = math.MaxUint16
+
+// MaxCompactSize is the largest key and value of a compact record
+const MaxCompactSize = math.MaxUint8
+
+// the lower bits of the flag are reserved, bit 0 marks tombstones, bit 1 wide records,
+// bit 2 compact records, bit 3 encrypted records, the upper bits hold a flag defined by
+// the application
+const (
+	userFlagShift = 4
+	MaxUserFlag   = byte(1<<(8-userFlagShift) - 1)
+)
+
 const (
 	flagPos        = 0
 	keySizeBegin   = 1
 	valueSizeBegin = 1 + 2
 	keyBegin       = 1 + 2 + 4
+	wideKeyBegin   = 1 + 2 + 8
 	checksumSize   = 4
+
+	compactValueSizeBegin = 1 + 1
+	compactKeyBegin       = 1 + 1 + 1
 )
 
+// headerSize returns the size of the record header, which ends where the key begins
+func headerSize(flag byte) int {
+	if isWide(flag) {
+		return wideKeyBegin
+	}
+	if isCompact(flag) {
+		return compactKeyBegin
+	}
+	return keyBegin
+}
+
+func isWide(flag byte) bool {
+	return (flag>>bitWide)&1 == 1
+}
+
+func isCompact(flag byte) bool {
+	return (flag>>bitCompact)&1 == 1
+}
+
+func isEncrypted(flag byte) bool {
+	return (flag>>bitEncrypted)&1 == 1
+}
+
+// putKeySize encodes ksize into header, which holds at least headerSize(header[flagPos]) bytes
+func putKeySize(header []byte, ksize uint16) {
+	if isCompact(header[flagPos]) {
+		header[keySizeBegin] = byte(ksize)
+		return
+	}
+	binary.BigEndian.PutUint16(header[keySizeBegin:valueSizeBegin], ksize)
+}
+
+// keySize decodes the key size from header
+func keySize(header []byte) uint16 {
+	if isCompact(header[flagPos]) {
+		return uint16(header[keySizeBegin])
+	}
+	return binary.BigEndian.Uint16(header[keySizeBegin:valueSizeBegin])
+}
+
+// putValueSize encodes vsize into header, which holds at least headerSize(header[flagPos]) bytes
+func putValueSize(header []byte, vsize uint64) {
+	if isCompact(header[flagPos]) {
+		header[compactValueSizeBegin] = byte(vsize)
+		return
+	}
+	if isWide(header[flagPos]) {
+		binary.BigEndian.PutUint64(header[valueSizeBegin:wideKeyBegin], vsize)
+		return
+	}
+	binary.BigEndian.PutUint32(header[valueSizeBegin:keyBegin], uint32(vsize))
+}
+
+// valueSize decodes the value size from header
+func valueSize(header []byte) uint64 {
+	if isCompact(header[flagPos]) {
+		return uint64(header[compactValueSizeBegin])
+	}
+	if isWide(header[flagPos]) {
+		return binary.BigEndian.Uint64(header[valueSizeBegin:wideKeyBegin])
+	}
+	return uint64(binary.BigEndian.Uint32(header[valueSizeBegin:keyBegin]))
+}
+
 type Record struct {
 	flag     byte
 	ksize    uint16
-	vsize    uint32
+	vsize    uint64
 	key      []byte
 	value    []byte
 	checksum uint32
 }
 
 func NewRecordWithoutChecksum(flag byte, key []byte, value []byte) *Record {
+	flag &^= 1<<bitWide | 1<<bitCompact
+	if uint64(len(value)) > math.MaxUint32 {
+		flag |= 1 << bitWide
+	}
 	return &Record{
 		flag:  flag,
 		ksize: uint16(len(key)),
-		vsize: uint32(len(value)),
+		vsize: uint64(len(value)),
 		key:   key,
 		value: value,
 	}
 }
 
+// newRecord works like NewRecordWithoutChecksum, the record is compact if compact is
+// set and key and value are small enough
+func newRecord(flag byte, key []byte, value []byte, compact bool) *Record {
+	record := NewRecordWithoutChecksum(flag, key, value)
+	if compact && len(key) <= MaxCompactSize && len(value) <= MaxCompactSize {
+		record.flag |= 1 << bitCompact
+	}
+	return record
+}
+
 func generateChecksum(flag byte, key []byte, value []byte) uint32 {
-	payload := make([]byte, keyBegin+len(key)+len(value))
-	payload[0] = flag
-	binary.BigEndian.PutUint16(payload[keySizeBegin:valueSizeBegin], uint16(len(key)))
-	binary.BigEndian.PutUint32(payload[valueSizeBegin:keyBegin], uint32(len(value)))
-	copy(payload[keyBegin:keyBegin+len(key)], key)
-	copy(payload[keyBegin+len(key):keyBegin+len(key)+len(value)], value)
-	return crc32.ChecksumIEEE(payload)
+	header := make([]byte, headerSize(flag))
+	header[flagPos] = flag
+	putKeySize(header, uint16(len(key)))
+	putValueSize(header, uint64(len(value)))
+	checksum := crc32.ChecksumIEEE(header)
+	checksum = crc32.Update(checksum, crc32.IEEETable, key)
+	return crc32.Update(checksum, crc32.IEEETable, value)
 }
 
 func (r *Record) Size() int64 {
-	return int64(keyBegin + len(r.key) + len(r.value) + checksumSize)
+	return int64(headerSize(r.flag) + len(r.key) + len(r.value) + checksumSize)
 }
 
 func (r *Record) Value() []byte {
 	return r.value
 }
 
+// UserFlag returns the application defined flag of the record
+func (r *Record) UserFlag() byte {
+	return r.flag >> userFlagShift
+}
+
+func (r *Record) Checksum() uint32 {
+	return r.checksum
+}
+
 func (r *Record) Corrupted() bool {
 	checksum := generateChecksum(r.flag, r.key, r.value)
 	return r.checksum != checksum
@@ -71,16 +188,17 @@ func (r *Record) SetDeleted() {
 
 func DecodeRecord(bytes []byte) *Record {
 	flag := bytes[flagPos]
-	ksize := binary.BigEndian.Uint16(bytes[keySizeBegin:valueSizeBegin])
-	vsize := binary.BigEndian.Uint32(bytes[valueSizeBegin:keyBegin])
+	ksize := keySize(bytes)
+	vsize := valueSize(bytes)
 	record := &Record{
 		flag:  flag,
 		ksize: ksize,
 		vsize: vsize,
 	}
-	valueStart := keyBegin + ksize
-	checksumStart := uint32(valueStart) + vsize
-	record.key = bytes[keyBegin:valueStart]
+	keyStart := uint64(headerSize(flag))
+	valueStart := keyStart + uint64(ksize)
+	checksumStart := valueStart + vsize
+	record.key = bytes[keyStart:valueStart]
 	record.value = bytes[valueStart:checksumStart]
 	record.checksum = binary.BigEndian.Uint32(bytes[checksumStart : checksumStart+checksumSize])
 	return record
@@ -89,11 +207,12 @@ func DecodeRecord(bytes []byte) *Record {
 func EncodeRecordWithChecksum(record *Record) []byte {
 	bytes := make([]byte, record.Size())
 	bytes[flagPos] = record.flag
-	binary.BigEndian.PutUint16(bytes[keySizeBegin:valueSizeBegin], record.ksize)
-	binary.BigEndian.PutUint32(bytes[valueSizeBegin:keyBegin], record.vsize)
-	valueStart := keyBegin + record.ksize
-	checksumStart := uint32(valueStart) + record.vsize
-	copy(bytes[keyBegin:valueStart], record.key)
+	putKeySize(bytes, record.ksize)
+	putValueSize(bytes, record.vsize)
+	keyStart := uint64(headerSize(record.flag))
+	valueStart := keyStart + uint64(record.ksize)
+	checksumStart := valueStart + record.vsize
+	copy(bytes[keyStart:valueStart], record.key)
 	copy(bytes[valueStart:checksumStart], record.value)
 	checksum := crc32.ChecksumIEEE(bytes[:checksumStart])
 	binary.BigEndian.PutUint32(bytes[checksumStart:checksumStart+checksumSize], checksum)
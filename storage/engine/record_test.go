@@ -1,7 +1,11 @@
 package engine
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -18,3 +22,149 @@ func TestRecord(t *testing.T) {
 		require.Equal(t, expected, actual)
 	}
 }
+
+func TestWideRecord(t *testing.T) {
+	key := []byte("key")
+	value := []byte("value")
+	expected := &Record{
+		flag:  1 << bitWide,
+		ksize: uint16(len(key)),
+		vsize: uint64(len(value)),
+		key:   key,
+		value: value,
+	}
+	bytes := EncodeRecordWithChecksum(expected)
+	require.Equal(t, int64(wideKeyBegin+len(key)+len(value)+checksumSize), expected.Size())
+	require.Equal(t, int(expected.Size()), len(bytes))
+	actual := DecodeRecord(bytes)
+	require.False(t, actual.Corrupted())
+	require.Equal(t, key, actual.key)
+	require.Equal(t, value, actual.Value())
+
+	// small values keep the narrow layout whatever flag they are given
+	record := NewRecordWithoutChecksum(1<<bitWide, key, value)
+	require.Equal(t, int64(keyBegin+len(key)+len(value)+checksumSize), record.Size())
+}
+
+func TestWideRecordHeader(t *testing.T) {
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "sparse"))
+	require.Nil(t, err)
+	defer file.Close()
+
+	// a sparse record with a value over 4GiB, only its header is read
+	vsize := uint64(math.MaxUint32) + 1
+	header := make([]byte, wideKeyBegin)
+	header[flagPos] = 1 << bitWide
+	binary.BigEndian.PutUint16(header[keySizeBegin:valueSizeBegin], 3)
+	putValueSize(header, vsize)
+	_, err = file.Write(append(header, "key"...))
+	require.Nil(t, err)
+	err = file.Truncate(int64(wideKeyBegin+3) + int64(vsize) + checksumSize)
+	require.Nil(t, err)
+
+	actual, err := readRecordHeader(file, 0)
+	require.Nil(t, err)
+	require.Equal(t, header, actual)
+	require.Equal(t, vsize, valueSize(actual))
+}
+
+func TestCompactRecord(t *testing.T) {
+	key := []byte("key")
+	value := []byte("value")
+	record := newRecord(1<<userFlagShift, key, value, true)
+	require.True(t, isCompact(record.flag))
+	require.Equal(t, int64(compactKeyBegin+len(key)+len(value)+checksumSize), record.Size())
+	bytes := EncodeRecordWithChecksum(record)
+	require.Equal(t, int(record.Size()), len(bytes))
+	actual := DecodeRecord(bytes)
+	require.False(t, actual.Corrupted())
+	require.Equal(t, key, actual.key)
+	require.Equal(t, value, actual.Value())
+	require.Equal(t, byte(1), actual.UserFlag())
+
+	// the smallest compact record is as long as a normal header, so it is read in one step
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "compact"))
+	require.Nil(t, err)
+	defer file.Close()
+	_, err = file.Write(EncodeRecordWithChecksum(newRecord(NormalFlag, nil, nil, true)))
+	require.Nil(t, err)
+	header, err := readRecordHeader(file, 0)
+	require.Nil(t, err)
+	require.Len(t, header, compactKeyBegin)
+
+	// larger keys and values keep the normal layout
+	for _, record := range []*Record{
+		newRecord(NormalFlag, make([]byte, MaxCompactSize+1), value, true),
+		newRecord(NormalFlag, key, make([]byte, MaxCompactSize+1), true),
+		NewRecordWithoutChecksum(1<<bitCompact, key, value),
+	} {
+		require.False(t, isCompact(record.flag))
+	}
+}
+
+func TestCompactRecords(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.CompactRecords = true
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%08d", i)), []byte(fmt.Sprintf("%0*d", i*4, i)))
+		require.Nil(t, err)
+	}
+	err = s.Delete([]byte(fmt.Sprintf("%08d", 0)))
+	require.Nil(t, err)
+	stats := s.Stats()
+	require.Equal(t, stats.DiskBytes, stats.LiveBytes+stats.GarbageBytes)
+	err = s.Merge()
+	require.Nil(t, err)
+	err = s.Close()
+	require.Nil(t, err)
+
+	// records of both layouts are read whether or not new records are compact
+	config.CompactRecords = false
+	err = os.Remove(filepath.Join(config.RootDirectory, indexFileName))
+	require.Nil(t, err)
+	s, err = Open(config)
+	require.Nil(t, err)
+	err = s.Put([]byte("normal"), []byte("value"))
+	require.Nil(t, err)
+	require.Len(t, s.index, 100)
+	for i := 1; i < 100; i++ {
+		value, err := s.Get([]byte(fmt.Sprintf("%08d", i)))
+		require.Nil(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("%0*d", i*4, i)), value)
+		header := keyBegin
+		if len(value) <= MaxCompactSize {
+			header = compactKeyBegin
+		}
+		require.Equal(t, uint64(header+8+len(value)+checksumSize), s.index[fmt.Sprintf("%08d", i)].Size)
+	}
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func BenchmarkCompactRecords(b *testing.B) {
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%t", compact), func(b *testing.B) {
+			config := DefaultConfig()
+			config.RootDirectory = b.TempDir()
+			config.CompactRecords = compact
+			s, err := Open(config)
+			require.Nil(b, err)
+			defer s.Close()
+			value := make([]byte, 10)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Put([]byte(fmt.Sprintf("%016d", i)), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(s.Stats().DiskBytes)/float64(b.N), "disk-bytes/op")
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotContentHash = errors.New("not the hash of a content addressed value")
+	ErrReservedKey    = errors.New("key is reserved for content addressed values and links")
+)
+
+// Names refer to content addressed values by links, a link is stored as a record of the
+// name under linkPrefix with the hash as value. Every hash counts the links to it, the
+// value is deleted once the last link is removed. The links are the truth, the counts are
+// rebuilt from them at open unless the refs file saved along with the index is current.
+// Link and Unlink write the link first, so a crash in between may leave a value without
+// links, but never deletes one which is linked. Hashes and links are only written through
+// PutContentAddressed, Link and Unlink, other writes fail with ErrReservedKey.
+const linkPrefix = "\x00link/"
+
+const refsFileName = "refs.json"
+
+// refsFile holds the counts of links per hash as they were at sequence number Seq
+type refsFile struct {
+	Seq  uint64           `json:"seq"`
+	Refs map[string]int64 `json:"refs"`
+}
+
+func linkKey(name []byte) []byte {
+	return append([]byte(linkPrefix), name...)
+}
+
+// reservedKey reports whether key is a hash or a link, which plain writes must not touch
+// as they would bypass the counts
+func reservedKey(key []byte) bool {
+	return IsContentHash(string(key)) || bytes.HasPrefix(key, []byte(linkPrefix))
+}
+
+// Link makes name refer to the content addressed value of hash, a value name referred to
+// before loses the link. A missing value fails with ErrKeyNotFound.
+func (m *MKV) Link(name []byte, hash string) error {
+	if !IsContentHash(hash) {
+		return ErrNotContentHash
+	}
+	key := linkKey(name)
+	if err := m.checkRecord(key, []byte(hash), 0); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	if _, ok := m.index[hash]; !ok {
+		m.mutex.Unlock()
+		return ErrKeyNotFound
+	}
+	old, err := m.linkTarget(key)
+	if err != nil && err != ErrKeyNotFound {
+		m.mutex.Unlock()
+		return err
+	}
+	if old == hash {
+		m.mutex.Unlock()
+		return nil
+	}
+	if _, err := m.put(key, []byte(hash), 0, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.refs[hash]++
+	writes := []write{{key: key, value: []byte(hash)}}
+	if old != "" {
+		released, err := m.release(old)
+		if err != nil {
+			m.mutex.Unlock()
+			return err
+		}
+		writes = append(writes, released...)
+	}
+	m.unlockAndNotifyWrites(writes...)
+	return nil
+}
+
+// Unlink removes the link of name, the value it referred to is deleted if it was the last
+// link. A name without link fails with ErrKeyNotFound.
+func (m *MKV) Unlink(name []byte) error {
+	key := linkKey(name)
+	m.mutex.Lock()
+	hash, err := m.linkTarget(key)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if err := m.delete(key, m.seq+1); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	released, err := m.release(hash)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.unlockAndNotifyWrites(append([]write{{key: key, deleted: true}}, released...)...)
+	return nil
+}
+
+// LinkTarget returns the hash name refers to
+func (m *MKV) LinkTarget(name []byte) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.linkTarget(linkKey(name))
+}
+
+// RefCount returns the number of names referring to the value of hash
+func (m *MKV) RefCount(hash string) int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.refs[hash]
+}
+
+func (m *MKV) linkTarget(key []byte) (string, error) {
+	value, _, err := m.get(key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// deleteKeys deletes the existing keys among keys and releases the hashes of the deleted
+// links after them. Linked values are skipped, their links still refer to them, unless
+// the last link is deleted too. The writes done are returned on error as well.
+func (m *MKV) deleteKeys(keys [][]byte) ([]write, error) {
+	var writes []write
+	var hashes []string
+	for _, key := range keys {
+		if _, ok := m.index[string(key)]; !ok {
+			continue
+		}
+		if IsContentHash(string(key)) && m.refs[string(key)] > 0 {
+			continue
+		}
+		if bytes.HasPrefix(key, []byte(linkPrefix)) {
+			hash, err := m.linkTarget(key)
+			if err != nil {
+				return writes, err
+			}
+			hashes = append(hashes, hash)
+		}
+		if err := m.delete(key, m.seq+1); err != nil {
+			return writes, err
+		}
+		writes = append(writes, write{key: key, deleted: true})
+	}
+	for _, hash := range hashes {
+		released, err := m.release(hash)
+		writes = append(writes, released...)
+		if err != nil {
+			return writes, err
+		}
+	}
+	return writes, nil
+}
+
+// release drops a link to hash and deletes the value with the last one
+func (m *MKV) release(hash string) ([]write, error) {
+	m.refs[hash]--
+	if m.refs[hash] > 0 {
+		return nil, nil
+	}
+	delete(m.refs, hash)
+	if _, ok := m.index[hash]; !ok {
+		return nil, nil
+	}
+	if err := m.delete([]byte(hash), m.seq+1); err != nil {
+		return nil, err
+	}
+	return []write{{key: []byte(hash), deleted: true}}, nil
+}
+
+// loadRefs sets the counts of links from the refs file if it was saved at the current
+// sequence number, otherwise they are counted from the links
+func (m *MKV) loadRefs() error {
+	file, err := loadRefsFile(m.config.RootDirectory)
+	if err != nil {
+		m.config.logger().Warnf("load refs file error, counting links: %s", err)
+	}
+	if file != nil && file.Seq == m.seq {
+		m.refs = file.Refs
+		return nil
+	}
+	m.refs = make(map[string]int64)
+	for key := range m.index {
+		if !strings.HasPrefix(key, linkPrefix) {
+			continue
+		}
+		hash, err := m.linkTarget([]byte(key))
+		if err != nil {
+			return errors.Wrapf(err, "read link %q error", strings.TrimPrefix(key, linkPrefix))
+		}
+		m.refs[hash]++
+	}
+	return nil
+}
+
+// saveRefs saves the counts of links along with the index, a store without links has
+// no refs file
+func (m *MKV) saveRefs() error {
+	name := filepath.Join(m.config.RootDirectory, refsFileName)
+	if len(m.refs) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	bytes, err := json.Marshal(&refsFile{Seq: m.seq, Refs: m.refs})
+	if err != nil {
+		return err
+	}
+	mode := m.config.fileMode()
+	if err := ioutil.WriteFile(name+".tmp", bytes, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(name+".tmp", mode); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func loadRefsFile(dir string) (*refsFile, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, refsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := new(refsFile)
+	if err := json.Unmarshal(bytes, file); err != nil {
+		return nil, err
+	}
+	if file.Refs == nil {
+		file.Refs = make(map[string]int64)
+	}
+	return file, nil
+}
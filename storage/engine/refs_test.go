@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLink(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	hash, err := s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	other, err := s.PutContentAddressed([]byte("other value"))
+	require.Nil(t, err)
+
+	require.Equal(t, ErrNotContentHash, s.Link([]byte("a"), "value"))
+	require.Equal(t, ErrKeyNotFound, s.Link([]byte("a"), hash[:63]+"0"))
+	require.Nil(t, s.Link([]byte("a"), hash))
+	require.Nil(t, s.Link([]byte("b"), hash))
+	// linking again changes nothing
+	require.Nil(t, s.Link([]byte("b"), hash))
+	require.Equal(t, int64(2), s.RefCount(hash))
+	target, err := s.LinkTarget([]byte("a"))
+	require.Nil(t, err)
+	require.Equal(t, hash, target)
+
+	// the value stays until the last link is removed
+	require.Nil(t, s.Unlink([]byte("a")))
+	require.Equal(t, int64(1), s.RefCount(hash))
+	_, err = s.Get([]byte(hash))
+	require.Nil(t, err)
+	require.Equal(t, ErrKeyNotFound, s.Unlink([]byte("a")))
+	_, err = s.LinkTarget([]byte("a"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// relinking b releases hash
+	require.Nil(t, s.Link([]byte("b"), other))
+	require.Equal(t, int64(0), s.RefCount(hash))
+	_, err = s.Get([]byte(hash))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Nil(t, s.Link([]byte("c"), other))
+
+	// the counts are saved with the index and counted from the links without it
+	require.Nil(t, s.Close())
+	require.FileExists(t, filepath.Join(config.RootDirectory, refsFileName))
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), s.RefCount(other))
+	require.Nil(t, s.Close())
+	require.Nil(t, os.Remove(filepath.Join(config.RootDirectory, refsFileName)))
+	s, err = Open(config)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), s.RefCount(other))
+	require.Nil(t, s.Unlink([]byte("b")))
+	require.Nil(t, s.Unlink([]byte("c")))
+	_, err = s.Get([]byte(other))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Nil(t, s.Close())
+	require.NoFileExists(t, filepath.Join(config.RootDirectory, refsFileName))
+}
+
+func TestLinkReservedKeys(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	hash, err := s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, s.Link([]byte("c"), hash))
+	link := linkKey([]byte("c"))
+
+	// plain writes can't bypass the counts
+	for _, key := range [][]byte{[]byte(hash), link} {
+		require.Equal(t, ErrReservedKey, s.Put(key, []byte("other")))
+		require.Equal(t, ErrReservedKey, s.Delete(key))
+		require.Equal(t, ErrReservedKey, s.Move(key, []byte("moved")))
+		require.Equal(t, ErrReservedKey, s.Copy([]byte("moved"), key))
+	}
+	require.Nil(t, s.Copy([]byte(hash), []byte("copy")))
+	value, err := s.Get([]byte(hash))
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, int64(1), s.RefCount(hash))
+}
+
+func TestDeletePrefixLinks(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	hash, err := s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, s.Link([]byte("a"), hash))
+	n, err := s.DeletePrefix(nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, int64(0), s.RefCount(hash))
+	_, err = s.Get([]byte(hash))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// a value put again is reclaimed with its last link
+	_, err = s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, s.Link([]byte("b"), hash))
+	require.Nil(t, s.Unlink([]byte("b")))
+	_, err = s.Get([]byte(hash))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// a linked value is kept until its links are deleted
+	_, err = s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, s.Link([]byte("c"), hash))
+	n, err = s.DeletePrefix([]byte(hash[:1]))
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, int64(1), s.RefCount(hash))
+	_, err = s.Get([]byte(hash))
+	require.Nil(t, err)
+}
+
+func TestMergeFilterLinks(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MergeFilter = func(key []byte) bool {
+		return !strings.HasPrefix(string(key), linkPrefix+"gone/")
+	}
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	hash, err := s.PutContentAddressed([]byte("value"))
+	require.Nil(t, err)
+	other, err := s.PutContentAddressed([]byte("other value"))
+	require.Nil(t, err)
+	require.Nil(t, s.Link([]byte("gone/a"), hash))
+	require.Nil(t, s.Link([]byte("gone/b"), other))
+	require.Nil(t, s.Link([]byte("kept/b"), other))
+	require.Nil(t, s.Merge())
+
+	// dropped links release their values
+	_, err = s.LinkTarget([]byte("gone/a"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, int64(0), s.RefCount(hash))
+	_, err = s.Get([]byte(hash))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, int64(1), s.RefCount(other))
+	value, err := s.Get([]byte(other))
+	require.Nil(t, err)
+	require.Equal(t, []byte("other value"), value)
+
+	require.Nil(t, s.Close())
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	require.Equal(t, int64(1), s.RefCount(other))
+	_, err = s.Get([]byte(hash))
+	require.Equal(t, ErrKeyNotFound, err)
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"sort"
+	"time"
+)
+
+// scrubber verifies the immutable data files in the background, see Config.ScrubInterval
+type scrubber struct {
+	ticker  *time.Ticker
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// startScrubber starts scrubbing if ScrubInterval is set
+func (m *MKV) startScrubber() {
+	if m.config.ScrubInterval <= 0 {
+		return
+	}
+	m.scrubs = &scrubber{
+		ticker:  time.NewTicker(m.config.ScrubInterval),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go m.runScrubber()
+}
+
+func (m *MKV) runScrubber() {
+	c := m.scrubs
+	defer close(c.stopped)
+	for {
+		select {
+		case <-c.ticker.C:
+		case <-c.stop:
+			return
+		}
+		report, ok := m.scrub()
+		if !ok {
+			return
+		}
+		if m.config.OnScrub != nil {
+			m.config.OnScrub(report)
+		}
+	}
+}
+
+// stopScrubber stops runScrubber, a running pass stops at the next record
+func (m *MKV) stopScrubber() {
+	c := m.scrubs
+	if c == nil {
+		return
+	}
+	c.ticker.Stop()
+	close(c.stop)
+	<-c.stopped
+}
+
+// scrub verifies every immutable data file at up to MaxScrubMBPerSec, it reports
+// false if it was stopped. The read lock is only held while a record is read, so files
+// may be merged away meanwhile, the rest of such a file is skipped.
+func (m *MKV) scrub() (VerifyReport, bool) {
+	m.mutex.RLock()
+	files := make([]*DataFile, 0, len(m.dataFiles))
+	for _, df := range m.dataFiles {
+		files = append(files, df)
+	}
+	m.mutex.RUnlock()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID() < files[j].ID()
+	})
+	throttle := newThrottle(m.config.MaxScrubMBPerSec)
+	var report VerifyReport
+	for _, df := range files {
+		fileReport := newFileReport(df)
+		offset := int64(0)
+		for offset >= 0 {
+			select {
+			case <-m.scrubs.stop:
+				return report, false
+			default:
+			}
+			m.mutex.RLock()
+			if m.dataFiles[df.ID()] != df || offset >= df.Size() {
+				m.mutex.RUnlock()
+				break
+			}
+			next, err := verifyRecord(df, offset, &fileReport)
+			m.mutex.RUnlock()
+			if err != nil {
+				m.config.logger().Warnf("scrub data file %d error: %s", df.ID(), err)
+				break
+			}
+			if next > offset {
+				throttle.wait(next - offset)
+			}
+			offset = next
+		}
+		if fileReport.Corrupt > 0 {
+			m.config.logger().Warnf("scrub found %d corrupt records in data file %d, the first at offset %d", fileReport.Corrupt, df.ID(), fileReport.FirstCorruption)
+		}
+		report.Files = append(report.Files, fileReport)
+		report.Good += fileReport.Good
+		report.Corrupt += fileReport.Corrupt
+	}
+	return report, true
+}
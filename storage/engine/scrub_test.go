@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrub(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 10
+	config.ScrubInterval = 10 * time.Millisecond
+	reports := make(chan VerifyReport, 1)
+	config.OnScrub = func(report VerifyReport) {
+		select {
+		case reports <- report:
+		default:
+		}
+	}
+	logger := &recordLogger{}
+	config.Logger = logger
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; s.Stats().DataFiles < 3; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), make([]byte, 100))
+		require.Nil(t, err)
+	}
+	// wait for a pass started after the writes
+	<-reports
+	report := <-reports
+	require.Len(t, report.Files, 2)
+	require.Equal(t, int64(0), report.Corrupt)
+	require.True(t, report.Good > 0)
+
+	// flip a byte of a value in the first data file
+	file, err := os.OpenFile(s.dataFiles[0].Name(), os.O_RDWR, 0)
+	require.Nil(t, err)
+	_, err = file.WriteAt([]byte{1}, keyBegin+16+50)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	<-reports
+	report = <-reports
+	require.Equal(t, int64(1), report.Corrupt)
+	require.Equal(t, int64(1), report.Files[0].Corrupt)
+	require.Equal(t, int64(0), report.Files[0].FirstCorruption)
+	require.True(t, logger.find("WARN scrub found 1 corrupt records in data file 0"))
+
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestScrubCorruptHeader(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 1 << 10
+	config.ScrubInterval = 10 * time.Millisecond
+	reports := make(chan VerifyReport, 1)
+	config.OnScrub = func(report VerifyReport) {
+		select {
+		case reports <- report:
+		default:
+		}
+	}
+	config.Logger = &recordLogger{}
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	for i := 0; s.Stats().DataFiles < 3; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), make([]byte, 100))
+		require.Nil(t, err)
+	}
+
+	// the wide bit makes the sizes of the first record read as a huge value size,
+	// the record is reported instead of allocated
+	file, err := os.OpenFile(s.dataFiles[0].Name(), os.O_RDWR, 0)
+	require.Nil(t, err)
+	_, err = file.WriteAt([]byte{1 << bitWide}, 0)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	<-reports
+	report := <-reports
+	require.Equal(t, int64(1), report.Files[0].Corrupt)
+	require.Equal(t, int64(0), report.Files[0].FirstCorruption)
+	require.True(t, report.Files[1].Good > 0)
+}
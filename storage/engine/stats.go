@@ -0,0 +1,82 @@
+package engine
+
+import "math"
+
+// Stats summarizes the store and where its disk space goes
+type Stats struct {
+	Keys int `json:"keys"`
+	// LiveBytes is the size of the current records of all keys
+	LiveBytes int64 `json:"live_bytes"`
+	// OverheadBytes is the part of LiveBytes taken by record headers and checksums
+	OverheadBytes int64 `json:"overhead_bytes"`
+	// VersionBytes is the size of the older versions kept by MaxVersions
+	VersionBytes int64 `json:"version_bytes"`
+	DataFiles    int   `json:"data_files"`
+	// DiskBytes is the size of all data files
+	DiskBytes int64 `json:"disk_bytes"`
+	// GarbageBytes is the size of overwritten values and tombstones, it is
+	// DiskBytes less LiveBytes and VersionBytes
+	GarbageBytes int64 `json:"garbage_bytes"`
+	// ReusableBytes is the garbage counted towards the merge thresholds
+	ReusableBytes int64 `json:"reusable_bytes"`
+	// HintErrors counts the hint files which couldn't be written since open
+	HintErrors int64 `json:"hint_errors"`
+	// MergeRatioThreshold and MergeSpaceThreshold are the thresholds auto merging applies,
+	// they differ from the configured ones if AdaptiveMerge is set
+	MergeRatioThreshold float64 `json:"merge_ratio_threshold"`
+	MergeSpaceThreshold int64   `json:"merge_space_threshold"`
+}
+
+// Stats returns a summary of the store
+func (m *MKV) Stats() Stats {
+	ratio, space := m.mergeThresholds()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stats := Stats{
+		MergeRatioThreshold: ratio,
+		MergeSpaceThreshold: space,
+		Keys:                len(m.index),
+		DataFiles:           len(m.dataFiles),
+		ReusableBytes:       m.meta.ReusableSpace,
+		HintErrors:          m.hintErrors,
+	}
+	for key, entry := range m.index {
+		stats.LiveBytes += int64(entry.Size)
+		stats.OverheadBytes += recordOverhead(len(key), int64(entry.Size), m.config.CompactRecords)
+	}
+	if m.versions != nil {
+		for _, entries := range m.versions.entries {
+			for _, entry := range entries {
+				stats.VersionBytes += int64(entry.Size)
+			}
+		}
+	}
+	for _, df := range m.dataFiles {
+		stats.DiskBytes += df.Size()
+	}
+	if m.cur != nil {
+		stats.DataFiles++
+		stats.DiskBytes += m.cur.Size()
+	}
+	stats.GarbageBytes = stats.DiskBytes - stats.LiveBytes - stats.VersionBytes
+	return stats
+}
+
+// recordOverhead returns the size of the header and checksum of a record of size
+// bytes with a key of ksize bytes, records with values over 4GiB have a wider header.
+// Small records are taken to be compact if compact is set, records written before
+// CompactRecords was set are miscounted by the 4 bytes they are larger.
+func recordOverhead(ksize int, size int64, compact bool) int64 {
+	if compact && ksize <= MaxCompactSize && size-int64(ksize)-compactKeyBegin-checksumSize <= MaxCompactSize {
+		return compactKeyBegin + checksumSize
+	}
+	if size-int64(ksize)-wideKeyBegin-checksumSize > math.MaxUint32 {
+		return wideKeyBegin + checksumSize
+	}
+	return keyBegin + checksumSize
+}
+
+// RecordSize returns the size of the record a put of key and value appends
+func (m *MKV) RecordSize(key []byte, value []byte) int64 {
+	return newRecord(NormalFlag, key, value, m.config.CompactRecords).Size()
+}
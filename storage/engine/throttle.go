@@ -0,0 +1,44 @@
+package engine
+
+import "time"
+
+// throttle limits the rate of bytes written, a zero rate is unlimited
+type throttle struct {
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottle(mbPerSec int) *throttle {
+	return &throttle{
+		rate:  int64(mbPerSec) << 20,
+		start: time.Now(),
+	}
+}
+
+// wait records n written bytes and sleeps until the rate is kept
+func (t *throttle) wait(n int64) {
+	if t.rate <= 0 {
+		return
+	}
+	t.written += n
+	expected := time.Duration(t.written * int64(time.Second) / t.rate)
+	if elapsed := time.Since(t.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// inWindow reports whether now is in the daily window from start to end, both
+// offsets from local midnight, the window wraps past midnight if end is before start.
+// An empty window always matches.
+func inWindow(now time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
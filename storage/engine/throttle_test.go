@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInWindow(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2020, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	require.True(t, inWindow(at(12), 0, 0))
+	require.True(t, inWindow(at(3), 2*time.Hour, 5*time.Hour))
+	require.False(t, inWindow(at(5), 2*time.Hour, 5*time.Hour))
+	require.True(t, inWindow(at(23), 22*time.Hour, 2*time.Hour))
+	require.True(t, inWindow(at(1), 22*time.Hour, 2*time.Hour))
+	require.False(t, inWindow(at(12), 22*time.Hour, 2*time.Hour))
+}
+
+func TestThrottle(t *testing.T) {
+	start := time.Now()
+	throttle := newThrottle(1)
+	for i := 0; i < 4; i++ {
+		throttle.wait(1 << 16)
+	}
+	require.True(t, time.Since(start) >= 250*time.Millisecond)
+
+	start = time.Now()
+	throttle = newThrottle(0)
+	throttle.wait(1 << 30)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"io"
+	"sort"
+)
+
+// FileReport is the result of verifying one data file
+type FileReport struct {
+	ID      int    `json:"id"`
+	Path    string `json:"path"`
+	Good    int64  `json:"good"`
+	Corrupt int64  `json:"corrupt"`
+	// FirstCorruption is the offset of the first corrupt record, -1 if there is none
+	FirstCorruption int64 `json:"first_corruption"`
+}
+
+// VerifyReport is the result of verifying all data files
+type VerifyReport struct {
+	Files   []FileReport `json:"files"`
+	Good    int64        `json:"good"`
+	Corrupt int64        `json:"corrupt"`
+}
+
+// Verify reads every record of every data file and checks its checksum, it never
+// modifies the store. It holds the read lock, so writes wait until it is done.
+func (m *MKV) Verify() (VerifyReport, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	files := make([]*DataFile, 0, len(m.dataFiles)+1)
+	for _, df := range m.dataFiles {
+		files = append(files, df)
+	}
+	if m.cur != nil {
+		files = append(files, m.cur)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID() < files[j].ID()
+	})
+	var report VerifyReport
+	for _, df := range files {
+		fileReport, err := verifyDataFile(df)
+		if err != nil {
+			return report, err
+		}
+		report.Files = append(report.Files, fileReport)
+		report.Good += fileReport.Good
+		report.Corrupt += fileReport.Corrupt
+	}
+	return report, nil
+}
+
+func newFileReport(df *DataFile) FileReport {
+	return FileReport{
+		ID:              df.ID(),
+		Path:            df.Name(),
+		FirstCorruption: -1,
+	}
+}
+
+func verifyDataFile(df *DataFile) (FileReport, error) {
+	report := newFileReport(df)
+	offset := int64(0)
+	for offset >= 0 && offset < df.Size() {
+		var err error
+		if offset, err = verifyRecord(df, offset, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// verifyRecord checks the record at offset and counts it in report, it returns the
+// offset of the next record, or -1 if the rest of the file can't be parsed
+func verifyRecord(df *DataFile, offset int64, report *FileReport) (int64, error) {
+	corrupt := func() {
+		report.Corrupt++
+		if report.FirstCorruption < 0 {
+			report.FirstCorruption = offset
+		}
+	}
+	record, err := df.ReadRecordAt(offset)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the record sizes point past the end of the file
+			corrupt()
+			return -1, nil
+		}
+		return offset, err
+	}
+	if record.Corrupted() {
+		corrupt()
+	} else {
+		report.Good++
+	}
+	return offset + record.Size(), nil
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("%01024d", i)))
+		require.Nil(t, err)
+	}
+	report, err := s.Verify()
+	require.Nil(t, err)
+	require.Equal(t, int64(10), report.Good)
+	require.Equal(t, int64(0), report.Corrupt)
+	require.Equal(t, int64(-1), report.Files[0].FirstCorruption)
+	name := s.cur.Name()
+	err = s.Close()
+	require.Nil(t, err)
+
+	// flip a value byte of the third record
+	size := NewRecordWithoutChecksum(NormalFlag, make([]byte, 16), make([]byte, 1024)).Size()
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.Nil(t, err)
+	_, err = file.WriteAt([]byte("x"), 2*size+keyBegin+16)
+	require.Nil(t, err)
+	err = file.Close()
+	require.Nil(t, err)
+
+	config.ReadOnly = true
+	s, err = Open(config)
+	require.Nil(t, err)
+	report, err = s.Verify()
+	require.Nil(t, err)
+	require.Equal(t, int64(9), report.Good)
+	require.Equal(t, int64(1), report.Corrupt)
+	require.Equal(t, 2*size, report.Files[0].FirstCorruption)
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestVerifyCorruptHeader(t *testing.T) {
+	config := DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := Open(config)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := s.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("%01024d", i)))
+		require.Nil(t, err)
+	}
+	name := s.cur.Name()
+	err = s.Close()
+	require.Nil(t, err)
+
+	// the wide bit makes the sizes of the first record read as a huge value size
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.Nil(t, err)
+	flag := make([]byte, 1)
+	_, err = file.ReadAt(flag, 0)
+	require.Nil(t, err)
+	flag[0] |= 1 << bitWide
+	_, err = file.WriteAt(flag, 0)
+	require.Nil(t, err)
+	err = file.Close()
+	require.Nil(t, err)
+
+	config.ReadOnly = true
+	s, err = Open(config)
+	require.Nil(t, err)
+	defer s.Close()
+	report, err := s.Verify()
+	require.Nil(t, err)
+	require.Equal(t, int64(1), report.Corrupt)
+	require.Equal(t, int64(0), report.Files[0].FirstCorruption)
+}
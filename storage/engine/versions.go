@@ -0,0 +1,90 @@
+package engine
+
+// versions keeps the entries of overwritten values so they stay addressable,
+// a nil *versions means versioning is disabled and overwritten values are garbage
+type versions struct {
+	// max is the number of older versions kept per key
+	max int
+	// entries maps a key to its older entries, newest first
+	entries map[string][]*Entry
+}
+
+// newVersions returns nil unless maxVersions keeps more than the current version
+func newVersions(maxVersions int) *versions {
+	if maxVersions <= 1 {
+		return nil
+	}
+	return &versions{
+		max:     maxVersions - 1,
+		entries: make(map[string][]*Entry),
+	}
+}
+
+// retire keeps old as the newest older version of key, it returns the size of
+// the entries which are no longer kept
+func (v *versions) retire(key string, old *Entry) int64 {
+	if v == nil {
+		return int64(old.Size)
+	}
+	entries := append([]*Entry{old}, v.entries[key]...)
+	var dropped int64
+	for _, entry := range entries[min(len(entries), v.max):] {
+		dropped += int64(entry.Size)
+	}
+	v.entries[key] = entries[:min(len(entries), v.max)]
+	return dropped
+}
+
+// drop forgets all older versions of key and returns their size
+func (v *versions) drop(key string) int64 {
+	if v == nil {
+		return 0
+	}
+	var dropped int64
+	for _, entry := range v.entries[key] {
+		dropped += int64(entry.Size)
+	}
+	delete(v.entries, key)
+	return dropped
+}
+
+// dropUpTo forgets the older versions of key in data files up to last
+func (v *versions) dropUpTo(key string, last int) {
+	if v == nil {
+		return
+	}
+	var kept []*Entry
+	for _, entry := range v.entries[key] {
+		if int(entry.ID) > last {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		delete(v.entries, key)
+		return
+	}
+	v.entries[key] = kept
+}
+
+// get returns the nth older version of key, 1 is the newest
+func (v *versions) get(key string, n int) (*Entry, bool) {
+	if v == nil || n < 1 || n > len(v.entries[key]) {
+		return nil, false
+	}
+	return v.entries[key][n-1], true
+}
+
+// list returns the older versions of key, newest first
+func (v *versions) list(key string) []*Entry {
+	if v == nil {
+		return nil
+	}
+	return v.entries[key]
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
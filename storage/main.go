@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
+	"mos/internal/etcdutil"
 	"mos/storage/engine"
 	"mos/storage/server"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,8 +26,22 @@ import (
 )
 
 var (
-	port = flag.Int("port", 8080, "http listening port")
-	dir  = flag.String("dir", "", "storage root directory")
+	port         = flag.Int("port", 8080, "http listening port")
+	dir          = flag.String("dir", "", "storage root directory")
+	adminToken   = flag.String("admin-token", "", "token for admin endpoints, they are disabled if empty")
+	etcdTimeout  = flag.Duration("etcd-timeout", time.Minute, "how long to wait for etcd before giving up registering")
+	advertise    = flag.String("advertise", "", "address:port the proxy reaches this node at, autodetected if empty")
+	readTimeout  = flag.Duration("read-timeout", 0, "timeout of read requests, 0 means none")
+	writeTimeout = flag.Duration("write-timeout", 0, "timeout of write requests, 0 means none")
+	ttl          = flag.Duration("ttl", 10*time.Second, "lease ttl of the node registration in etcd, rounded down to seconds")
+	indexFlush   = flag.Duration("index-flush-interval", 0, "how often the index is saved so a crash replays less, 0 means only on close")
+	readOnly     = flag.Bool("readonly", false, "open the store read only and reject writes with 405")
+	configFile   = flag.String("config", "", "json config file of the store, MOS_ environment variables override it and flags override both")
+	accessLog    = flag.Bool("access-log", false, "log every request with its request ID")
+	gzipMinSize  = flag.Int64("gzip-min-size", 0, "compress GET responses of at least this size for clients accepting gzip, 0 means never")
+	maxRequests  = flag.Int("max-concurrent-requests", 0, "requests in flight beyond which requests get 503, 0 means unlimited")
+	userRate     = flag.Float64("user-rate", 0, "requests per second of a user beyond which requests get 429, 0 means unlimited")
+	userBurst    = flag.Int("user-burst", 0, "requests a user may send at once, 0 means the user rate")
 )
 
 var endpointPrefix = "/storage_node/"
@@ -36,17 +56,73 @@ var etcdCfg = clientv3.Config{
 	DialKeepAliveTimeout: time.Second * 30,
 }
 
+// commands are run as "storage <command> [flags]", without a command the server is run
+var commands = map[string]func(args []string) int{
+	"serve":   serve,
+	"verify":  verify,
+	"export":  export,
+	"import":  importStore,
+	"merge":   merge,
+	"migrate": migrate,
+	"stats":   stats,
+}
+
 func main() {
-	flag.Parse()
-	config := engine.DefaultConfig()
-	if *dir != "" {
-		config.RootDirectory = *dir
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, ok := commands[args[0]]
+		if !ok {
+			names := make([]string, 0, len(commands))
+			for name := range commands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(os.Stderr, "unknown command %s, commands are %s\n", args[0], strings.Join(names, ", "))
+			os.Exit(2)
+		}
+		args = args[1:]
+		os.Exit(command(args))
+	}
+	os.Exit(serve(args))
+}
+
+// serve runs the storage node until it gets a signal to exit
+func serve(args []string) int {
+	flag.CommandLine.Parse(args)
+	if *ttl < time.Second {
+		log.Fatalf("ttl %s is less than 1s", *ttl)
 	}
+	// nodes must not share the jitter of their retries
+	rand.Seed(time.Now().UnixNano())
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	// only flags given explicitly override the config file and the environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dir":
+			config.RootDirectory = *dir
+		case "index-flush-interval":
+			config.IndexFlushInterval = *indexFlush
+		case "readonly":
+			config.ReadOnly = *readOnly
+		}
+	})
 	s, err := server.NewServer(config)
 	if err != nil {
 		panic(err)
 	}
 	defer s.Close()
+	s.AdminToken = *adminToken
+	s.ReadTimeout = *readTimeout
+	s.WriteTimeout = *writeTimeout
+	s.AccessLog = *accessLog
+	s.GzipMinSize = *gzipMinSize
+	s.MaxConcurrentRequests = *maxRequests
+	s.UserRate = *userRate
+	s.UserBurst = *userBurst
 	router := s.SetRouter()
 	pprof.Register(router)
 	srv := &http.Server{
@@ -59,71 +135,362 @@ func main() {
 			log.Println(err)
 		}
 	}()
-	go ServiceRegistry(*port)
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
+	registry := &Registry{}
+	go func() {
+		endpoint, err := advertiseAddress(*port)
+		if err == nil {
+			err = registry.Run(endpoint)
+		}
+		if err != nil {
+			// an unregistered node gets no traffic, shut it down
+			log.Println(err)
+			sigCh <- syscall.SIGTERM
+		}
+	}()
 	sig := <-sigCh
 	log.Println(fmt.Sprintf("Got signal [%s] to exit.", sig))
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	// deregister first so the proxy stops routing here immediately
+	if err := registry.Deregister(ctx); err != nil {
+		log.Println("deregister error: ", err)
+	}
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal("Server forced to shutdown: ", err)
 	}
 	log.Println("Server shutdown")
+	return 0
 }
 
-func ServiceRegistry(port int) {
-	addrs, err := net.InterfaceAddrs()
+// loadConfig reads the config file if path is set and applies the environment
+func loadConfig(path string) (*engine.Config, error) {
+	config := engine.DefaultConfig()
+	if path != "" {
+		var err error
+		config, err = engine.LoadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := config.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// commandFlags returns the flags of a command working on a store
+func commandFlags(name string) (flags *flag.FlagSet, dir *string, config *string) {
+	flags = flag.NewFlagSet(name, flag.ExitOnError)
+	dir = flags.String("dir", "", "storage root directory")
+	config = flags.String("config", "", "json config file of the store")
+	return flags, dir, config
+}
+
+// openEngine opens the store of a command, dir overrides the root directory if set
+func openEngine(configFile string, dir string, readOnly bool) (*engine.MKV, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		config.RootDirectory = dir
+	}
+	config.ReadOnly = readOnly
+	return engine.Open(config)
+}
+
+// verify checks all records of a store opened read only, it is run as
+// "storage verify -dir <dir>" and exits with 1 if a corrupt record is found
+func verify(args []string) int {
+	flags, dir, config := commandFlags("verify")
+	flags.Parse(args)
+	e, err := openEngine(*config, *dir, true)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	defer e.Close()
+	report, err := e.Verify()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	for _, file := range report.Files {
+		if file.Corrupt > 0 {
+			fmt.Printf("%s: %d good, %d corrupt, first corruption at offset %d\n", file.Path, file.Good, file.Corrupt, file.FirstCorruption)
+		} else {
+			fmt.Printf("%s: %d good\n", file.Path, file.Good)
+		}
+	}
+	fmt.Printf("%d good, %d corrupt records\n", report.Good, report.Corrupt)
+	if report.Corrupt > 0 {
+		return 1
+	}
+	return 0
+}
+
+// export writes the current value of every key of a store opened read only to
+// a file, it is run as "storage export -dir <dir> -out <file>"
+func export(args []string) int {
+	flags, dir, config := commandFlags("export")
+	out := flags.String("out", "", "file to export to, stdout if empty")
+	flags.Parse(args)
+	e, err := openEngine(*config, *dir, true)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer e.Close()
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	written, err := e.Export(w)
+	if err == nil && w != os.Stdout {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("exported %d bytes", written)
+	return 0
+}
+
+// importStore puts all keys of an export into a store, it is run as
+// "storage import -dir <dir> -in <file>"
+func importStore(args []string) int {
+	flags, dir, config := commandFlags("import")
+	in := flags.String("in", "", "file to import from, stdin if empty")
+	flags.Parse(args)
+	r := os.Stdin
+	if *in != "" {
+		var err error
+		r, err = os.Open(*in)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer r.Close()
+	}
+	e, err := openEngine(*config, *dir, false)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	imported, err := e.Import(bufio.NewReader(r))
+	if cerr := e.Close(); err == nil {
+		err = cerr
+	}
+	log.Printf("imported %d keys", imported)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// merge merges all data files of a store, it is run as "storage merge -dir <dir>"
+func merge(args []string) int {
+	flags, dir, config := commandFlags("merge")
+	flags.Parse(args)
+	e, err := openEngine(*config, *dir, false)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	err = e.Merge()
+	if cerr := e.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// migrate rewrites a store in a newer format, it is run as
+// "storage migrate -dir <dir> [-to <version>]"
+func migrate(args []string) int {
+	flags, dir, config := commandFlags("migrate")
+	to := flags.Int("to", engine.FormatVersion, "format version to migrate to")
+	flags.Parse(args)
+	e, err := openEngine(*config, *dir, false)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	err = e.Migrate(*to)
+	if cerr := e.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// stats prints a summary of a store opened read only as json, it is run as
+// "storage stats -dir <dir>"
+func stats(args []string) int {
+	flags, dir, config := commandFlags("stats")
+	flags.Parse(args)
+	e, err := openEngine(*config, *dir, true)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer e.Close()
+	b, err := json.MarshalIndent(e.Stats(), "", "  ")
 	if err != nil {
 		log.Println(err)
-		return
+		return 1
+	}
+	fmt.Println(string(b))
+	return 0
+}
+
+// advertiseAddress returns the address the proxy reaches this node at, the
+// -advertise flag if set, else the first non loopback IPv4 address
+func advertiseAddress(port int) (string, error) {
+	if *advertise != "" {
+		if _, _, err := net.SplitHostPort(*advertise); err != nil {
+			return "", err
+		}
+		return *advertise, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
 	}
-	var endpoint string
 	for _, address := range addrs {
 		// 检查ip地址判断是否回环地址
 		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
-				endpoint = fmt.Sprintf("%s:%d", ipnet.IP.String(), port)
-				break
+				return fmt.Sprintf("%s:%d", ipnet.IP.String(), port), nil
 			}
 		}
 	}
-	cli, err := clientv3.New(etcdCfg)
-	if err != nil {
-		panic(err)
+	return "", fmt.Errorf("no non loopback IPv4 address to advertise, use -advertise")
+}
+
+// Registry registers the node in etcd under a lease and keeps it alive
+type Registry struct {
+	mutex   sync.Mutex
+	client  *clientv3.Client
+	key     string
+	leaseID clientv3.LeaseID
+	stopped bool
+}
+
+// Run registers the node and keeps the lease alive until the node is
+// deregistered. The first registration gives up after -etcd-timeout, a lost
+// lease is granted again for as long as it takes, so a node cut off from etcd
+// for a while registers again once etcd is reachable instead of staying gone.
+func (r *Registry) Run(endpoint string) error {
+	for registered := false; ; registered = true {
+		timeout := *etcdTimeout
+		if registered {
+			timeout = 0
+		}
+		var klRes <-chan *clientv3.LeaseKeepAliveResponse
+		err := etcdutil.Retry("register service", timeout, func() error {
+			var err error
+			klRes, err = r.register(endpoint)
+			return err
+		})
+		if err != nil || klRes == nil {
+			return err
+		}
+		if registered {
+			r.mutex.Lock()
+			log.Printf("registered %s again under lease %x", endpoint, r.leaseID)
+			r.mutex.Unlock()
+		}
+		// 监听续约情况, the client renews every ttl/3
+		for v := range klRes {
+			b, _ := json.Marshal(v)
+			fmt.Printf("keep lease alive suucess: %s\n", string(b))
+		}
+		r.mutex.Lock()
+		stopped := r.stopped
+		r.mutex.Unlock()
+		if stopped {
+			log.Println("stop keeping lease alive")
+			return nil
+		}
+		log.Println("lease lost, registering again")
 	}
-	key := endpointPrefix + endpoint
-	ctx := context.Background()
-	ttl := 3
+}
+
+// register grants a lease, puts the endpoint under it and starts keeping it
+// alive, it returns a nil channel if the node is deregistered
+func (r *Registry) register(endpoint string) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return nil, nil
+	}
+	if r.client == nil {
+		cli, err := clientv3.New(etcdCfg)
+		if err != nil {
+			return nil, err
+		}
+		r.client = cli
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdutil.RequestTimeout)
+	defer cancel()
 	// 创建租约
-	lease, err := cli.Grant(ctx, int64(ttl))
+	lease, err := r.client.Grant(ctx, int64(ttl.Seconds()))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	b, _ := json.Marshal(lease)
 	log.Printf("grant lease suucess: %s\n", string(b))
 	// 通过租约上报endpoint
-	res, err := cli.Put(ctx, key, endpoint, clientv3.WithLease(lease.ID))
+	key := endpointPrefix + endpoint
+	res, err := r.client.Put(ctx, key, endpoint, clientv3.WithLease(lease.ID))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	b, _ = json.Marshal(res)
 	log.Printf("put kv with lease suucess: %s\n", string(b))
+	r.key = key
+	r.leaseID = lease.ID
 	// 保持租约不过期
-	klRes, err := cli.KeepAlive(ctx, lease.ID)
-	if err != nil {
-		panic(err)
+	return r.client.KeepAlive(context.Background(), lease.ID)
+}
+
+// Deregister revokes the lease and deletes the key, so the proxy removes the
+// node at once instead of waiting for the lease to expire
+func (r *Registry) Deregister(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopped = true
+	if r.client == nil {
+		return nil
+	}
+	defer r.client.Close()
+	if r.leaseID == clientv3.NoLease {
+		return nil
 	}
-	// 监听续约情况
-	for v := range klRes {
-		b, _ = json.Marshal(v)
-		fmt.Printf("keep lease alive suucess: %s\n", string(b))
+	if _, err := r.client.Delete(ctx, r.key); err != nil {
+		return err
 	}
-	log.Println("stop keeping lease alive")
+	_, err := r.client.Revoke(ctx, r.leaseID)
+	return err
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"mos/storage/engine"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Objects outside a bucket are stored under username_objectname, usernames contain no
+// _, so keys split at the first _ into user and object. Objects in a bucket are stored
+// under username_bucket//objectname with _, / and % escaped in username and bucket, as
+// usernames can't contain a slash and object names never do, no other key contains a
+// double slash, so bucket keys clash neither with other buckets nor with objects outside
+// buckets or their chunks.
+var keyPartEscaper = strings.NewReplacer("%", "%25", "_", "%5F", "/", "%2F")
+var keyPartUnescaper = strings.NewReplacer("%25", "%", "%5F", "_", "%2F", "/")
+
+const bucketSeparator = "//"
+
+func objectKey(username string, objectname string) string {
+	return username + "_" + objectname
+}
+
+// bucketPrefix is the prefix of the keys of all objects in bucket
+func bucketPrefix(username string, bucket string) string {
+	return keyPartEscaper.Replace(username) + "_" + keyPartEscaper.Replace(bucket) + bucketSeparator
+}
+
+func bucketKey(username string, bucket string, objectname string) string {
+	return bucketPrefix(username, bucket) + objectname
+}
+
+// parseKey splits key into its username, bucket and the rest, which is the object name
+// followed by the chunk suffix for chunks and manifests. bucket is empty for objects
+// outside a bucket.
+func parseKey(key string) (username string, bucket string, rest string, ok bool) {
+	prefix, rest, found := strings.Cut(key, bucketSeparator)
+	if found {
+		username, bucket, ok = strings.Cut(prefix, "_")
+		return keyPartUnescaper.Replace(username), keyPartUnescaper.Replace(bucket), rest, ok
+	}
+	username, rest, ok = strings.Cut(key, "_")
+	return username, "", rest, ok
+}
+
+// requestUser returns the user of a request, it responds with 400 if the request has no
+// user or one whose name can't be part of a key
+func requestUser(ctx *gin.Context) (string, bool) {
+	username := ctx.GetHeader("x-mos-username")
+	if username == "" {
+		renderError(ctx, http.StatusBadRequest, CodeEmptyUserName, "empty user name")
+		return "", false
+	}
+	if strings.ContainsAny(username, "/_") {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidUserName, "user name contains a slash or an underscore")
+		return "", false
+	}
+	return username, true
+}
+
+// requestKey returns the key and name of the object a request is for, objects in a bucket
+// are routed as /:objectname/:name, since gin needs one wildcard name per path segment.
+// It responds with 400 if the request names no valid object.
+func requestKey(ctx *gin.Context) (key string, objectname string, ok bool) {
+	username, ok := requestUser(ctx)
+	if !ok {
+		return "", "", false
+	}
+	objectname = ctx.Param("objectname")
+	bucket := ""
+	if name := ctx.Param("name"); name != "" {
+		bucket, objectname = objectname, name
+	}
+	if objectname == "" {
+		renderError(ctx, http.StatusBadRequest, CodeEmptyObjectName, "empty object name")
+		return "", "", false
+	}
+	if bucket != "" {
+		return bucketKey(username, bucket, objectname), objectname, true
+	}
+	return objectKey(username, objectname), objectname, true
+}
+
+// sourceKey returns the key of the object named by x-mos-copy-source, an object name
+// or bucket/objectname of the user of the request
+func sourceKey(ctx *gin.Context) (string, bool) {
+	source := ctx.GetHeader("x-mos-copy-source")
+	username := ctx.GetHeader("x-mos-username")
+	bucket, objectname, found := strings.Cut(source, "/")
+	if !found {
+		bucket, objectname = "", source
+	}
+	if objectname == "" || strings.Contains(objectname, "/") || (found && bucket == "") {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidCopySource, "invalid copy source")
+		return "", false
+	}
+	if bucket != "" {
+		return bucketKey(username, bucket, objectname), true
+	}
+	return objectKey(username, objectname), true
+}
+
+// listBucketHandler lists the names of the objects in a bucket in order, it is routed
+// as /:objectname/ since /:objectname names an object outside a bucket
+func (s *Server) listBucketHandler(ctx *gin.Context) {
+	username, ok := requestUser(ctx)
+	if !ok {
+		return
+	}
+	prefix := bucketPrefix(username, ctx.Param("objectname"))
+	names := make([]string, 0)
+	err := s.Engine.Scan(prefix, func(key string, entry *engine.Entry) error {
+		name := strings.TrimPrefix(key, prefix)
+		// chunks are part of the object their manifest describes
+		if strings.HasSuffix(name, manifestSuffix) {
+			name = strings.TrimSuffix(name, manifestSuffix)
+		} else if strings.Contains(name, "/") {
+			return nil
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		renderEngineError(ctx, "list bucket error", err)
+		return
+	}
+	// manifests sort after names starting with the object name and a character below /
+	sort.Strings(names)
+	ctx.JSON(http.StatusOK, names)
+}
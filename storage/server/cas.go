@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io"
+	"mos/storage/engine"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CASResponse names a content addressed object by the hex SHA-256 of its content
+type CASResponse struct {
+	Hash string `json:"hash"`
+}
+
+// putContentHandler stores the request body as a content addressed object, POST /cas
+// returns its hash, an object stored already isn't written again. Content addressed
+// objects are shared by all users and can't be deleted.
+func (s *Server) putContentHandler(ctx *gin.Context) {
+	limit := s.Engine.MaxValueSize()
+	if limit > 0 && ctx.Request.ContentLength > limit {
+		renderError(ctx, http.StatusRequestEntityTooLarge, CodeObjectTooLarge, "object too large")
+		return
+	}
+	var body io.Reader = ctx.Request.Body
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	value, err := io.ReadAll(body)
+	if err != nil {
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "read object content error: %s", err.Error())
+		return
+	}
+	hash, err := s.Engine.PutContentAddressedCtx(ctx.Request.Context(), value)
+	if err != nil {
+		renderEngineError(ctx, "store object error", err)
+		return
+	}
+	s.setVersion(ctx)
+	ctx.JSON(http.StatusOK, &CASResponse{Hash: hash})
+}
+
+// getContentHandler returns the content addressed object of GET /cas/:hash
+func (s *Server) getContentHandler(ctx *gin.Context) {
+	hash := ctx.Param("hash")
+	if !engine.IsContentHash(hash) {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidRequest, "invalid hash %q", hash)
+		return
+	}
+	value, err := s.Engine.GetCtx(ctx.Request.Context(), []byte(hash))
+	if err == engine.ErrKeyNotFound {
+		renderError(ctx, http.StatusNotFound, CodeNotFound, "object not found")
+		return
+	}
+	if err != nil {
+		renderEngineError(ctx, "get object error", err)
+		return
+	}
+	// the hash is a strong validator of the content
+	ctx.Header("ETag", `"`+hash+`"`)
+	ctx.Data(http.StatusOK, "application/octet-stream", value)
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mos/storage/engine"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// DefaultChunkSize is the size of the chunks large objects are split into
+const DefaultChunkSize = 4 << 20
+
+// manifest lists the chunks of an object stored in chunks, it is stored under
+// the manifest key of the object instead of the object itself. All chunks but the
+// last one hold ChunkSize bytes, manifests written before it was kept lack it.
+type manifest struct {
+	Size      int64             `json:"size"`
+	ChunkSize int64             `json:"chunk_size,omitempty"`
+	Chunks    []string          `json:"chunks"`
+	Meta      map[string]string `json:"meta,omitempty"`
+}
+
+const manifestSuffix = "/manifest"
+
+func manifestKey(key string) string {
+	return key + manifestSuffix
+}
+
+// chunkKey names chunk n of an upload, object names never contain a slash, so
+// chunk keys can't clash with objects. Each upload has its own chunks, so a failed
+// upload never touches the chunks of the object it would replace.
+func chunkKey(key string, upload int64, n int) string {
+	return fmt.Sprintf("%s/%x/chunk%d", key, upload, n)
+}
+
+// putChunked stores head followed by the rest of body in chunks, the object replaces
+// any object stored under key once its manifest is written, which holds meta too. With
+// createOnly it fails with errObjectExists instead if there is an object under key.
+func (s *Server) putChunked(ctx context.Context, key string, head []byte, body io.Reader, flag byte, meta map[string]string, createOnly bool) (int64, error) {
+	upload := time.Now().UnixNano()
+	reader := io.MultiReader(bytes.NewReader(head), body)
+	buf := make([]byte, s.ChunkSize)
+	m := manifest{ChunkSize: s.ChunkSize, Meta: meta}
+	var stored int64
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			s.deleteChunks(ctx, m.Chunks)
+			return 0, err
+		}
+		chunk := chunkKey(key, upload, len(m.Chunks))
+		size, perr := s.Engine.PutNCtx(ctx, []byte(chunk), buf[:n])
+		if perr != nil {
+			s.deleteChunks(ctx, m.Chunks)
+			return 0, perr
+		}
+		m.Chunks = append(m.Chunks, chunk)
+		m.Size += int64(n)
+		stored += size
+		if s.Engine.MaxValueSize() > 0 && m.Size > s.Engine.MaxValueSize() {
+			s.deleteChunks(ctx, m.Chunks)
+			return 0, engine.ErrValueTooLarge
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	old, err := s.getManifest(ctx, key)
+	if err != nil && err != engine.ErrKeyNotFound {
+		s.deleteChunks(ctx, m.Chunks)
+		return 0, err
+	}
+	value, err := json.Marshal(&m)
+	if err != nil {
+		s.deleteChunks(ctx, m.Chunks)
+		return 0, err
+	}
+	var size int64
+	if createOnly {
+		var written bool
+		written, err = s.Engine.PutIfAbsentCtx(ctx, []byte(manifestKey(key)), value, flag, []byte(key))
+		if err == nil && !written {
+			err = errObjectExists
+		}
+		size = s.Engine.RecordSize([]byte(manifestKey(key)), value)
+	} else {
+		size, err = s.Engine.PutNCtxWithFlag(ctx, []byte(manifestKey(key)), value, flag)
+	}
+	if err != nil {
+		s.deleteChunks(ctx, m.Chunks)
+		return 0, err
+	}
+	if err := s.Engine.DeleteCtx(ctx, []byte(key)); err != nil && err != engine.ErrKeyNotFound {
+		return 0, err
+	}
+	if old != nil {
+		s.deleteChunks(ctx, old.Chunks)
+	}
+	return stored + size, nil
+}
+
+func (s *Server) getManifest(ctx context.Context, key string) (*manifest, error) {
+	value, err := s.Engine.GetCtx(ctx, []byte(manifestKey(key)))
+	if err != nil {
+		return nil, err
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(value, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// deleteChunks removes chunks, errors are logged only as the chunks are unreachable anyway
+func (s *Server) deleteChunks(ctx context.Context, chunks []string) {
+	for _, chunk := range chunks {
+		if err := s.Engine.DeleteCtx(ctx, []byte(chunk)); err != nil && err != engine.ErrKeyNotFound {
+			log.Printf("request_id=%s delete chunk %s error: %s", requestIDOf(ctx), chunk, err)
+		}
+	}
+}
+
+// deleteChunked removes the object stored in chunks under key if cond accepts its manifest,
+// cond may be nil
+func (s *Server) deleteChunked(ctx context.Context, key string, cond func(*engine.ObjectInfo) error) error {
+	m, err := s.getManifest(ctx, key)
+	if err != nil {
+		return err
+	}
+	if cond == nil {
+		err = s.Engine.DeleteCtx(ctx, []byte(manifestKey(key)))
+	} else {
+		err = s.Engine.DeleteIf(ctx, []byte(manifestKey(key)), cond)
+	}
+	if err != nil {
+		return err
+	}
+	s.deleteChunks(ctx, m.Chunks)
+	return nil
+}
+
+// getChunked serves the object stored in chunks under key like a single value, with
+// ranges and conditional requests
+func (s *Server) getChunked(ctx *gin.Context, objectname string, key string) {
+	value, info, err := s.Engine.GetWithInfo(ctx.Request.Context(), []byte(manifestKey(key)))
+	if err != nil {
+		if err == engine.ErrKeyNotFound {
+			renderError(ctx, http.StatusNotFound, CodeNotFound, "object not found")
+			return
+		}
+		renderEngineError(ctx, "get object error", err)
+		return
+	}
+	var m manifest
+	if err := json.Unmarshal(value, &m); err != nil {
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "get object error: %s", err.Error())
+		return
+	}
+	if m.ChunkSize == 0 && len(m.Chunks) > 1 {
+		// the chunks of older manifests are as large as the first one
+		_, size, _, err := s.Engine.OpenReaderAtWithInfo(ctx.Request.Context(), []byte(m.Chunks[0]))
+		if err != nil {
+			renderEngineError(ctx, "get object error", err)
+			return
+		}
+		m.ChunkSize = size
+	}
+	setMetaHeaders(ctx, m.Meta)
+	s.setObjectHeaders(ctx, info)
+	r := &chunkReader{ctx: ctx.Request.Context(), engine: s.Engine, m: &m, loaded: -1}
+	http.ServeContent(ctx.Writer, ctx.Request, objectname, info.ModTime, r)
+	if r.err != nil {
+		// the status is sent already, the client sees a short body
+		log.Printf("request_id=%s get chunk error: %s", requestIDOf(ctx.Request.Context()), r.err)
+		ctx.Abort()
+	}
+}
+
+// chunkReader reads the object of a manifest as one stream, the chunk read last is kept
+type chunkReader struct {
+	ctx    context.Context
+	engine *engine.MKV
+	m      *manifest
+	offset int64
+	loaded int
+	chunk  []byte
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.m.Size {
+		return 0, io.EOF
+	}
+	n := 0
+	if r.m.ChunkSize > 0 {
+		n = int(r.offset / r.m.ChunkSize)
+	}
+	if n >= len(r.m.Chunks) {
+		r.err = errors.Errorf("manifest of %d bytes lists %d chunks", r.m.Size, len(r.m.Chunks))
+		return 0, r.err
+	}
+	if n != r.loaded {
+		chunk, err := r.engine.GetCtx(r.ctx, []byte(r.m.Chunks[n]))
+		if err != nil {
+			r.err = errors.Wrapf(err, "get chunk %s error", r.m.Chunks[n])
+			return 0, r.err
+		}
+		r.loaded, r.chunk = n, chunk
+	}
+	start := r.offset - int64(n)*r.m.ChunkSize
+	if start >= int64(len(r.chunk)) {
+		r.err = errors.Errorf("chunk %s is shorter than the manifest says", r.m.Chunks[n])
+		return 0, r.err
+	}
+	read := copy(p, r.chunk[start:])
+	r.offset += int64(read)
+	return read, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.m.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// copyChunked copies the object stored in chunks under src to dst, the chunks are copied
+// too since deleting either object deletes its chunks. A move only moves the manifest.
+func (s *Server) copyChunked(ctx context.Context, src string, dst string, move bool) error {
+	value, info, err := s.Engine.GetWithInfo(ctx, []byte(manifestKey(src)))
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err := json.Unmarshal(value, &m); err != nil {
+		return err
+	}
+	old, err := s.getManifest(ctx, dst)
+	if err != nil && err != engine.ErrKeyNotFound {
+		return err
+	}
+	if move {
+		err = s.Engine.MoveCtx(ctx, []byte(manifestKey(src)), []byte(manifestKey(dst)))
+	} else {
+		err = s.copyChunks(ctx, &m, dst, info.UserFlag)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.Engine.DeleteCtx(ctx, []byte(dst)); err != nil && err != engine.ErrKeyNotFound {
+		return err
+	}
+	if old != nil {
+		s.deleteChunks(ctx, old.Chunks)
+	}
+	return nil
+}
+
+// copyChunks copies the chunks of m to a new upload of dst and writes its manifest
+func (s *Server) copyChunks(ctx context.Context, m *manifest, dst string, flag byte) error {
+	upload := time.Now().UnixNano()
+	copied := manifest{Size: m.Size, ChunkSize: m.ChunkSize, Meta: m.Meta}
+	for i, chunk := range m.Chunks {
+		key := chunkKey(dst, upload, i)
+		if err := s.Engine.CopyCtx(ctx, []byte(chunk), []byte(key)); err != nil {
+			s.deleteChunks(ctx, copied.Chunks)
+			return err
+		}
+		copied.Chunks = append(copied.Chunks, key)
+	}
+	value, err := json.Marshal(&copied)
+	if err != nil {
+		s.deleteChunks(ctx, copied.Chunks)
+		return err
+	}
+	if _, err := s.Engine.PutNCtxWithFlag(ctx, []byte(manifestKey(dst)), value, flag); err != nil {
+		s.deleteChunks(ctx, copied.Chunks)
+		return err
+	}
+	return nil
+}
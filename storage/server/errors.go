@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"mos/storage/engine"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Codes of error responses, they are stable so clients can branch on them
+// rather than on messages
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeEmptyUserName      = "empty_user_name"
+	CodeInvalidUserName    = "invalid_user_name"
+	CodeEmptyObjectName    = "empty_object_name"
+	CodeUnknownObjectType  = "unknown_object_type"
+	CodeInvalidCopySource  = "invalid_copy_source"
+	CodeInvalidVersion     = "invalid_version"
+	CodeObjectTooLarge     = "object_too_large"
+	CodeKeyTooLarge        = "key_too_large"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeObjectExists       = "object_exists"
+	CodeObjectChunked      = "object_chunked"
+	CodePreconditionFailed = "precondition_failed"
+	CodeVersionNotReached  = "version_not_reached"
+	CodeMergeInProgress    = "merge_in_progress"
+	CodeForbidden          = "forbidden"
+	CodeUnavailable        = "unavailable"
+	CodeOverloaded         = "overloaded"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeInternal           = "internal"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newErrorDetail(code string, format string, args ...interface{}) *ErrorDetail {
+	return &ErrorDetail{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// renderError responds with status and an ErrorResponse
+func renderError(ctx *gin.Context, status int, code string, format string, args ...interface{}) {
+	ctx.JSON(status, &ErrorResponse{Error: *newErrorDetail(code, format, args...)})
+}
+
+// renderEngineError responds with the status and code err maps to, message describes
+// what failed
+func renderEngineError(ctx *gin.Context, message string, err error) {
+	renderError(ctx, errorStatus(err), errorCode(err), "%s: %s", message, err.Error())
+}
+
+// errorStatus maps engine errors to a status code, a request given up on
+// because of its context is unavailable rather than failed
+func errorStatus(err error) int {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return http.StatusServiceUnavailable
+	}
+	if err == engine.ErrValueTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	if err == engine.ErrKeyTooLarge {
+		return http.StatusBadRequest
+	}
+	if err == errObjectExists {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// errorCode maps engine errors to the code of their status
+func errorCode(err error) string {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return CodeUnavailable
+	}
+	if err == engine.ErrValueTooLarge {
+		return CodeObjectTooLarge
+	}
+	if err == engine.ErrKeyTooLarge {
+		return CodeKeyTooLarge
+	}
+	if err == errObjectExists {
+		return CodeObjectExists
+	}
+	return CodeInternal
+}
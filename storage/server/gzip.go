@@ -0,0 +1,104 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipWriter compresses the body if the response turns out to be worth it, which is
+// only known once the handler starts writing it
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int64
+	gz      *gzip.Writer
+	decided bool
+}
+
+// gzip compresses GET responses for clients accepting gzip, if GzipMinSize is set
+func (s *Server) gzip(ctx *gin.Context) {
+	if s.GzipMinSize <= 0 || ctx.Request.Method != http.MethodGet || !acceptsGzip(ctx.GetHeader("Accept-Encoding")) {
+		ctx.Next()
+		return
+	}
+	w := &gzipWriter{ResponseWriter: ctx.Writer, minSize: s.GzipMinSize}
+	ctx.Writer = w
+	defer w.close()
+	ctx.Header("Vary", "Accept-Encoding")
+	ctx.Next()
+}
+
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+	return false
+}
+
+// compress reports whether a response with status code is compressed, responses which are
+// encoded already, small or of a compressed media type are sent as they are
+func (w *gzipWriter) compress(code int) bool {
+	header := w.Header()
+	if code != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || n < w.minSize {
+			return false
+		}
+	}
+	contentType := header.Get("Content-Type")
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write decides on the first write whether to compress, gin sends the status and
+// headers only then, and renderers set the content type after the status
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		if w.compress(w.Status()) {
+			header := w.Header()
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			// the encoded body differs from the stored one
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"mos/storage/engine"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxKeys is the default and largest number of names of a page
+const maxKeys = 1000
+
+// ListResponse is a page of the objects of a user outside buckets, NextMarker is the
+// marker of the following page if IsTruncated is set
+type ListResponse struct {
+	Objects     []string `json:"objects"`
+	IsTruncated bool     `json:"is_truncated"`
+	NextMarker  string   `json:"next_marker,omitempty"`
+}
+
+// listObjectsHandler lists the names of the objects of the user outside buckets in
+// order, GET /?prefix=&marker=&max-keys= returns up to max-keys names starting with
+// prefix which sort after marker
+func (s *Server) listObjectsHandler(ctx *gin.Context) {
+	username, ok := requestUser(ctx)
+	if !ok {
+		return
+	}
+	limit := maxKeys
+	if value := ctx.Query("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			renderError(ctx, http.StatusBadRequest, CodeInvalidRequest, "invalid max-keys %q", value)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	prefix := ctx.Query("prefix")
+	marker := ctx.Query("marker")
+	names := make([]string, 0)
+	// the scan starts at the marker and stops once no key left can give one of the first
+	// limit+1 names
+	bound := ""
+	err := s.Engine.ScanFrom(objectKey(username, prefix), objectKey(username, marker), func(key string, entry *engine.Entry) error {
+		if bound != "" && key >= bound {
+			return engine.ErrStopScan
+		}
+		user, bucket, name, _ := parseKey(key)
+		if user != username || bucket != "" {
+			return nil
+		}
+		// chunks are part of the object their manifest describes
+		if strings.HasSuffix(name, manifestSuffix) {
+			name = strings.TrimSuffix(name, manifestSuffix)
+		} else if strings.Contains(name, "/") {
+			return nil
+		}
+		if name <= marker {
+			return nil
+		}
+		names = append(names, name)
+		if bound == "" && len(names) > limit {
+			sort.Strings(names)
+			bound = listBound(username, names[limit])
+		}
+		return nil
+	})
+	if err != nil {
+		renderEngineError(ctx, "list objects error", err)
+		return
+	}
+	// manifests sort after names starting with the object name and a character below /
+	sort.Strings(names)
+	response := &ListResponse{Objects: names}
+	if len(names) > limit {
+		response.Objects = names[:limit]
+		response.IsTruncated = true
+		if limit > 0 {
+			response.NextMarker = names[limit-1]
+		} else {
+			response.NextMarker = marker
+		}
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+// listBound returns the key from which on no object name sorts before name. Names come
+// in key order but for the manifests of objects named by a prefix of name followed by a
+// character below /, the scan is past them at the first of these prefixes followed by 0,
+// the character after /.
+func listBound(username string, name string) string {
+	if i := strings.IndexFunc(name, func(r rune) bool { return r < '/' }); i >= 0 {
+		return objectKey(username, name[:i]) + "0"
+	}
+	return objectKey(username, name)
+}
+
+// DeleteResponse counts the objects deleted by prefix
+type DeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// deleteObjectsHandler deletes the objects of the user whose names start with prefix at
+// once, DELETE /?prefix= deletes objects outside buckets, DELETE /:objectname/?prefix=
+// the ones in a bucket. An empty prefix deletes all of them.
+func (s *Server) deleteObjectsHandler(ctx *gin.Context) {
+	username, ok := requestUser(ctx)
+	if !ok {
+		return
+	}
+	bucket := ctx.Param("objectname")
+	prefix := objectKey(username, ctx.Query("prefix"))
+	if bucket != "" {
+		prefix = bucketKey(username, bucket, ctx.Query("prefix"))
+	}
+	deleted := 0
+	_, err := s.Engine.DeletePrefixCtx(ctx.Request.Context(), []byte(prefix), func(key []byte) bool {
+		user, b, name, _ := parseKey(string(key))
+		if user != username || b != bucket {
+			return false
+		}
+		// chunks are part of the object their manifest describes
+		if strings.HasSuffix(name, manifestSuffix) || !strings.Contains(name, "/") {
+			deleted++
+		}
+		return true
+	})
+	if err != nil {
+		renderEngineError(ctx, "delete objects error", err)
+		return
+	}
+	s.setVersion(ctx)
+	ctx.JSON(http.StatusOK, &DeleteResponse{Deleted: deleted})
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Objects carry the x-mos-meta-* headers they were put with. A value stored in one record
+// starts with its metadata if metaFlag is set in its user flag: a 4 byte length followed
+// by the metadata as a JSON object, objects stored in chunks keep it in their manifest.
+// Objects without metadata are stored as they are.
+const metaHeaderPrefix = "x-mos-meta-"
+
+// metaFlag is the upper bit of the user flag, the lower bits hold the object type
+const metaFlag = byte(1 << 3)
+
+// maxMetaSize bounds the encoded metadata of an object
+const maxMetaSize = 8 << 10
+
+const metaLengthSize = 4
+
+var errMetaTooLarge = errors.New("metadata too large")
+
+// requestMeta returns the x-mos-meta-* headers of a request by their lower case names
+// without the prefix, nil if there are none
+func requestMeta(header http.Header) (map[string]string, error) {
+	var meta map[string]string
+	size := 0
+	for name, values := range header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, metaHeaderPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		value := strings.Join(values, ",")
+		meta[strings.TrimPrefix(name, metaHeaderPrefix)] = value
+		size += len(name) + len(value)
+	}
+	if size > maxMetaSize {
+		return nil, errMetaTooLarge
+	}
+	return meta, nil
+}
+
+// encodeMeta prepends meta to value, value is returned as it is if meta is empty
+func encodeMeta(meta map[string]string, value []byte) ([]byte, error) {
+	if len(meta) == 0 {
+		return value, nil
+	}
+	block, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, metaLengthSize, metaLengthSize+len(block)+len(value))
+	binary.BigEndian.PutUint32(data, uint32(len(block)))
+	return append(append(data, block...), value...), nil
+}
+
+// decodeMeta reads the metadata at the start of a value of size bytes, it returns
+// the metadata and the offset of the object content
+func decodeMeta(r io.ReaderAt, size int64) (map[string]string, int64, error) {
+	length := make([]byte, metaLengthSize)
+	if _, err := r.ReadAt(length, 0); err != nil {
+		return nil, 0, errors.Wrap(err, "read metadata error")
+	}
+	n := int64(binary.BigEndian.Uint32(length))
+	if metaLengthSize+n > size {
+		return nil, 0, errors.New("metadata exceeds the value")
+	}
+	block := make([]byte, n)
+	if _, err := r.ReadAt(block, metaLengthSize); err != nil {
+		return nil, 0, errors.Wrap(err, "read metadata error")
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(block, &meta); err != nil {
+		return nil, 0, errors.Wrap(err, "decode metadata error")
+	}
+	return meta, metaLengthSize + n, nil
+}
+
+func setMetaHeaders(ctx *gin.Context, meta map[string]string) {
+	for name, value := range meta {
+		ctx.Header(metaHeaderPrefix+name, value)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userLimiter is a token bucket per user, a bucket which refilled completely is
+// the same as a new one, so idle users are dropped and the map only holds users
+// active within the time it takes to refill a bucket
+type userLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// swept is when idle buckets were last dropped
+	swept time.Time
+	now   func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newUserLimiter(rate float64, burst int) *userLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &userLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token of user, it returns false and the time until the next token
+// if the bucket is empty
+func (l *userLimiter) allow(user string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+	bucket, ok := l.buckets[user]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[user] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets which refilled, at most once per refill time
+func (l *userLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	for user, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, user)
+		}
+	}
+	l.swept = now
+}
+
+// rateLimit answers the requests of a user beyond UserRate with 429, requests
+// without a user name aren't limited
+func (s *Server) rateLimit(ctx *gin.Context) {
+	username := ctx.GetHeader("x-mos-username")
+	if s.users == nil || username == "" {
+		ctx.Next()
+		return
+	}
+	if ok, wait := s.users.allow(username); !ok {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		renderError(ctx, http.StatusTooManyRequests, CodeTooManyRequests, "user %s exceeds %g requests per second", username, s.UserRate)
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
@@ -2,13 +2,22 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log"
+	"math"
 	"mos/storage/engine"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
@@ -19,10 +28,66 @@ const preallocate = 70000
 type Stats struct {
 	KeyCount int64 `json:"key_count"`
 	Space    int64 `json:"space"`
+	// Buckets breaks the stats of a user down by bucket, objects outside buckets are left out
+	Buckets map[string]*Stats `json:"buckets,omitempty"`
 }
 
+// UsersResponse lists the users with objects on a node
+type UsersResponse struct {
+	Users []string `json:"users"`
+}
+
+// MergeEstimate describes what the next merge would do, Reclaimable is the garbage of
+// the data files it would process
+type MergeEstimate struct {
+	Reclaimable  int64 `json:"reclaimable"`
+	FilesToMerge int   `json:"files_to_merge"`
+}
+
+type MergeResult struct {
+	// Reclaimed is the disk space the merge freed, the size of the merged files less the
+	// size of the files replacing them
+	Reclaimed int64  `json:"reclaimed"`
+	Duration  string `json:"duration"`
+}
+
+// errObjectExists fails a create only put of an existing object
+var errObjectExists = errors.New("object exists")
+
+// DefaultObjectTypes are the object types known to a new server
+var DefaultObjectTypes = []string{"normal", "temporary"}
+
 type Server struct {
 	Engine *engine.MKV
+	// ObjectTypes names the values of the x-mos-object-type header, the index of
+	// a name is the user flag its objects are stored with, up to 8 types are known
+	ObjectTypes []string
+	// ChunkSize splits larger objects into chunks of this size, 0 stores every object in one record
+	ChunkSize int64
+	// ReadOnly serves only reads, writes get 405, it is set if the engine is read only
+	ReadOnly bool
+	// AdminToken guards the admin endpoints, they are disabled if it is empty
+	AdminToken string
+	// ReadTimeout and WriteTimeout bound GET and other requests, zero means no timeout
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// AccessLog logs every request with its request ID, status and duration
+	AccessLog bool
+	// GzipMinSize compresses GET responses of at least this size for clients accepting gzip,
+	// 0 disables compression
+	GzipMinSize int64
+	// MaxConcurrentRequests answers requests beyond this many in flight with 503, which
+	// bounds the memory taken by request bodies, 0 means unlimited
+	MaxConcurrentRequests int
+	// UserRate limits the requests per second of every user, so one user can't take over
+	// the node, further requests get 429, 0 means unlimited. UserBurst is the number of
+	// requests a user may send at once, 0 means UserRate rounded up.
+	UserRate  float64
+	UserBurst int
+	// inFlight holds a token per request in flight if MaxConcurrentRequests is set
+	inFlight chan struct{}
+	// users holds the token buckets of the users if UserRate is set
+	users *userLimiter
 }
 
 func NewServer(config *engine.Config, options ...engine.Option) (*Server, error) {
@@ -30,76 +95,229 @@ func NewServer(config *engine.Config, options ...engine.Option) (*Server, error)
 	if err != nil {
 		return nil, err
 	}
+	chunkSize := int64(DefaultChunkSize)
+	if limit := e.MaxValueSize(); limit > 0 && limit < chunkSize {
+		chunkSize = limit
+	}
 	return &Server{
-		Engine: e,
+		Engine:      e,
+		ObjectTypes: DefaultObjectTypes,
+		ChunkSize:   chunkSize,
+		ReadOnly:    e.ReadOnly(),
 	}, nil
 }
 
 func (s *Server) SetRouter() *gin.Engine {
 	//router := gin.Default()
 	router := gin.New()
-	router.PUT("/:objectname", s.putObjectHandler)
-	router.GET("/:objectname", s.getObjectHandler)
-	router.DELETE("/:objectname", s.deleteObjectHandler)
+	if s.MaxConcurrentRequests > 0 {
+		s.inFlight = make(chan struct{}, s.MaxConcurrentRequests)
+	}
+	if s.UserRate > 0 {
+		s.users = newUserLimiter(s.UserRate, s.UserBurst)
+	}
+	router.Use(s.requestID, s.rateLimit, s.limit, s.timeout, s.gzip)
+	// a read only server registers no write routes, so writes get 405
+	router.HandleMethodNotAllowed = s.ReadOnly
+	router.NoRoute(func(ctx *gin.Context) {
+		renderError(ctx, http.StatusNotFound, CodeNotFound, "no route for %s %s", ctx.Request.Method, ctx.Request.URL.Path)
+	})
+	router.NoMethod(func(ctx *gin.Context) {
+		renderError(ctx, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method %s not allowed", ctx.Request.Method)
+	})
+	// objects in a bucket are routed as /:objectname/:name, so a bucket can't be
+	// named exp, cas or admin
+	for _, path := range []string{"/:objectname", "/:objectname/:name"} {
+		router.GET(path, s.getObjectHandler)
+		router.HEAD(path, s.getObjectHandler)
+		if !s.ReadOnly {
+			router.PUT(path, s.putObjectHandler)
+			router.POST(path, s.copyObjectHandler)
+			router.PATCH(path, s.appendObjectHandler)
+			router.DELETE(path, s.deleteObjectHandler)
+		}
+	}
+	router.GET("/", s.listObjectsHandler)
+	router.GET("/:objectname/", s.listBucketHandler)
+	if !s.ReadOnly {
+		router.DELETE("/", s.adminAuth, s.deleteObjectsHandler)
+		router.DELETE("/:objectname/", s.adminAuth, s.deleteObjectsHandler)
+	}
 
 	router.GET("/stats", s.getStatsHandler)
 
-	router.PUT("/exp/:objectname", s.putObjectHandlerV2)
+	if !s.ReadOnly {
+		router.PUT("/exp/:objectname", s.putObjectHandlerV2)
+		router.POST("/cas", s.putContentHandler)
+	}
+	router.GET("/cas/:hash", s.getContentHandler)
+
+	admin := router.Group("/admin", s.adminAuth)
+	if !s.ReadOnly {
+		admin.POST("/merge", s.mergeHandler)
+	}
+	admin.GET("/merge/estimate", s.getMergeEstimateHandler)
+	admin.GET("/files", s.getFilesHandler)
+	admin.GET("/users", s.getUsersHandler)
 	return router
 }
 
 func (s *Server) putObjectHandler(ctx *gin.Context) {
-	objectname := ctx.Param("objectname")
-	if objectname == "" {
-		ctx.String(http.StatusBadRequest, "empty object name")
+	key, _, ok := requestKey(ctx)
+	if !ok {
 		return
 	}
-	username := ctx.GetHeader("x-mos-username")
-	if username == "" {
-		ctx.String(http.StatusBadRequest, "empty user name")
+	flag, ok := s.objectTypeFlag(ctx.GetHeader("x-mos-object-type"))
+	if !ok {
+		renderError(ctx, http.StatusBadRequest, CodeUnknownObjectType, "unknown object type")
 		return
 	}
-	value, err := io.ReadAll(ctx.Request.Body)
+	meta, err := requestMeta(ctx.Request.Header)
 	if err != nil {
-		ctx.String(http.StatusInternalServerError, "read object content error: %s", err.Error())
+		renderError(ctx, http.StatusBadRequest, CodeInvalidRequest, "%s, at most %d bytes are stored", err.Error(), maxMetaSize)
+		return
+	}
+	// objects are limited to the value size of the engine as a whole, even if stored in chunks
+	limit := s.Engine.MaxValueSize()
+	if limit > 0 && ctx.Request.ContentLength > limit {
+		renderError(ctx, http.StatusRequestEntityTooLarge, CodeObjectTooLarge, "object too large")
 		return
 	}
-	key := []byte(fmt.Sprintf("%s_%s", username, objectname))
-	err = s.Engine.Put(key, value)
+	var body io.Reader = ctx.Request.Body
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	head := body
+	if s.ChunkSize > 0 {
+		head = io.LimitReader(body, s.ChunkSize+1)
+	}
+	value, err := io.ReadAll(head)
 	if err != nil {
-		ctx.String(http.StatusInternalServerError, "store object err: %s", err.Error())
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "read object content error: %s", err.Error())
+		return
+	}
+	// a create only put fails with 409 if the object exists
+	createOnly := ctx.GetHeader("If-None-Match") == "*" || ctx.Query("createOnly") == "1"
+	chunked := s.ChunkSize > 0 && int64(len(value)) > s.ChunkSize
+	// ?return=previous responds with the object the put replaced, which is read atomically
+	// with the put, so it is only supported for objects stored in one record
+	returnPrevious := ctx.Query("return") == "previous"
+	if returnPrevious && (chunked || createOnly) {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidRequest, "return=previous is not supported for create only puts and objects stored in chunks")
+		return
+	}
+	if !chunked && len(meta) > 0 {
+		if value, err = encodeMeta(meta, value); err != nil {
+			renderError(ctx, http.StatusInternalServerError, CodeInternal, "encode metadata error: %s", err.Error())
+			return
+		}
+		flag |= metaFlag
+	}
+	var size int64
+	var previous []byte
+	var previousInfo *engine.ObjectInfo
+	if chunked {
+		size, err = s.putChunked(ctx.Request.Context(), key, value, body, flag, meta, createOnly)
+	} else if createOnly {
+		// the object may be stored in chunks
+		var written bool
+		written, err = s.Engine.PutIfAbsentCtx(ctx.Request.Context(), []byte(key), value, flag, []byte(manifestKey(key)))
+		if err == nil && !written {
+			err = errObjectExists
+		}
+		size = s.Engine.RecordSize([]byte(key), value)
+	} else {
+		if returnPrevious {
+			// nor is the object replaced if it is stored in chunks, which is checked under
+			// the lock of the put so that a concurrent chunked put can't slip in between
+			previous, previousInfo, err = s.Engine.PutAndGetPreviousCtx(ctx.Request.Context(), []byte(key), value, flag, []byte(manifestKey(key)))
+			if err == engine.ErrPreconditionFailed {
+				renderError(ctx, http.StatusConflict, CodeObjectChunked, "return=previous is not supported for objects stored in chunks")
+				return
+			}
+			size = s.Engine.RecordSize([]byte(key), value)
+		} else {
+			size, err = s.Engine.PutNCtxWithFlag(ctx.Request.Context(), []byte(key), value, flag)
+		}
+		if err == nil {
+			// the object may replace one stored in chunks
+			err = s.deleteChunked(ctx.Request.Context(), key, nil)
+			if err == engine.ErrKeyNotFound {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		renderEngineError(ctx, "store object err", err)
+		return
+	}
+	ctx.Header("x-mos-stored-size", strconv.FormatInt(size, 10))
+	s.setVersion(ctx)
+	if returnPrevious {
+		s.renderPrevious(ctx, previous, previousInfo)
 		return
 	}
 	ctx.String(http.StatusOK, "object have been stored")
 	return
 }
 
-func (s *Server) putObjectHandlerV2(ctx *gin.Context) {
-	objectname := ctx.Param("objectname")
-	if objectname == "" {
-		ctx.String(http.StatusBadRequest, "empty object name")
+// renderPrevious responds with the object a put replaced and its headers, or with 204
+// if there was none
+func (s *Server) renderPrevious(ctx *gin.Context, previous []byte, info *engine.ObjectInfo) {
+	if info == nil {
+		ctx.Status(http.StatusNoContent)
 		return
 	}
-	username := ctx.GetHeader("x-mos-username")
-	if username == "" {
-		ctx.String(http.StatusBadRequest, "empty user name")
+	var offset int64
+	if info.UserFlag&metaFlag != 0 {
+		meta, n, err := decodeMeta(bytes.NewReader(previous), int64(len(previous)))
+		if err != nil {
+			renderError(ctx, http.StatusInternalServerError, CodeInternal, "get previous object error: %s", err.Error())
+			return
+		}
+		setMetaHeaders(ctx, meta)
+		offset = n
+	}
+	s.setObjectHeaders(ctx, info)
+	ctx.Data(http.StatusOK, "application/octet-stream", previous[offset:])
+}
+
+// objectTypeFlag returns the user flag of the named object type, an empty name is the first type
+func (s *Server) objectTypeFlag(name string) (byte, bool) {
+	if name == "" {
+		return 0, true
+	}
+	for i, t := range s.ObjectTypes {
+		if t == name && i < int(metaFlag) {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) putObjectHandlerV2(ctx *gin.Context) {
+	key, _, ok := requestKey(ctx)
+	if !ok {
 		return
 	}
-	key := fmt.Sprintf("%s_%s", username, objectname)
 	data, err := formData(ctx, key)
 	if err != nil {
-		ctx.String(http.StatusInternalServerError, "form data error: %s", err.Error())
+		renderEngineError(ctx, "form data error", err)
 		return
 	}
 	if err := s.Engine.PutData(data, key); err != nil {
-		ctx.String(http.StatusInternalServerError, "store object err: %s", err.Error())
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "store object err: %s", err.Error())
 		return
 	}
+	s.setVersion(ctx)
 	ctx.String(http.StatusOK, "object have been stored")
 	return
 }
 
 func formData(ctx *gin.Context, key string) ([]byte, error) {
+	if len(key) > engine.MaxKeySize {
+		return nil, engine.ErrKeyTooLarge
+	}
 	buf := make([]byte, 0, preallocate)
 	buffer := bytes.NewBuffer(buf)
 	buffer.WriteByte(engine.NormalFlag)
@@ -114,6 +332,11 @@ func formData(ctx *gin.Context, key string) ([]byte, error) {
 		return nil, err
 	}
 	data := buffer.Bytes()
+	if n > math.MaxUint32 {
+		// values over 4GiB need the wide record header
+		record := engine.NewRecordWithoutChecksum(engine.NormalFlag, []byte(key), data[7+len(key):])
+		return engine.EncodeRecordWithChecksum(record), nil
+	}
 	binary.BigEndian.PutUint32(data[3:7], uint32(n))
 	checksum := crc32.ChecksumIEEE(data)
 	if err := binary.Write(buffer, binary.BigEndian, checksum); err != nil {
@@ -123,76 +346,489 @@ func formData(ctx *gin.Context, key string) ([]byte, error) {
 }
 
 func (s *Server) getObjectHandler(ctx *gin.Context) {
-	objectname := ctx.Param("objectname")
-	if objectname == "" {
-		ctx.String(http.StatusBadRequest, "empty object name")
+	name, objectname, ok := requestKey(ctx)
+	if !ok {
+		return
+	}
+	if !s.checkMinVersion(ctx) {
 		return
 	}
-	username := ctx.GetHeader("x-mos-username")
-	if username == "" {
-		ctx.String(http.StatusBadRequest, "empty user name")
+	key := []byte(name)
+	if version := ctx.Query("version"); version != "" {
+		s.getObjectVersion(ctx, key, version)
 		return
 	}
-	key := []byte(fmt.Sprintf("%s_%s", username, objectname))
-	value, err := s.Engine.Get(key)
+	r, size, info, err := s.Engine.OpenReaderAtWithInfo(ctx.Request.Context(), key)
 	if err != nil {
 		if err == engine.ErrKeyNotFound {
-			ctx.String(http.StatusNotFound, "object not found")
+			s.getChunked(ctx, objectname, string(key))
 			return
 		}
-		ctx.String(http.StatusInternalServerError, "get object error: %s", err.Error())
+		renderEngineError(ctx, "get object error", err)
 		return
 	}
-	ctx.Data(http.StatusOK, "application/octet-stream", value)
+	var offset int64
+	if info.UserFlag&metaFlag != 0 {
+		var meta map[string]string
+		meta, offset, err = decodeMeta(r, size)
+		if err != nil {
+			renderError(ctx, http.StatusInternalServerError, CodeInternal, "get object error: %s", err.Error())
+			return
+		}
+		setMetaHeaders(ctx, meta)
+	}
+	s.setObjectHeaders(ctx, info)
+	// ServeContent handles ranges and conditional requests, the content type
+	// follows from the object name
+	http.ServeContent(ctx.Writer, ctx.Request, objectname, info.ModTime, io.NewSectionReader(r, offset, size-offset))
 	return
 }
 
-func (s *Server) deleteObjectHandler(ctx *gin.Context) {
-	objectname := ctx.Param("objectname")
-	if objectname == "" {
-		ctx.String(http.StatusBadRequest, "empty object name")
+// setVersion returns the sequence number of the engine after a write, it is at least
+// the one of the write, so a node which reached it is known to hold the write
+func (s *Server) setVersion(ctx *gin.Context) {
+	ctx.Header("x-mos-version", strconv.FormatUint(s.Engine.Seq(), 10))
+}
+
+// checkMinVersion responds with 503 if the engine hasn't reached the sequence number in
+// x-mos-min-version, a read passing the version of a write then sees it or a later one
+func (s *Server) checkMinVersion(ctx *gin.Context) bool {
+	header := ctx.GetHeader("x-mos-min-version")
+	if header == "" {
+		return true
+	}
+	version, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidVersion, "invalid min version")
+		return false
+	}
+	if seq := s.Engine.Seq(); seq < version {
+		renderError(ctx, http.StatusServiceUnavailable, CodeVersionNotReached, "version %d not reached, node is at %d", version, seq)
+		return false
+	}
+	return true
+}
+
+func (s *Server) setObjectHeaders(ctx *gin.Context, info *engine.ObjectInfo) {
+	ctx.Header("ETag", etag(info))
+	ctx.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	if t := info.UserFlag &^ metaFlag; int(t) < len(s.ObjectTypes) {
+		ctx.Header("x-mos-object-type", s.ObjectTypes[t])
+	}
+}
+
+func (s *Server) getObjectVersion(ctx *gin.Context, key []byte, version string) {
+	n, err := strconv.Atoi(version)
+	if err != nil || n < 0 {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidVersion, "invalid version")
 		return
 	}
-	username := ctx.GetHeader("x-mos-username")
-	if username == "" {
-		ctx.String(http.StatusBadRequest, "empty user name")
+	value, info, err := s.Engine.GetVersionWithInfo(key, n)
+	if err != nil {
+		if err == engine.ErrKeyNotFound {
+			renderError(ctx, http.StatusNotFound, CodeNotFound, "object version not found")
+			return
+		}
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "get object error: %s", err.Error())
 		return
 	}
-	key := []byte(fmt.Sprintf("%s_%s", username, objectname))
-	err := s.Engine.Delete(key)
+	if info.UserFlag&metaFlag != 0 {
+		meta, offset, err := decodeMeta(bytes.NewReader(value), int64(len(value)))
+		if err != nil {
+			renderError(ctx, http.StatusInternalServerError, CodeInternal, "get object error: %s", err.Error())
+			return
+		}
+		setMetaHeaders(ctx, meta)
+		value = value[offset:]
+	}
+	ctx.Data(http.StatusOK, "application/octet-stream", value)
+}
+
+func (s *Server) deleteObjectHandler(ctx *gin.Context) {
+	key, _, ok := requestKey(ctx)
+	if !ok {
+		return
+	}
+	var err error
+	ifMatch := ctx.GetHeader("If-Match")
+	ifUnmodifiedSince := ctx.GetHeader("If-Unmodified-Since")
+	if ifMatch == "" && ifUnmodifiedSince == "" {
+		err = s.Engine.DeleteCtx(ctx.Request.Context(), []byte(key))
+		if err == nil {
+			if err = s.deleteChunked(ctx.Request.Context(), key, nil); err == engine.ErrKeyNotFound {
+				err = nil
+			}
+		}
+	} else {
+		cond := func(info *engine.ObjectInfo) error {
+			return checkPreconditions(info, ifMatch, ifUnmodifiedSince)
+		}
+		err = s.Engine.DeleteIf(ctx.Request.Context(), []byte(key), cond)
+		if err == engine.ErrKeyNotFound {
+			err = s.deleteChunked(ctx.Request.Context(), key, cond)
+		}
+	}
 	if err != nil {
-		ctx.String(http.StatusInternalServerError, "delete object error: %s", err.Error())
+		// a missing key has no stored version to match
+		if errors.Cause(err) == engine.ErrPreconditionFailed || err == engine.ErrKeyNotFound {
+			renderError(ctx, http.StatusPreconditionFailed, CodePreconditionFailed, "precondition failed")
+			return
+		}
+		renderEngineError(ctx, "delete object error", err)
 		return
 	}
+	s.setVersion(ctx)
 	ctx.String(http.StatusOK, "object have been deleted")
 	return
 }
 
+// appendObjectHandler appends the body to the object atomically, a missing object is created.
+// Objects stored in chunks can't be appended to.
+func (s *Server) appendObjectHandler(ctx *gin.Context) {
+	key, _, ok := requestKey(ctx)
+	if !ok {
+		return
+	}
+	limit := s.Engine.MaxValueSize()
+	if limit > 0 && ctx.Request.ContentLength > limit {
+		renderError(ctx, http.StatusRequestEntityTooLarge, CodeObjectTooLarge, "object too large")
+		return
+	}
+	var body io.Reader = ctx.Request.Body
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	suffix, err := io.ReadAll(body)
+	if err != nil {
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "read object content error: %s", err.Error())
+		return
+	}
+	if _, err := s.getManifest(ctx.Request.Context(), key); err != engine.ErrKeyNotFound {
+		if err == nil {
+			renderError(ctx, http.StatusConflict, CodeObjectChunked, "object is stored in chunks")
+			return
+		}
+		renderEngineError(ctx, "append object error", err)
+		return
+	}
+	if err := s.Engine.AppendCtx(ctx.Request.Context(), []byte(key), suffix); err != nil {
+		renderEngineError(ctx, "append object error", err)
+		return
+	}
+	s.setVersion(ctx)
+	ctx.String(http.StatusOK, "object have been appended")
+}
+
+// copyObjectHandler copies the object named by x-mos-copy-source to the object of the request,
+// with x-mos-move: true the source is removed. The proxy routes by the destination only, so
+// both objects must be stored on the same node.
+func (s *Server) copyObjectHandler(ctx *gin.Context) {
+	dst, _, ok := requestKey(ctx)
+	if !ok {
+		return
+	}
+	src, ok := sourceKey(ctx)
+	if !ok {
+		return
+	}
+	if src == dst {
+		renderError(ctx, http.StatusBadRequest, CodeInvalidCopySource, "copy source is the object itself")
+		return
+	}
+	move := ctx.GetHeader("x-mos-move") == "true"
+	var err error
+	if move {
+		err = s.Engine.MoveCtx(ctx.Request.Context(), []byte(src), []byte(dst))
+	} else {
+		err = s.Engine.CopyCtx(ctx.Request.Context(), []byte(src), []byte(dst))
+	}
+	if err == nil {
+		// the copy replaces an object stored in chunks under dst
+		if err = s.deleteChunked(ctx.Request.Context(), dst, nil); err == engine.ErrKeyNotFound {
+			err = nil
+		}
+	} else if err == engine.ErrKeyNotFound {
+		err = s.copyChunked(ctx.Request.Context(), src, dst, move)
+	}
+	if err != nil {
+		if err == engine.ErrKeyNotFound {
+			renderError(ctx, http.StatusNotFound, CodeNotFound, "copy source not found")
+			return
+		}
+		renderEngineError(ctx, "copy object error", err)
+		return
+	}
+	s.setVersion(ctx)
+	ctx.String(http.StatusOK, "object have been copied")
+}
+
+func etag(info *engine.ObjectInfo) string {
+	return fmt.Sprintf("\"%08x\"", info.Checksum)
+}
+
+// checkPreconditions checks If-Match and If-Unmodified-Since against the stored version
+func checkPreconditions(info *engine.ObjectInfo, ifMatch string, ifUnmodifiedSince string) error {
+	if ifMatch != "" {
+		matched := false
+		for _, tag := range strings.Split(ifMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == etag(info) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.Wrap(engine.ErrPreconditionFailed, "etag mismatch")
+		}
+	}
+	if ifUnmodifiedSince != "" {
+		// an invalid date is ignored, http dates have second precision
+		t, err := http.ParseTime(ifUnmodifiedSince)
+		if err == nil && info.ModTime.Truncate(time.Second).After(t) {
+			return errors.Wrap(engine.ErrPreconditionFailed, "modified since")
+		}
+	}
+	return nil
+}
+
+// getStatsHandler reports the keys and space of every user, with ?disk=1 it reports
+// the disk usage of the store instead
 func (s *Server) getStatsHandler(ctx *gin.Context) {
+	if ctx.Query("disk") == "1" {
+		ctx.JSON(http.StatusOK, s.Engine.Stats())
+		return
+	}
 	user2stats := make(map[string]*Stats)
 	f := func(key string, entry *engine.Entry) error {
-		username, _, found := strings.Cut(key, "_")
+		username, bucket, rest, found := parseKey(key)
 		if !found {
 			return errors.New("invalid key")
 		}
 		stats := user2stats[username]
 		if stats == nil {
 			stats = new(Stats)
+			user2stats[username] = stats
+		}
+		all := []*Stats{stats}
+		if bucket != "" {
+			if stats.Buckets == nil {
+				stats.Buckets = make(map[string]*Stats)
+			}
+			if stats.Buckets[bucket] == nil {
+				stats.Buckets[bucket] = new(Stats)
+			}
+			all = append(all, stats.Buckets[bucket])
+		}
+		for _, stats := range all {
+			// chunks are part of the object their manifest describes
+			if !strings.Contains(rest, "/") || strings.HasSuffix(rest, manifestSuffix) {
+				stats.KeyCount += 1
+			}
+			stats.Space += int64(entry.Size)
 		}
-		stats.KeyCount += 1
-		stats.Space += int64(entry.Size)
-		user2stats[username] = stats
 		return nil
 	}
 	err := s.Engine.Walk(f)
 	if err != nil {
-		ctx.String(http.StatusInternalServerError, "get stats error: %s", err.Error())
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "get stats error: %s", err.Error())
 		return
 	}
 	ctx.JSON(http.StatusOK, user2stats)
 	return
 }
 
+// getUsersHandler lists the users with objects, sorted, without the accounting of
+// getStatsHandler. It walks all keys, so only admins may. Keys of no user, like content
+// addressed objects and their links, are skipped, a user name never contains a slash.
+func (s *Server) getUsersHandler(ctx *gin.Context) {
+	seen := make(map[string]struct{})
+	users := []string{}
+	err := s.Engine.Walk(func(key string, entry *engine.Entry) error {
+		username, _, _, found := parseKey(key)
+		if !found || username == "" || strings.Contains(username, "/") {
+			return nil
+		}
+		if _, ok := seen[username]; !ok {
+			seen[username] = struct{}{}
+			users = append(users, username)
+		}
+		return nil
+	})
+	if err != nil {
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "get users error: %s", err.Error())
+		return
+	}
+	sort.Strings(users)
+	ctx.JSON(http.StatusOK, &UsersResponse{Users: users})
+}
+
+func (s *Server) getMergeEstimateHandler(ctx *gin.Context) {
+	reclaimable, files := s.Engine.MergeEstimate()
+	ctx.JSON(http.StatusOK, &MergeEstimate{
+		Reclaimable:  reclaimable,
+		FilesToMerge: files,
+	})
+	return
+}
+
+// timeout gives the request context a deadline, engine operations still
+// waiting when it passes give up and the handlers answer 503
+func (s *Server) timeout(ctx *gin.Context) {
+	timeout := s.WriteTimeout
+	if ctx.Request.Method == http.MethodGet || ctx.Request.Method == http.MethodHead {
+		timeout = s.ReadTimeout
+	}
+	if timeout <= 0 {
+		ctx.Next()
+		return
+	}
+	c, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+	defer cancel()
+	ctx.Request = ctx.Request.WithContext(c)
+	ctx.Next()
+}
+
+// requestIDKey is the request context key of the request ID
+type requestIDKey struct{}
+
+// requestID takes the request ID from X-Request-ID, which the proxy sets, or generates
+// one for requests sent to the node directly. The ID is returned in the response and
+// added to the request context, so logs of the request can be correlated with the proxy.
+func (s *Server) requestID(ctx *gin.Context) {
+	id := ctx.GetHeader("X-Request-ID")
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx.Header("X-Request-ID", id)
+	ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), requestIDKey{}, id))
+	start := time.Now()
+	ctx.Next()
+	if s.AccessLog {
+		log.Printf("request_id=%s method=%s path=%s status=%d duration=%s",
+			id, ctx.Request.Method, ctx.Request.URL.Path, ctx.Writer.Status(), time.Since(start))
+	}
+}
+
+// requestIDOf returns the request ID of a request context, it is empty outside requests
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// limit rejects requests beyond MaxConcurrentRequests rather than queueing them,
+// so the client backs off instead of the server running out of memory
+func (s *Server) limit(ctx *gin.Context) {
+	if s.inFlight == nil {
+		ctx.Next()
+		return
+	}
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		ctx.Header("Retry-After", "1")
+		renderError(ctx, http.StatusServiceUnavailable, CodeOverloaded, "too many requests in flight")
+		ctx.Abort()
+		return
+	}
+	defer func() { <-s.inFlight }()
+	ctx.Next()
+}
+
+func (s *Server) adminAuth(ctx *gin.Context) {
+	// the comparison takes as long wherever the token differs
+	token := ctx.GetHeader("x-mos-admin-token")
+	if s.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		renderError(ctx, http.StatusForbidden, CodeForbidden, "admin token required")
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+func (s *Server) mergeHandler(ctx *gin.Context) {
+	if ctx.GetHeader("Accept") == "text/event-stream" {
+		s.mergeStream(ctx)
+		return
+	}
+	start := time.Now()
+	var reclaimed int64
+	err := s.Engine.MergeWithProgress(func(p engine.MergeProgress) {
+		reclaimed = p.Reclaimed
+	})
+	if err != nil {
+		if err == engine.ErrMergeInProgress {
+			renderError(ctx, http.StatusConflict, CodeMergeInProgress, "merge in progress")
+			return
+		}
+		if err == engine.ErrMergeAborted {
+			renderError(ctx, http.StatusServiceUnavailable, CodeUnavailable, "merge aborted, the store is closing")
+			return
+		}
+		renderError(ctx, http.StatusInternalServerError, CodeInternal, "merge error: %s", err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, &MergeResult{
+		Reclaimed: reclaimed,
+		Duration:  time.Since(start).String(),
+	})
+	return
+}
+
+// mergeStream merges and sends progress events while it runs, followed by a
+// result or error event. Progress the client can't keep up with is skipped.
+func (s *Server) mergeStream(ctx *gin.Context) {
+	start := time.Now()
+	progress := make(chan engine.MergeProgress, 1)
+	done := make(chan error, 1)
+	var reclaimed int64
+	go func() {
+		done <- s.Engine.MergeWithProgress(func(p engine.MergeProgress) {
+			reclaimed = p.Reclaimed
+			select {
+			case <-progress:
+			default:
+			}
+			progress <- p
+		})
+	}()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case p := <-progress:
+			ctx.SSEvent("progress", p)
+			return true
+		case err := <-done:
+			// progress sent right before the end is still reported
+			select {
+			case p := <-progress:
+				ctx.SSEvent("progress", p)
+			default:
+			}
+			if err != nil {
+				ctx.SSEvent("error", newErrorDetail(CodeInternal, "merge error: %s", err.Error()))
+				return false
+			}
+			ctx.SSEvent("result", &MergeResult{
+				Reclaimed: reclaimed,
+				Duration:  time.Since(start).String(),
+			})
+			return false
+		}
+	})
+}
+
+func (s *Server) getFilesHandler(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, s.Engine.DataFiles())
+	return
+}
+
 func (s *Server) Close() error {
 	return s.Engine.Close()
 }
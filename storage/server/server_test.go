@@ -2,12 +2,17 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mos/storage/engine"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -98,6 +103,566 @@ func TestStats(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestPutStoredSize(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(nil)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	expected := []byte(fmt.Sprintf("%01024d", 123))
+	req, err := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader(expected))
+	require.Nil(t, err)
+	req.Header.Set("x-mos-username", "admin")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	// flag, key size, value size, key, value and checksum
+	size := 1 + 2 + 4 + len("admin_test") + len(expected) + 4
+	assert.Equal(t, strconv.Itoa(size), recorder.Header().Get("x-mos-stored-size"))
+}
+
+func TestMergeEstimate(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(nil)
+	require.Nil(t, err)
+	defer s.Close()
+	s.AdminToken = "secret"
+
+	router := s.SetRouter()
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader(value))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	// the estimate is an admin endpoint
+	req, err := http.NewRequest("GET", "http://localhost:8080/admin/merge/estimate", nil)
+	require.Nil(t, err)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	req.Header.Set("x-mos-admin-token", "secret")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	estimate := new(MergeEstimate)
+	err = json.Unmarshal(recorder.Body.Bytes(), estimate)
+	require.Nil(t, err)
+	// the first put is garbage now
+	size := 1 + 2 + 4 + len("admin_test") + len(value) + 4
+	assert.Equal(t, int64(size), estimate.Reclaimable)
+	assert.Equal(t, 1, estimate.FilesToMerge)
+}
+
+func TestAdminMerge(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(nil)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader(value))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	// admin endpoints are disabled without a token
+	req, err := http.NewRequest("POST", "http://localhost:8080/admin/merge", nil)
+	require.Nil(t, err)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	s.AdminToken = "secret"
+	for _, token := range []string{"wrong", "secreT", "secre", "secrets"} {
+		req.Header.Set("x-mos-admin-token", token)
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	}
+
+	req.Header.Set("x-mos-admin-token", "secret")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	result := new(MergeResult)
+	err = json.Unmarshal(recorder.Body.Bytes(), result)
+	require.Nil(t, err)
+	size := 1 + 2 + 4 + len("admin_test") + len(value) + 4
+	assert.Equal(t, int64(size), result.Reclaimed)
+	reclaimable, _ := s.Engine.MergeEstimate()
+	assert.Equal(t, int64(0), reclaimable)
+}
+
+func TestAdminMergeReclaimed(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 2048
+	config.MergeMaxFiles = 1
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.AdminToken = "secret"
+
+	router := s.SetRouter()
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	for i := 0; i < 6; i++ {
+		req, err := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader(value))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	before := diskBytes(s)
+	req, err := http.NewRequest("POST", "http://localhost:8080/admin/merge", nil)
+	require.Nil(t, err)
+	req.Header.Set("x-mos-admin-token", "secret")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	result := new(MergeResult)
+	err = json.Unmarshal(recorder.Body.Bytes(), result)
+	require.Nil(t, err)
+	// only the oldest file is merged, the garbage of the others stays
+	assert.Greater(t, s.Engine.Stats().ReusableBytes, int64(0))
+	assert.Greater(t, result.Reclaimed, int64(0))
+	assert.Equal(t, before-diskBytes(s), result.Reclaimed)
+}
+
+// diskBytes is the size of all data files of the server
+func diskBytes(s *Server) int64 {
+	var size int64
+	for _, file := range s.Engine.DataFiles() {
+		size += file.Size
+	}
+	return size
+}
+
+// slowFileSystem opens files whose Sync takes delay, syncing holds the engine lock
+type slowFileSystem struct {
+	delay   time.Duration
+	syncing chan struct{}
+}
+
+func (fs *slowFileSystem) OpenFile(name string, flag int, perm os.FileMode) (engine.File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{File: file, fs: fs}, nil
+}
+
+type slowFile struct {
+	*os.File
+	fs *slowFileSystem
+}
+
+func (f *slowFile) Sync() error {
+	select {
+	case f.fs.syncing <- struct{}{}:
+	default:
+	}
+	time.Sleep(f.fs.delay)
+	return f.File.Sync()
+}
+
+func TestTimeout(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.SyncWrite = true
+	fs := &slowFileSystem{delay: 500 * time.Millisecond, syncing: make(chan struct{}, 1)}
+	config.FileSystem = fs
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ReadTimeout = 50 * time.Millisecond
+	s.WriteTimeout = 5 * time.Second
+
+	router := s.SetRouter()
+	value := []byte(fmt.Sprintf("%01024d", 123))
+	done := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader(value))
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		done <- recorder.Code
+	}()
+	<-fs.syncing
+	// the slow put holds the lock past the read timeout
+	req, err := http.NewRequest("GET", "http://localhost:8080/test", nil)
+	require.Nil(t, err)
+	req.Header.Set("x-mos-username", "admin")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, value, recorder.Body.Bytes())
+}
+
+func TestConditionalDelete(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(nil)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	request := func(method string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080/test", bytes.NewReader([]byte("value")))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, request("PUT", nil).Code)
+	recorder := request("GET", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	tag := recorder.Header().Get("ETag")
+	require.NotEmpty(t, tag)
+	lastModified, err := http.ParseTime(recorder.Header().Get("Last-Modified"))
+	require.Nil(t, err)
+
+	assert.Equal(t, http.StatusPreconditionFailed, request("DELETE", map[string]string{"If-Match": `"00000000"`}).Code)
+	before := lastModified.Add(-time.Second).Format(http.TimeFormat)
+	assert.Equal(t, http.StatusPreconditionFailed, request("DELETE", map[string]string{"If-Unmodified-Since": before}).Code)
+	assert.Equal(t, http.StatusOK, request("GET", nil).Code)
+
+	header := map[string]string{
+		"If-Match":            tag,
+		"If-Unmodified-Since": lastModified.Format(http.TimeFormat),
+	}
+	assert.Equal(t, http.StatusOK, request("DELETE", header).Code)
+	assert.Equal(t, http.StatusNotFound, request("GET", nil).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, request("DELETE", map[string]string{"If-Match": "*"}).Code)
+}
+
+func TestGetVersion(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxVersions = 2
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	for _, value := range []string{"old", "new"} {
+		req, err := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader([]byte(value)))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	for version, expected := range map[string]string{"0": "new", "1": "old"} {
+		req, err := http.NewRequest("GET", "http://localhost:8080/test?version="+version, nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, expected, recorder.Body.String())
+	}
+	for version, code := range map[string]int{"2": http.StatusNotFound, "x": http.StatusBadRequest} {
+		req, err := http.NewRequest("GET", "http://localhost:8080/test?version="+version, nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, code, recorder.Code)
+	}
+}
+
+func TestObjectType(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	for objectType, code := range map[string]int{"temporary": http.StatusOK, "unknown": http.StatusBadRequest} {
+		req, err := http.NewRequest("PUT", "http://localhost:8080/test", bytes.NewReader([]byte("value")))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		req.Header.Set("x-mos-object-type", objectType)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, code, recorder.Code)
+	}
+	req, err := http.NewRequest("GET", "http://localhost:8080/test", nil)
+	require.Nil(t, err)
+	req.Header.Set("x-mos-username", "admin")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "temporary", recorder.Header().Get("x-mos-object-type"))
+}
+
+func TestChunkedObject(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+
+	router := s.SetRouter()
+	do := func(method string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080/test", strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	keys := func() []string {
+		var keys []string
+		err := s.Engine.Walk(func(key string, entry *engine.Entry) error {
+			keys = append(keys, key)
+			return nil
+		})
+		require.Nil(t, err)
+		return keys
+	}
+
+	for _, value := range []string{"0123456789", "01234567", "large object"} {
+		assert.Equal(t, http.StatusOK, do("PUT", value).Code)
+		recorder := do("GET", "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, value, recorder.Body.String())
+		assert.NotEmpty(t, recorder.Header().Get("ETag"))
+		// the chunks of replaced objects are removed
+		assert.Len(t, keys(), (len(value)+3)/4+1)
+	}
+
+	// ranges may span chunks, conditional requests are answered from the manifest
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost:8080/test", nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, do("PUT", "0123456789").Code)
+	recorder := get(map[string]string{"Range": "bytes=3-8"})
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "345678", recorder.Body.String())
+	assert.Equal(t, "bytes 3-8/10", recorder.Header().Get("Content-Range"))
+	recorder = get(map[string]string{"Range": "bytes=-2"})
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "89", recorder.Body.String())
+	tag := recorder.Header().Get("ETag")
+	recorder = get(map[string]string{"If-None-Match": tag})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+	recorder = get(map[string]string{"If-None-Match": `"other"`})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "0123456789", recorder.Body.String())
+
+	assert.Equal(t, http.StatusOK, do("PUT", "abc").Code)
+	assert.Equal(t, "abc", do("GET", "").Body.String())
+	assert.Equal(t, []string{"admin_test"}, keys())
+
+	assert.Equal(t, http.StatusOK, do("PUT", "0123456789").Code)
+	assert.Equal(t, http.StatusOK, do("DELETE", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "").Code)
+	assert.Empty(t, keys())
+}
+
+func TestMaxValueSize(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxValueSize = 1024
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	require.Equal(t, int64(1024), s.ChunkSize)
+
+	router := s.SetRouter()
+	for _, chunkSize := range []int64{0, 256} {
+		s.ChunkSize = chunkSize
+		for size, code := range map[int]int{1024: http.StatusOK, 1025: http.StatusRequestEntityTooLarge} {
+			value := strings.Repeat("x", size)
+			req, err := http.NewRequest("PUT", "http://localhost:8080/test", strings.NewReader(value))
+			require.Nil(t, err)
+			req.Header.Set("x-mos-username", "admin")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			assert.Equal(t, code, recorder.Code)
+
+			// without a content length the body is cut off at the limit
+			req, err = http.NewRequest("PUT", "http://localhost:8080/test", io.NopCloser(strings.NewReader(value)))
+			require.Nil(t, err)
+			req.Header.Set("x-mos-username", "admin")
+			recorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			assert.Equal(t, code, recorder.Code)
+		}
+	}
+}
+
+func TestAdminMergeStream(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.DataFileMaxSize = 256
+	config.MergeMaxFiles = 1
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.AdminToken = "secret"
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 10; i++ {
+			err := s.Engine.Put([]byte(fmt.Sprintf("admin_test%d", i)), []byte("value"))
+			require.Nil(t, err)
+		}
+	}
+	require.Greater(t, s.Engine.Stats().ReusableBytes, int64(0))
+	before := diskBytes(s)
+	server := httptest.NewServer(s.SetRouter())
+	defer server.Close()
+	req, err := http.NewRequest("POST", server.URL+"/admin/merge", nil)
+	require.Nil(t, err)
+	req.Header.Set("x-mos-admin-token", "secret")
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(body), "event:progress")
+	assert.Contains(t, string(body), `"files_done":1`)
+	last := string(body[strings.LastIndex(string(body), "event:"):])
+	assert.True(t, strings.HasPrefix(last, "event:result"))
+	// the result reports the space freed once the merge is done, only the oldest file is merged
+	result := new(MergeResult)
+	err = json.Unmarshal([]byte(strings.TrimSpace(last[strings.Index(last, "data:")+len("data:"):])), result)
+	require.Nil(t, err)
+	assert.Greater(t, s.Engine.Stats().ReusableBytes, int64(0))
+	assert.Greater(t, result.Reclaimed, int64(0))
+	assert.Equal(t, before-diskBytes(s), result.Reclaimed)
+}
+
+func TestServeContent(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(method string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080/test.txt", strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, do("PUT", "0123456789", nil).Code)
+
+	recorder := do("GET", "", map[string]string{"Range": "bytes=2-4"})
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "234", recorder.Body.String())
+	assert.Equal(t, "bytes 2-4/10", recorder.Header().Get("Content-Range"))
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	tag := recorder.Header().Get("ETag")
+
+	recorder = do("GET", "", map[string]string{"If-None-Match": tag})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	recorder = do("GET", "", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	recorder = do("GET", "", map[string]string{"If-None-Match": `"other"`})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "0123456789", recorder.Body.String())
+}
+
+func TestAdminFiles(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(nil)
+	require.Nil(t, err)
+	defer s.Close()
+	s.AdminToken = "secret"
+
+	router := s.SetRouter()
+	err = s.Engine.Put([]byte("admin_test"), []byte("value"))
+	require.Nil(t, err)
+	err = s.Engine.Merge()
+	require.Nil(t, err)
+	req, err := http.NewRequest("GET", "http://localhost:8080/admin/files", nil)
+	require.Nil(t, err)
+	req.Header.Set("x-mos-admin-token", "secret")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var files []engine.DataFileInfo
+	err = json.Unmarshal(recorder.Body.Bytes(), &files)
+	require.Nil(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, 0, files[0].ID)
+	assert.False(t, files[0].Active)
+	assert.Equal(t, int64(1+2+4+len("admin_test")+len("value")+4), files[0].Size)
+	assert.Equal(t, filepath.Join(config.RootDirectory, "00000000.data"), files[0].Path)
+	assert.True(t, files[1].Active)
+	assert.Equal(t, int64(0), files[1].Size)
+}
+
 func TestBasicOperation(t *testing.T) {
 	config := engine.DefaultConfig()
 	err := os.RemoveAll(config.RootDirectory)
@@ -206,8 +771,8 @@ func TestPutObjectToServer(t *testing.T) {
 		require.Nil(t, err)
 		req.Header.Set("x-mos-username", username)
 		resp, err := client.Do(req)
-		defer resp.Body.Close()
 		require.Nil(t, err)
+		defer resp.Body.Close()
 
 		// validate object has been successfully put
 		require.Equal(t, http.StatusOK, resp.StatusCode)
@@ -252,8 +817,8 @@ func TestGetObjectFromServer(t *testing.T) {
 		require.Nil(t, err)
 		req.Header.Set("x-mos-username", username)
 		resp, err := client.Do(req)
-		defer resp.Body.Close()
 		require.Nil(t, err)
+		defer resp.Body.Close()
 		require.Equal(t, http.StatusOK, resp.StatusCode)
 		actual, err := io.ReadAll(resp.Body)
 		require.Nil(t, err)
@@ -274,3 +839,945 @@ func TestGetObjectFromServer(t *testing.T) {
 	wg.Wait()
 	fmt.Println("getting 100000 64KiB objects from server and validating successfully, it takes:", time.Since(start))
 }
+
+func TestReadOnlyServer(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	require.False(t, s.ReadOnly)
+	router := s.SetRouter()
+	do := func(method string, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader("value"))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		req.Header.Set("x-mos-admin-token", "token")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	require.Equal(t, http.StatusOK, do("PUT", "http://localhost:8080/test").Code)
+	err = s.Close()
+	require.Nil(t, err)
+
+	config.ReadOnly = true
+	s, err = NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	require.True(t, s.ReadOnly)
+	s.AdminToken = "token"
+	router = s.SetRouter()
+	recorder := do("GET", "http://localhost:8080/test")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "value", recorder.Body.String())
+	assert.Equal(t, http.StatusOK, do("HEAD", "http://localhost:8080/test").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("PUT", "http://localhost:8080/test").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("DELETE", "http://localhost:8080/test").Code)
+	assert.Equal(t, http.StatusOK, do("GET", "http://localhost:8080/admin/files").Code)
+}
+
+func TestBuckets(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+
+	router := s.SetRouter()
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "user")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, do("PUT", "/a", "flat").Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/my_bucket/a", "in").Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/my_bucket/c", "c").Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/my_bucket/b", "chunked object").Code)
+	// the same object name in another bucket is another object
+	assert.Equal(t, http.StatusOK, do("PUT", "/other/a", "other").Code)
+
+	assert.Equal(t, "flat", do("GET", "/a", "").Body.String())
+	assert.Equal(t, "in", do("GET", "/my_bucket/a", "").Body.String())
+	assert.Equal(t, "chunked object", do("GET", "/my_bucket/b", "").Body.String())
+	assert.Equal(t, http.StatusNotFound, do("GET", "/my_bucket/d", "").Code)
+
+	recorder := do("GET", "/my_bucket/", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `["a", "b", "c"]`, recorder.Body.String())
+	assert.JSONEq(t, `[]`, do("GET", "/empty/", "").Body.String())
+
+	recorder = do("GET", "/stats", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stats map[string]*Stats
+	err = json.Unmarshal(recorder.Body.Bytes(), &stats)
+	require.Nil(t, err)
+	require.Contains(t, stats, "user")
+	assert.Equal(t, int64(5), stats["user"].KeyCount)
+	assert.Equal(t, int64(3), stats["user"].Buckets["my_bucket"].KeyCount)
+	assert.Equal(t, int64(1), stats["user"].Buckets["other"].KeyCount)
+
+	assert.Equal(t, http.StatusOK, do("DELETE", "/my_bucket/b", "").Code)
+	assert.JSONEq(t, `["a", "c"]`, do("GET", "/my_bucket/", "").Body.String())
+	assert.Equal(t, "flat", do("GET", "/a", "").Body.String())
+
+	req, err := http.NewRequest("PUT", "http://localhost:8080/a", strings.NewReader("value"))
+	require.Nil(t, err)
+	req.Header.Set("x-mos-username", "user/1")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestUserNames(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(method string, path string, username string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", username)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	require.Equal(t, http.StatusOK, do("PUT", "/b_c", "a", "x").Code)
+	// user a_b and object c would share the key of user a and object b_c
+	for _, username := range []string{"a_b", "a/b"} {
+		for _, request := range [][2]string{{"PUT", "/c"}, {"GET", "/c"}, {"GET", "/"}, {"GET", "/bucket/"}} {
+			recorder := do(request[0], request[1], username, "x")
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, "%s %s %s", username, request[0], request[1])
+			assert.Contains(t, recorder.Body.String(), CodeInvalidUserName)
+		}
+	}
+	assert.Equal(t, "x", do("GET", "/b_c", "a", "").Body.String())
+	assert.JSONEq(t, `{"objects": ["b_c"], "is_truncated": false}`, do("GET", "/", "a", "").Body.String())
+}
+
+func TestCopyObject(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+
+	router := s.SetRouter()
+	do := func(method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	copyFrom := func(source string) map[string]string {
+		return map[string]string{"x-mos-copy-source": source}
+	}
+	moveFrom := func(source string) map[string]string {
+		return map[string]string{"x-mos-copy-source": source, "x-mos-move": "true"}
+	}
+	assert.Equal(t, http.StatusOK, do("PUT", "/a", "abc", nil).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/bucket/a", "", copyFrom("a")).Code)
+	assert.Equal(t, "abc", do("GET", "/bucket/a", "", nil).Body.String())
+	assert.Equal(t, http.StatusOK, do("POST", "/b", "", moveFrom("bucket/a")).Code)
+	assert.Equal(t, "abc", do("GET", "/b", "", nil).Body.String())
+	assert.Equal(t, http.StatusNotFound, do("GET", "/bucket/a", "", nil).Code)
+
+	// chunks are copied, so deleting the source keeps the copy
+	assert.Equal(t, http.StatusOK, do("PUT", "/chunked", "chunked object", nil).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/a", "", copyFrom("chunked")).Code)
+	assert.Equal(t, http.StatusOK, do("DELETE", "/chunked", "", nil).Code)
+	assert.Equal(t, "chunked object", do("GET", "/a", "", nil).Body.String())
+	assert.Equal(t, http.StatusOK, do("POST", "/b", "", moveFrom("a")).Code)
+	assert.Equal(t, "chunked object", do("GET", "/b", "", nil).Body.String())
+	assert.Equal(t, http.StatusNotFound, do("GET", "/a", "", nil).Code)
+
+	// a plain copy replaces a chunked object
+	assert.Equal(t, http.StatusOK, do("PUT", "/c", "c", nil).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/b", "", copyFrom("c")).Code)
+	assert.Equal(t, "c", do("GET", "/b", "", nil).Body.String())
+
+	assert.Equal(t, http.StatusNotFound, do("POST", "/d", "", copyFrom("missing")).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/c", "", copyFrom("c")).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/c", "", nil).Code)
+
+	// only objects and manifests are left
+	recorder := do("GET", "/stats", "", nil)
+	var stats map[string]*Stats
+	err = json.Unmarshal(recorder.Body.Bytes(), &stats)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), stats["admin"].KeyCount)
+	keys := 0
+	err = s.Engine.Walk(func(key string, entry *engine.Entry) error {
+		keys++
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 2, keys)
+}
+
+func TestCreateOnly(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+
+	router := s.SetRouter()
+	do := func(method string, url string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	noneMatch := map[string]string{"If-None-Match": "*"}
+	recorder := do("PUT", "/a", "abc", noneMatch)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "21", recorder.Header().Get("x-mos-stored-size"))
+	assert.Equal(t, http.StatusConflict, do("PUT", "/a", "def", noneMatch).Code)
+	assert.Equal(t, http.StatusConflict, do("PUT", "/a?createOnly=1", "def", nil).Code)
+	assert.Equal(t, http.StatusConflict, do("PUT", "/a", "chunked object", noneMatch).Code)
+	assert.Equal(t, "abc", do("GET", "/a", "", nil).Body.String())
+
+	// chunked objects exist as well
+	assert.Equal(t, http.StatusOK, do("PUT", "/b?createOnly=1", "chunked object", nil).Code)
+	assert.Equal(t, http.StatusConflict, do("PUT", "/b", "b", noneMatch).Code)
+	assert.Equal(t, http.StatusConflict, do("PUT", "/b", "other chunked object", noneMatch).Code)
+	assert.Equal(t, "chunked object", do("GET", "/b", "", nil).Body.String())
+	// a failed create only put leaves no chunks behind
+	keys := 0
+	err = s.Engine.Walk(func(key string, entry *engine.Entry) error {
+		keys++
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 1+1+4, keys)
+
+	// a plain put still overwrites
+	assert.Equal(t, http.StatusOK, do("PUT", "/a", "def", nil).Code)
+	assert.Equal(t, "def", do("GET", "/a", "", nil).Body.String())
+}
+
+func TestAppendObject(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxValueSize = 1024
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+
+	router := s.SetRouter()
+	do := func(method string, url string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, do("PATCH", "/log", "a").Code)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, do("PATCH", "/log", "b").Code)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "a"+strings.Repeat("b", 10), do("GET", "/log", "").Body.String())
+	assert.Equal(t, http.StatusRequestEntityTooLarge, do("PATCH", "/log", strings.Repeat("c", 1024)).Code)
+
+	assert.Equal(t, http.StatusOK, do("PUT", "/chunked", "chunked object").Code)
+	assert.Equal(t, http.StatusConflict, do("PATCH", "/chunked", "a").Code)
+}
+
+func TestDiskStats(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(method string, url string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, http.StatusOK, do("PUT", "/a", "abc").Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/a", "def").Code)
+	recorder := do("GET", "/stats?disk=1", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stats engine.Stats
+	err = json.Unmarshal(recorder.Body.Bytes(), &stats)
+	require.Nil(t, err)
+	assert.Equal(t, 1, stats.Keys)
+	assert.Equal(t, int64(21), stats.LiveBytes)
+	assert.Equal(t, int64(11), stats.OverheadBytes)
+	assert.Equal(t, int64(42), stats.DiskBytes)
+	assert.Equal(t, int64(21), stats.GarbageBytes)
+	assert.Equal(t, int64(21), stats.ReusableBytes)
+}
+
+func TestMinVersion(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(method string, url string, body string, minVersion string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		if minVersion != "" {
+			req.Header.Set("x-mos-min-version", minVersion)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := do("PUT", "/a", "abc", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("x-mos-version"))
+	recorder = do("DELETE", "/a", "", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("x-mos-version"))
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/a", "", "2").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, do("GET", "/a", "", "3").Code)
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/a", "", "x").Code)
+}
+
+func TestRequestID(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(id string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost:8080/a", nil)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	assert.Equal(t, "abc", do("abc").Header().Get("X-Request-ID"))
+	first := do("").Header().Get("X-Request-ID")
+	assert.NotEmpty(t, first)
+	assert.NotEqual(t, first, do("").Header().Get("X-Request-ID"))
+}
+
+func TestGzip(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.GzipMinSize = 100
+	s.ChunkSize = 1000
+
+	router := s.SetRouter()
+	do := func(method string, url string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	decode := func(recorder *httptest.ResponseRecorder) string {
+		require.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+		r, err := gzip.NewReader(recorder.Body)
+		require.Nil(t, err)
+		data, err := io.ReadAll(r)
+		require.Nil(t, err)
+		return string(data)
+	}
+	text := strings.Repeat("some text ", 50)
+	chunked := strings.Repeat("chunked text ", 100)
+	assert.Equal(t, http.StatusOK, do("PUT", "/a.txt", text, nil).Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/small.txt", "small", nil).Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/chunked", chunked, nil).Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/a.png", text, nil).Code)
+	gzipped := map[string]string{"Accept-Encoding": "gzip, deflate"}
+
+	recorder := do("GET", "/a.txt", "", gzipped)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("ETag"), "W/"))
+	assert.Equal(t, text, decode(recorder))
+	assert.Equal(t, chunked, decode(do("GET", "/chunked", "", gzipped)))
+
+	// small, compressed media, range and unaccepted responses are sent as they are
+	for _, recorder := range []*httptest.ResponseRecorder{
+		do("GET", "/small.txt", "", gzipped),
+		do("GET", "/a.png", "", gzipped),
+		do("GET", "/a.txt", "", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-199"}),
+		do("GET", "/a.txt", "", map[string]string{"Accept-Encoding": "gzip;q=0"}),
+		do("GET", "/a.txt", "", nil),
+	} {
+		assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+		assert.NotContains(t, recorder.Header().Get("ETag"), "W/")
+	}
+	assert.Equal(t, "small", do("GET", "/small.txt", "", gzipped).Body.String())
+}
+
+func TestErrorResponse(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxValueSize = 8
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(method string, url string, username string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", username)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	for _, c := range []struct {
+		recorder *httptest.ResponseRecorder
+		status   int
+		code     string
+	}{
+		{do("GET", "/a", "", ""), http.StatusBadRequest, CodeEmptyUserName},
+		{do("GET", "/a", "admin", ""), http.StatusNotFound, CodeNotFound},
+		{do("PUT", "/a", "admin", "too large value"), http.StatusRequestEntityTooLarge, CodeObjectTooLarge},
+		{do("GET", "/a?version=x", "admin", ""), http.StatusBadRequest, CodeInvalidVersion},
+		{do("POST", "/admin/merge", "admin", ""), http.StatusForbidden, CodeForbidden},
+		{do("GET", "/a/b/c", "admin", ""), http.StatusNotFound, CodeNotFound},
+	} {
+		assert.Equal(t, c.status, c.recorder.Code)
+		var resp ErrorResponse
+		err := json.Unmarshal(c.recorder.Body.Bytes(), &resp)
+		require.Nil(t, err)
+		assert.Equal(t, c.code, resp.Error.Code)
+		assert.NotEmpty(t, resp.Error.Message)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.MaxConcurrentRequests = 2
+
+	router := s.SetRouter()
+	do := func(method string, url string, body io.Reader) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+url, body)
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	// puts whose bodies haven't arrived yet take up the limit
+	var writers []*io.PipeWriter
+	done := make(chan int, s.MaxConcurrentRequests)
+	for i := 0; i < s.MaxConcurrentRequests; i++ {
+		r, w := io.Pipe()
+		writers = append(writers, w)
+		go func(i int) {
+			done <- do("PUT", fmt.Sprintf("/%d", i), r).Code
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		return len(s.inFlight) == s.MaxConcurrentRequests
+	}, time.Second, time.Millisecond)
+	recorder := do("GET", "/0", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusServiceUnavailable, do("PUT", "/2", strings.NewReader("value")).Code)
+
+	for _, w := range writers {
+		w.Write([]byte("value"))
+		w.Close()
+	}
+	for range writers {
+		assert.Equal(t, http.StatusOK, <-done)
+	}
+	assert.Equal(t, http.StatusOK, do("GET", "/0", nil).Code)
+}
+
+func TestListObjects(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+
+	router := s.SetRouter()
+	do := func(method string, path string, username string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", username)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	list := func(query string) *ListResponse {
+		recorder := do("GET", "/?"+query, "user", "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var response ListResponse
+		err := json.Unmarshal(recorder.Body.Bytes(), &response)
+		require.Nil(t, err)
+		return &response
+	}
+	// b is stored in chunks, objects in buckets and of other users aren't listed
+	for _, name := range []string{"a", "b", "b.txt", "c", "d"} {
+		body := "x"
+		if name == "b" {
+			body = "chunked object"
+		}
+		require.Equal(t, http.StatusOK, do("PUT", "/"+name, "user", body).Code)
+	}
+	require.Equal(t, http.StatusOK, do("PUT", "/bucket/e", "user", "x").Code)
+	require.Equal(t, http.StatusOK, do("PUT", "/f", "other", "x").Code)
+	// nor the ones of users whose names start with the name of the user
+	for _, username := range []string{"us", "user-2", "users"} {
+		require.Equal(t, http.StatusOK, do("PUT", "/er_g", username, "x").Code)
+	}
+	require.Equal(t, http.StatusBadRequest, do("GET", "/", "user_a", "").Code)
+
+	response := list("")
+	assert.Equal(t, []string{"a", "b", "b.txt", "c", "d"}, response.Objects)
+	assert.False(t, response.IsTruncated)
+	assert.Empty(t, response.NextMarker)
+
+	// pages continue after the marker of the previous one
+	var names []string
+	marker := ""
+	pages := 0
+	for {
+		response := list("max-keys=2&marker=" + marker)
+		names = append(names, response.Objects...)
+		pages++
+		if !response.IsTruncated {
+			break
+		}
+		require.Len(t, response.Objects, 2)
+		marker = response.NextMarker
+	}
+	assert.Equal(t, []string{"a", "b", "b.txt", "c", "d"}, names)
+	assert.Equal(t, 3, pages)
+
+	response = list("prefix=b&max-keys=1")
+	assert.Equal(t, []string{"b"}, response.Objects)
+	assert.True(t, response.IsTruncated)
+	assert.Equal(t, "b", response.NextMarker)
+	response = list("prefix=b&marker=b")
+	assert.Equal(t, []string{"b.txt"}, response.Objects)
+	assert.False(t, response.IsTruncated)
+	assert.Equal(t, []string{}, list("marker=d").Objects)
+	// the manifest of b comes after b.txt in key order
+	response = list("marker=a&max-keys=2")
+	assert.Equal(t, []string{"b", "b.txt"}, response.Objects)
+	assert.True(t, response.IsTruncated)
+	assert.Equal(t, "b.txt", response.NextMarker)
+
+	recorder := do("GET", "/", "us", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"objects": ["er_g"], "is_truncated": false}`, recorder.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/?max-keys=x", "user", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/", "", "").Code)
+}
+
+func TestObjectMeta(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+	config.MaxVersions = 2
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 8
+
+	router := s.SetRouter()
+	do := func(method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "user")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	meta := map[string]string{"x-mos-meta-Foo": "bar", "X-Mos-Meta-Owner": "alice", "x-mos-object-type": "temporary"}
+	for _, body := range []string{"value", "chunked object"} {
+		require.Equal(t, http.StatusOK, do("PUT", "/object", body, meta).Code)
+		for _, method := range []string{"GET", "HEAD"} {
+			recorder := do(method, "/object", "", nil)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "bar", recorder.Header().Get("x-mos-meta-foo"))
+			assert.Equal(t, "alice", recorder.Header().Get("x-mos-meta-owner"))
+			assert.Equal(t, "temporary", recorder.Header().Get("x-mos-object-type"))
+			assert.Equal(t, strconv.Itoa(len(body)), recorder.Header().Get("Content-Length"))
+			if method == "GET" {
+				assert.Equal(t, body, recorder.Body.String())
+			}
+		}
+		// copies keep the metadata
+		require.Equal(t, http.StatusOK, do("POST", "/copy", "", map[string]string{"x-mos-copy-source": "object"}).Code)
+		recorder := do("GET", "/copy", "", nil)
+		assert.Equal(t, body, recorder.Body.String())
+		assert.Equal(t, "bar", recorder.Header().Get("x-mos-meta-foo"))
+	}
+
+	// ranges and appends apply to the content only
+	require.Equal(t, http.StatusOK, do("PUT", "/object", "value", meta).Code)
+	recorder := do("GET", "/object", "", map[string]string{"Range": "bytes=1-2"})
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "al", recorder.Body.String())
+	require.Equal(t, http.StatusOK, do("PATCH", "/object", "s", nil).Code)
+	recorder = do("GET", "/object", "", nil)
+	assert.Equal(t, "values", recorder.Body.String())
+	assert.Equal(t, "bar", recorder.Header().Get("x-mos-meta-foo"))
+
+	// objects without metadata are stored as they are
+	require.Equal(t, http.StatusOK, do("PUT", "/object", "plain", nil).Code)
+	value, err := s.Engine.Get([]byte(objectKey("user", "object")))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("plain"), value)
+	recorder = do("GET", "/object", "", nil)
+	assert.Equal(t, "plain", recorder.Body.String())
+	assert.Empty(t, recorder.Header().Get("x-mos-meta-foo"))
+	recorder = do("GET", "/object?version=1", "", nil)
+	assert.Equal(t, "values", recorder.Body.String())
+	assert.Equal(t, "alice", recorder.Header().Get("x-mos-meta-owner"))
+
+	large := map[string]string{"x-mos-meta-large": strings.Repeat("x", maxMetaSize)}
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "/object", "value", large).Code)
+}
+
+func TestContentAddressed(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	router := s.SetRouter()
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := do("POST", "/cas", "value")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var response CASResponse
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	require.Nil(t, err)
+	require.Equal(t, "cd42404d52ad55ccfa9aca4adc828aa5800ad9d385a0671fbcbf724118320619", response.Hash)
+
+	// storing the same content again returns the same hash
+	recorder = do("POST", "/cas", "value")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Contains(t, recorder.Body.String(), response.Hash)
+
+	recorder = do("GET", "/cas/"+response.Hash, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "value", recorder.Body.String())
+	require.Equal(t, `"`+response.Hash+`"`, recorder.Header().Get("ETag"))
+
+	recorder = do("GET", "/cas/"+strings.Repeat("0", 64), "")
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+	// other keys of the engine aren't readable as content
+	recorder = do("GET", "/cas/user_object", "")
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestDeleteObjects(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 4
+	s.AdminToken = "secret"
+
+	router := s.SetRouter()
+	do := func(method string, path string, username string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", username)
+		req.Header.Set("x-mos-admin-token", "secret")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	// b is stored in chunks, the object in the bucket and the ones of other users stay
+	for _, path := range []string{"/a", "/b", "/c", "/bucket/a"} {
+		require.Equal(t, http.StatusOK, do("PUT", path, "user", "value of "+path).Code)
+	}
+	require.Equal(t, http.StatusOK, do("PUT", "/a", "user2", "value").Code)
+
+	recorder := do("DELETE", "/?prefix=c", "user", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"deleted":1}`, recorder.Body.String())
+	require.Equal(t, http.StatusNotFound, do("GET", "/c", "user", "").Code)
+	require.Equal(t, http.StatusOK, do("GET", "/a", "user", "").Code)
+
+	recorder = do("DELETE", "/", "user", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"deleted":2}`, recorder.Body.String())
+	for _, path := range []string{"/a", "/b"} {
+		require.Equal(t, http.StatusNotFound, do("GET", path, "user", "").Code)
+	}
+	require.Equal(t, http.StatusOK, do("GET", "/bucket/a", "user", "").Code)
+	require.Equal(t, http.StatusOK, do("GET", "/a", "user2", "").Code)
+	// chunks and manifests are gone with their objects
+	err = s.Engine.Scan("user_", func(key string, entry *engine.Entry) error {
+		if _, bucket, _, _ := parseKey(key); bucket == "" {
+			return fmt.Errorf("key %s left", key)
+		}
+		return nil
+	})
+	require.Nil(t, err)
+
+	recorder = do("DELETE", "/bucket/", "user", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"deleted":1}`, recorder.Body.String())
+	require.Equal(t, http.StatusNotFound, do("GET", "/bucket/a", "user", "").Code)
+
+	// users whose names start like the one of the deleting user keep their objects, a
+	// name with an underscore could clash with its keys and is refused
+	for _, username := range []string{"a", "a-b", "ab"} {
+		require.Equal(t, http.StatusOK, do("PUT", "/b_c", username, "value").Code)
+	}
+	recorder = do("DELETE", "/", "a_b", "")
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.Equal(t, http.StatusOK, do("GET", "/b_c", "a", "").Code)
+	recorder = do("DELETE", "/", "a", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"deleted":1}`, recorder.Body.String())
+	require.Equal(t, http.StatusNotFound, do("GET", "/b_c", "a", "").Code)
+	for _, username := range []string{"a-b", "ab"} {
+		require.Equal(t, http.StatusOK, do("GET", "/b_c", username, "").Code)
+	}
+
+	// bulk deletes need the admin token
+	req, err := http.NewRequest("DELETE", "http://localhost:8080/", nil)
+	require.Nil(t, err)
+	req.Header.Set("x-mos-username", "user2")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestUsers(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.AdminToken = "secret"
+
+	router := s.SetRouter()
+	do := func(method string, path string, username string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", username)
+		req.Header.Set("x-mos-admin-token", "secret")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := do("GET", "/admin/users", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"users":[]}`, recorder.Body.String())
+
+	require.Equal(t, http.StatusOK, do("PUT", "/a", "bob", "value").Code)
+	require.Equal(t, http.StatusOK, do("PUT", "/b", "bob", "value").Code)
+	require.Equal(t, http.StatusOK, do("PUT", "/a", "alice", "value").Code)
+	require.Equal(t, http.StatusOK, do("PUT", "/bucket/a_b", "carol", "value").Code)
+	require.Equal(t, http.StatusOK, do("PUT", "/b_c", "a", "value").Code)
+	// content addressed objects and links belong to no user
+	recorder = do("POST", "/cas", "", "value")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var response CASResponse
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	require.Nil(t, err)
+	err = s.Engine.Link([]byte("link_name"), response.Hash)
+	require.Nil(t, err)
+
+	recorder = do("GET", "/admin/users", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"users":["a","alice","bob","carol"]}`, recorder.Body.String())
+
+	// listing users needs the admin token
+	req, err := http.NewRequest("GET", "http://localhost:8080/admin/users", nil)
+	require.Nil(t, err)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestUserRate(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.UserRate = 1
+	s.UserBurst = 2
+
+	router := s.SetRouter()
+	now := time.Now()
+	s.users.now = func() time.Time { return now }
+	do := func(username string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "http://localhost:8080/test", strings.NewReader("value"))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", username)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	require.Equal(t, http.StatusOK, do("alice").Code)
+	require.Equal(t, http.StatusOK, do("alice").Code)
+	recorder := do("alice")
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	require.Contains(t, recorder.Body.String(), CodeTooManyRequests)
+	// other users have buckets of their own
+	require.Equal(t, http.StatusOK, do("bob").Code)
+
+	now = now.Add(time.Second)
+	require.Equal(t, http.StatusOK, do("alice").Code)
+	require.Equal(t, http.StatusTooManyRequests, do("alice").Code)
+
+	// idle users are dropped once their buckets refilled
+	require.Len(t, s.users.buckets, 2)
+	now = now.Add(2 * time.Second)
+	require.Equal(t, http.StatusOK, do("bob").Code)
+	require.Len(t, s.users.buckets, 1)
+}
+
+func TestPutReturnPrevious(t *testing.T) {
+	config := engine.DefaultConfig()
+	err := os.RemoveAll(config.RootDirectory)
+	require.Nil(t, err)
+
+	s, err := NewServer(config)
+	require.Nil(t, err)
+	defer s.Close()
+	s.ChunkSize = 16
+
+	router := s.SetRouter()
+	do := func(method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("x-mos-username", "admin")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder := do("PUT", "/test?return=previous", "first", map[string]string{"x-mos-meta-color": "red"})
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+	require.Empty(t, recorder.Body.String())
+
+	recorder = do("PUT", "/test?return=previous", "second", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "first", recorder.Body.String())
+	require.Equal(t, "red", recorder.Header().Get("x-mos-meta-color"))
+	require.NotEmpty(t, recorder.Header().Get("x-mos-version"))
+
+	recorder = do("GET", "/test", "", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "second", recorder.Body.String())
+
+	recorder = do("PUT", "/test?return=previous", strings.Repeat("x", 32), nil)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = do("PUT", "/other?return=previous", "value", map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// an object stored in chunks isn't replaced, it couldn't be returned
+	recorder = do("PUT", "/chunked", strings.Repeat("x", 32), nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = do("PUT", "/chunked?return=previous", "value", nil)
+	require.Equal(t, http.StatusConflict, recorder.Code)
+	recorder = do("GET", "/chunked", "", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, strings.Repeat("x", 32), recorder.Body.String())
+}